@@ -4,11 +4,21 @@ import (
 	"encoding/binary"
 	"errors"
 
-	"github.com/tendermint/tendermint/crypto/ed25519"
-
+	"github.com/vocdoni/arbo"
 	"go.vocdoni.io/dvote/db"
 )
 
+// account leaf layout:
+// [ 8 bytes | 32 bytes   | 48 bytes | 4 bytes | 32 bytes (optional) ]
+// [ amount  | ed25519 pk | bls pk   | counter | state               ]
+const (
+	accAmountEnd  = 8
+	accPubKeyEnd  = 40
+	accBlsKeyEnd  = 88
+	accCounterEnd = 92
+	accStateEnd   = 124
+)
+
 type Account struct {
 	Address       []byte
 	Data          []byte
@@ -18,7 +28,7 @@ type Account struct {
 	//pop           []byte
 	counter  []byte
 	Counter  uint32
-	Amount   uint32
+	Amount   uint64
 	Modified bool
 	isNew    bool
 }
@@ -28,105 +38,126 @@ func (app *App) fetchAccount(address []byte) (*Account, error) {
 
 	//maybe a previous tx has been delivered but not yet written to db
 	//check the map of temp accounts for a changed amount
-	logs.log("searching account in temporary memory...")
+	execLogs.log("searching account in temporary memory...")
 
 	var key [4]byte
 	copy(key[:], address)
 
-	v, ok := app.tempAccountMap[key]
+	//mempool checks see the committed state and their own pending txs only
+	cache := app.tempAccountMap
+	if app.checking {
+		cache = app.checkAccountMap
+	}
+
+	v, ok := cache[key]
 	if ok {
 		account = v
 		return account, nil
 	}
 
 	//read from db
-	logs.log("fetching account from internal database...")
+	execLogs.log("fetching account from internal database...")
 
 	_, value, err := app.accountTree.Get(address)
 	if err != nil {
 		return nil, errors.New("Miss accountTree entry")
 	}
 
-	if len(value) < 88 {
+	if len(value) < accCounterEnd {
 		return nil, errors.New("Not enough data, some error occurred")
 	}
 
 	//fill values
 	account.Data = value[:]
 	account.Address = address
-	account.schnorrPubKey = value[4:36]
-	account.Amount = binary.BigEndian.Uint32(account.Data[:4])
+	account.schnorrPubKey = value[accAmountEnd:accPubKeyEnd]
+	account.Amount = binary.BigEndian.Uint64(account.Data[:accAmountEnd])
 	account.fetchCounter()
 	account.fetchState()
 
-	app.tempAccountMap[key] = account
-	logs.logAccount(account)
+	cache[key] = account
+	execLogs.logAccount(account)
 
 	return account, nil
 }
 
 func (account *Account) fetchCounter() {
-	if len(account.Data) < 88 {
+	if len(account.Data) < accCounterEnd {
 		account.Counter = 0
 	} else {
-		account.counter = account.Data[84:88]
+		account.counter = account.Data[accBlsKeyEnd:accCounterEnd]
 		account.Counter = binary.BigEndian.Uint32(account.counter)
 	}
 }
 
 func (account *Account) fetchState() {
-	if len(account.Data) == 120 {
-		account.State = account.Data[88:]
+	if len(account.Data) == accStateEnd {
+		account.State = account.Data[accCounterEnd:]
 	}
 }
 
-func (app *App) commitAccountsToDb() {
-	logs.log("Commiting accounts to db... ")
+func (app *App) commitAccountsToDb() error {
+	execLogs.log("Commiting accounts to db... ")
 
 	accBatch := db.NewBatch(app.accountLedgerDb)
+	defer accBatch.Discard()
 	wAc := app.accountDb.WriteTx()
+	defer wAc.Discard()
 
 	for _, account := range app.tempAccountMap {
 		if account.Modified {
-			account.commitAccountToDb(app, accBatch, wAc)
+			err := account.commitAccountToDb(app, accBatch, wAc)
+			if err != nil {
+				return err
+			}
 		}
 	}
 
 	for _, account := range app.tempNewAccountMap {
 		if account.Modified {
-			account.commitNewAccountToDb(app, accBatch, wAc)
+			err := account.commitNewAccountToDb(app, accBatch, wAc)
+			if err != nil {
+				return err
+			}
 		}
 	}
 
 	//write deliver txs results on db
-	wAc.Commit()
-	wAc.Discard()
-	accBatch.Commit()
-	accBatch.Discard()
+	err := wAc.Commit()
+	if err != nil {
+		return err
+	}
+	err = accBatch.Commit()
+	if err != nil {
+		return err
+	}
 
 	//reset account cache
 	app.tempAccountMap = make(map[[4]byte]*Account)
 	app.tempNewAccountMap = make(map[[4]byte]*Account)
+	return nil
 }
 
-func (account *Account) commitAccountToDb(app *App, accBatch *db.Batch, wAc db.WriteTx) {
+func (account *Account) commitAccountToDb(app *App, accBatch *db.Batch, wAc db.WriteTx) error {
 	//add to the stream to be commited to db
 	err := app.accountTree.UpdateWithTx(wAc, account.Address, account.Data)
 	if err != nil {
-		logs.logError("Acctree update FATAL ERROR!!!", err)
-		panic(err)
+		execLogs.logError("Acctree update FATAL ERROR!!!", err)
+		return err
 	}
 
 	// reset the Modified flag
 	account.Modified = false
+	return nil
 }
 
-func (account *Account) commitNewAccountToDb(app *App, accBatch *db.Batch, wAc db.WriteTx) {
+func (account *Account) commitNewAccountToDb(app *App, accBatch *db.Batch, wAc db.WriteTx) error {
 
 	//add to the stream to be commited to db
-	err1 := app.accountTree.AddWithTx(wAc, account.Address, account.Data)
-	if err1 != nil {
-		logs.logError("Acctree update FATAL ERROR!!!", err1)
+	err := app.accountTree.AddWithTx(wAc, account.Address, account.Data)
+	if err != nil {
+		execLogs.logError("Acctree update FATAL ERROR!!!", err)
+		return err
 	}
 
 	// reset the Modified flag
@@ -137,50 +168,30 @@ func (account *Account) commitNewAccountToDb(app *App, accBatch *db.Batch, wAc d
 	//the following section creates a db with the bls pubkeys as keys
 	//and account addresses as values (only if account watch is set)
 	if !app.accountWatch {
-		return
+		return nil
 	}
-	if len(account.Data) < 84 {
-		return
+	if len(account.Data) < accBlsKeyEnd {
+		return nil
 	}
-	err := accBatch.Set(account.Data[36:84], account.Address)
+	err = accBatch.Set(account.Data[accPubKeyEnd:accBlsKeyEnd], account.Address)
 	if err != nil {
-		logs.logError("ACCOUNT DB WRITE ERROR!!!", err)
+		execLogs.logError("ACCOUNT DB WRITE ERROR!!!", err)
+		return err
 	}
-}
-
-func (app *App) createTemplateAccount(seed []byte, amount uint32) {
-	//produce keypair
-	privkey := ed25519.GenPrivKeyFromSecret(seed)
-	pubkey := privkey.PubKey()
-
-	//create and fund account
-	account := new(Account)
-	account.isNew = true
-	account.Amount = amount
-
-	//find next account address
-	account.nextAccountAddr(app)
-
-	//create raw account data
-	pad := make([]byte, 64)
-	account.Data = append(pad[0:4], pubkey.Bytes()...)
-	account.Data = append(account.Data, pad...)
-
-	//write to Dbs
-	account.writeAccount(app)
+	return nil
 }
 
 func (account *Account) writeAccount(app *App) {
-	logs.log("Writting...  ")
+	execLogs.log("Writting...  ")
 
 	//create new array to avoid writing on slice coming from tx
-	newData := make([]byte, 120)
+	newData := make([]byte, accStateEnd)
 
 	//fill the array with values
-	binary.BigEndian.PutUint32(newData[:4], account.Amount)
-	copy(newData[4:84], account.Data[4:84])
-	binary.BigEndian.PutUint32(newData[84:88], account.Counter)
-	account.Data = append(newData[:88], account.State...)
+	binary.BigEndian.PutUint64(newData[:accAmountEnd], account.Amount)
+	copy(newData[accAmountEnd:accBlsKeyEnd], account.Data[accAmountEnd:accBlsKeyEnd])
+	binary.BigEndian.PutUint32(newData[accBlsKeyEnd:accCounterEnd], account.Counter)
+	account.Data = append(newData[:accCounterEnd], account.State...)
 
 	//update temp account cache
 	var key [4]byte
@@ -192,28 +203,57 @@ func (account *Account) writeAccount(app *App) {
 		app.tempAccountMap[key] = account
 	}
 
-	logs.logAccount(account)
+	execLogs.logAccount(account)
 }
 
 func (app *App) findAccountByPubKey(blskey []byte) (*Account, error) {
 	rTx := app.accountLedgerDb.ReadTx()
 	address, err := rTx.Get(blskey)
 	if err != nil {
-		logs.log("Failed to get address by bls key: ")
+		execLogs.log("Failed to get address by bls key: ")
 		return nil, err
 	}
 
 	account, err := app.fetchAccount(address)
 	if err != nil {
-		logs.logError("Account can't be found: ", err)
+		execLogs.logError("Account can't be found: ", err)
 		return nil, err
 	}
-	logs.log("Found account:")
-	logs.logAccount(account)
+	execLogs.log("Found account:")
+	execLogs.logAccount(account)
 
 	return account, nil
 }
 
+// indexAccountLedger writes the bls key of every account of the tree to the
+// ledger, for trees restored from a snapshot (only if account watch is set)
+func (app *App) indexAccountLedger() error {
+	if !app.accountWatch {
+		return nil
+	}
+
+	var keys, addresses [][]byte
+	err := iterateLeaves(app.accountTree, func(k, data []byte) {
+		if len(data) >= accBlsKeyEnd {
+			keys = append(keys, append([]byte{}, data[accPubKeyEnd:accBlsKeyEnd]...))
+			addresses = append(addresses, append([]byte{}, k...))
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	accBatch := db.NewBatch(app.accountLedgerDb)
+	defer accBatch.Discard()
+	for i, key := range keys {
+		err = accBatch.Set(key, addresses[i])
+		if err != nil {
+			return err
+		}
+	}
+	return accBatch.Commit()
+}
+
 func (account *Account) nextAccountAddr(app *App) {
 	//find next account address
 	nextaddr := app.accountNumOnDb
@@ -222,3 +262,88 @@ func (account *Account) nextAccountAddr(app *App) {
 	binary.BigEndian.PutUint32(account.Address, uint32(nextaddr))
 	app.accountNumOnDb++
 }
+
+var stateAccountLayoutKey = []byte("accountlayout")
+
+// migrateAccounts rewrites account leaves of the 32 bit layout
+// [ 4 bytes amount | 32 bytes ed25519 pk | 48 bytes bls pk | 4 bytes counter | state ]
+// into the 64 bit layout, all validators have to run it before the next block
+func (app *App) migrateAccounts() error {
+	rSt := app.stateDb.ReadTx()
+	_, err := rSt.Get(stateAccountLayoutKey)
+	rSt.Discard()
+	if err == nil {
+		return nil
+	}
+
+	var keys, values [][]byte
+	err = app.accountTree.Iterate(nil, func(_, v []byte) {
+		if v[0] != arbo.PrefixValueLeaf {
+			return
+		}
+		k, old := arbo.ReadLeafValue(v)
+		if len(old) != 88 && len(old) != 120 {
+			return
+		}
+
+		data := make([]byte, accCounterEnd, accStateEnd)
+		binary.BigEndian.PutUint64(data[:accAmountEnd], uint64(binary.BigEndian.Uint32(old[:4])))
+		copy(data[accAmountEnd:], old[4:88])
+		data = append(data, old[88:]...)
+
+		keys = append(keys, append([]byte{}, k...))
+		values = append(values, data)
+	})
+	if err != nil {
+		execLogs.logError("Failed to iterate the Account Tree: ", err)
+		return err
+	}
+
+	wAc := app.accountDb.WriteTx()
+	defer wAc.Discard()
+	for i := range keys {
+		err = app.accountTree.UpdateWithTx(wAc, keys[i], values[i])
+		if err != nil {
+			execLogs.logError("Failed to migrate account: ", err)
+			return err
+		}
+	}
+
+	err = wAc.Commit()
+	if err != nil {
+		execLogs.logError("Failed to commit migrated accounts: ", err)
+		return err
+	}
+	execLogs.dlog("Migrated accounts to 64 bit balances: ", len(keys))
+
+	//remember the migration to skip the scan on the next start
+	wSt := app.stateDb.WriteTx()
+	defer wSt.Discard()
+	err = wSt.Set(stateAccountLayoutKey, []byte{2})
+	if err != nil {
+		return err
+	}
+
+	//the migrated leaves are part of the committed height, a crash in the
+	//next commit must not roll them back to the 32 bit layout
+	var states []treeState
+	if app.committed != nil {
+		states, err = app.treeStates()
+		if err == nil {
+			err = app.putTreeStates(wSt, states)
+		}
+		if err != nil {
+			execLogs.logError("Failed to store the migrated tree states: ", err)
+			return err
+		}
+	}
+
+	err = wSt.Commit()
+	if err != nil {
+		return err
+	}
+	if states != nil {
+		app.committed = states
+	}
+	return nil
+}
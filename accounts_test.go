@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// downgradeAccounts rewrites the account leaves to the 32 bit layout and
+// commits them at the current height, as stored before the migration
+func downgradeAccounts(t *testing.T, app *App, accounts []*testAccount) {
+	for _, a := range accounts {
+		key := make([]byte, 4)
+		binary.BigEndian.PutUint32(key, a.address)
+		_, data, err := app.accountTree.Get(key)
+		require.Nil(t, err)
+
+		old := make([]byte, 4, 88)
+		binary.BigEndian.PutUint32(old, uint32(binary.BigEndian.Uint64(data[:accAmountEnd])))
+		old = append(old, data[accAmountEnd:accCounterEnd]...)
+		require.Nil(t, app.accountTree.Update(key, old))
+	}
+
+	appHash, err := app.computeAppHash()
+	require.Nil(t, err)
+	require.Nil(t, app.saveState(appHash))
+
+	wSt := app.stateDb.WriteTx()
+	require.Nil(t, wSt.Delete(stateAccountLayoutKey))
+	require.Nil(t, wSt.Commit())
+}
+
+func TestMigrateAccounts(t *testing.T) {
+	tests := []struct {
+		name  string
+		crash bool
+	}{
+		{"restart", false},
+		{"crash in the first commit", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			accounts := newTestAccounts(t, 2)
+			app := newTestApp(t, testGenesis(t, accounts, 5000, nil))
+			commitBlock(t, app)
+			downgradeAccounts(t, app, accounts)
+
+			//the migration runs on start
+			app = reopenTestApp(t, app)
+			states, err := app.treeStates()
+			require.Nil(t, err)
+			assert.Equal(t, states, app.committed)
+
+			if tt.crash {
+				//the first commit after the migration dies after writing the accounts
+				require.Nil(t, app.writeJournal(app.committed))
+				require.Nil(t, app.accountTree.Update([]byte{0, 0, 0, 0}, make([]byte, accCounterEnd)))
+				app = reopenTestApp(t, app)
+			}
+
+			for _, a := range accounts {
+				key := make([]byte, 4)
+				binary.BigEndian.PutUint32(key, a.address)
+				_, data, err := app.accountTree.Get(key)
+				require.Nil(t, err)
+				assert.Equal(t, accCounterEnd, len(data))
+				assert.Equal(t, uint64(5000), binary.BigEndian.Uint64(data[:accAmountEnd]))
+			}
+		})
+	}
+}
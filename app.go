@@ -7,9 +7,9 @@ import (
 	abcitypes "github.com/tendermint/tendermint/abci/types"
 
 	"github.com/tendermint/tendermint/crypto/encoding"
+	"github.com/tendermint/tendermint/proto/tendermint/crypto"
 
 	"encoding/binary"
-	"encoding/hex"
 
 	"github.com/vocdoni/arbo"
 	"go.vocdoni.io/dvote/db"
@@ -17,6 +17,8 @@ import (
 
 	"fmt"
 	"math"
+	"os"
+	"time"
 )
 
 type App struct {
@@ -33,6 +35,10 @@ type App struct {
 	txStorageDb2 *badb.BadgerDB
 	blockHashDb  *badb.BadgerDB
 	validatorDb  *badb.BadgerDB
+	delegationDb *badb.BadgerDB
+	unbondingDb  *badb.BadgerDB
+	stateDb      *badb.BadgerDB
+	snapshotDb   *badb.BadgerDB
 
 	accountTree    *arbo.Tree
 	contractTree   *arbo.Tree
@@ -40,16 +46,42 @@ type App struct {
 	txStorageTree2 *arbo.Tree
 	blockHashTree  *arbo.Tree
 	validatorTree  *arbo.Tree
+	delegationTree *arbo.Tree
+	unbondingTree  *arbo.Tree
 
 	//transaction cache
-	txMap map[[32]byte]*Transaction
+	txCache *txCache
+
+	//prometheus metrics, no-op unless instrumentation is enabled
+	metrics *Metrics
+
+	//events of the tx being delivered
+	txEvents []abcitypes.Event
+
+	//stops the node after halt has written its diagnostic dump
+	onHalt func()
+
+	//tree states of the last committed height, journaled by Commit
+	committed []treeState
+
+	//last committed height, blockHeight moves to the executing block in EndBlock
+	committedHeight int64
 
 	//account and contract cache
-	tempAccountMap     map[[4]byte]*Account
+	tempAccountMap map[[4]byte]*Account
+
+	//committed accounts with the pending balance and counter of accepted mempool txs,
+	//set checking while CheckTx reads accounts
+	checkAccountMap map[[4]byte]*Account
+	checking        bool
+
 	tempNewAccountMap  map[[4]byte]*Account
 	tempContractMap    map[[4]byte]*Contract
 	tempNewContractMap map[[4]byte]*Contract
 
+	//directory holding the databases and halt dumps
+	dataDir string
+
 	//set this to build a temporary database for querrying addresses with bls keys
 	accountWatch bool
 
@@ -60,11 +92,30 @@ type App struct {
 
 	prevHash []byte
 
+	//app hash of the last committed block
+	appHash []byte
+
+	//app hash of an exported state imported by InitChain, nil for a new chain
+	importedAppHash []byte
+
+	//snapshot being restored through state sync
+	restore *snapshotRestore
+
+	//state sync snapshots are taken every snapshotInterval blocks, 0 disables them
+	snapshotInterval   int64
+	snapshotKeepRecent int
+
+	//heights whose tree states are kept for queries, 0 keeps them all
+	historyBlocks int64
+
 	txDbMutex  sync.Mutex
 	ctxDbMutex sync.Mutex
 
-	//Validator updates
-	valUpdates []abcitypes.ValidatorUpdate
+	//snapshots are written and pruned one at a time
+	snapshotMutex sync.Mutex
+
+	//validators stored by the block, reported at EndBlock if their voting power changed
+	valTouched [][]byte
 
 	//transaction db entries as batch
 	txDbKeys, txDbVals [][]byte
@@ -82,77 +133,133 @@ type App struct {
 	gas           uint32
 	blockReward   int64
 
-	totalFees uint32
+	//height from which legacy and v1 transactions are rejected, 0 keeps accepting them
+	legacyTxCutoff int64
+
+	//chain id of the genesis file, part of the signed message of versioned transactions
+	chainID []byte
+
+	//blocks during which released stake stays slashable
+	unbondingBlocks uint64
+
+	//slashing, fractions are in parts of slashFractionBase
+	slashFractionDoubleSign uint64
+	slashFractionDowntime   uint64
+	downtimeWindow          uint64
+	jailBlocks              uint64
+
+	//tips paid to the proposer of the next block
+	totalFees uint64
+
+	//fee market, the base fee per byte follows the size of the blocks
+	//and is burned, the gas parameter is its floor
+	baseFee          uint64
+	burned           uint64
+	blockBytes       uint64
+	targetBlockBytes uint64
 }
 
-func NewApp() (*App, error) {
-	app := &App{}
+func NewApp(config *AppConfig) (*App, error) {
+	app := &App{dataDir: config.DataDir}
+
+	err := os.MkdirAll(app.dataDir, 0o700)
+	if err != nil {
+		logs.logError("Data directory can not be created: ", err)
+		return nil, err
+	}
 
 	// create badger databases and associated arbo merkle trees
-	accountLedgerDb, err := badb.New(db.Options{Path: "accdb"})
+	accountLedgerDb, err := badb.New(db.Options{Path: app.dbPath("accdb")})
 	if err != nil {
 		logs.logError("Account db can not be created: ", err)
 		return nil, err
 	}
 
-	contractLedgerDb, err := badb.New(db.Options{Path: "condb"})
+	contractLedgerDb, err := badb.New(db.Options{Path: app.dbPath("condb")})
 	if err != nil {
 		logs.logError("Contract db can not be created: ", err)
 		return nil, err
 	}
 
 	// create 2 temporary swaping databases of contract entries
-	contractStorageDb, err := badb.New(db.Options{Path: contractdb})
+	contractStorageDb, err := badb.New(db.Options{Path: app.dbPath("contractdb")})
 	if err != nil {
 		logs.logError("Contract storage db can not be created: ", err)
 		return nil, err
 	}
 
-	contractStorageDb2, err := badb.New(db.Options{Path: contractdb2})
+	contractStorageDb2, err := badb.New(db.Options{Path: app.dbPath("contractdb2")})
 	if err != nil {
 		logs.logError("Contract storage db2 can not be created: ", err)
 		return nil, err
 	}
 
 	// create new Tree of accounts with maxLevels=48 and Blake2b hash function
-	accountDb, accountTree, err := app.createTreeDb("badg", 48, false)
+	accountDb, accountTree, err := app.createTreeDb(app.dbPath("badg"), 48, false)
 	if err != nil {
 		logs.logError("accountTree initialization failed!!!", err)
 		return nil, err
 	}
 
 	// create Tree of contracts
-	contractDb, contractTree, err := app.createTreeDb(badg0, 48, false)
+	contractDb, contractTree, err := app.createTreeDb(app.dbPath("badg0"), 48, false)
 	if err != nil {
 		logs.logError("contractTree initialization failed!!!", err)
 	}
 
 	// create 2 temporary swaping Trees of transactions
-	txStorageDb, txStorageTree, err := app.createTreeDb(badg2, 64, true)
+	txStorageDb, txStorageTree, err := app.createTreeDb(app.dbPath("badg2"), 64, true)
 	if err != nil {
 		logs.logError("Tree txStorageTree initialization failed!!!", err)
 		return nil, err
 	}
-	txStorageDb2, txStorageTree2, err := app.createTreeDb(badg3, 64, true)
+	txStorageDb2, txStorageTree2, err := app.createTreeDb(app.dbPath("badg3"), 64, true)
 	if err != nil {
 		logs.logError("Tree txStorageTree initialization failed!!!", err)
 		return nil, err
 	}
 
 	//create a tree of blockhashes
-	blockHashDb, blockHashTree, err := app.createTreeDb("badg4", 64, true)
+	blockHashDb, blockHashTree, err := app.createTreeDb(app.dbPath("badg4"), 64, true)
 	if err != nil {
 		logs.logError("Tree blockHashTree initialization failed!!!", err)
 		return nil, err
 	}
 
-	validatorDb, validatorTree, err := app.createTreeDb("badg5", 256, false)
+	validatorDb, validatorTree, err := app.createTreeDb(app.dbPath("badg5"), 256, false)
 	if err != nil {
 		logs.logError("Validafor Tree initialization failed", err)
 	}
 
+	//create a tree of delegations keyed by delegator account and validator address
+	delegationDb, delegationTree, err := app.createTreeDb(app.dbPath("badg6"), 192, false)
+	if err != nil {
+		logs.logError("Delegation Tree initialization failed", err)
+		return nil, err
+	}
+
+	//create a tree of pending unbondings keyed by maturity height, account and validator address
+	unbondingDb, unbondingTree, err := app.createTreeDb(app.dbPath("badg7"), 256, false)
+	if err != nil {
+		logs.logError("Unbonding Tree initialization failed", err)
+		return nil, err
+	}
+
+	//create a db for the last committed height and app hash
+	stateDb, err := badb.New(db.Options{Path: app.dbPath("statedb")})
+	if err != nil {
+		logs.logError("State db can not be created: ", err)
+		return nil, err
+	}
+
+	//create a db for state sync snapshots
+	snapshotDb, err := badb.New(db.Options{Path: app.dbPath("snapdb")})
+	if err != nil {
+		logs.logError("Snapshot db can not be created: ", err)
+		return nil, err
+	}
+
 	//initialize maps for temporary storage and fast access for transactions and accounts
-	txMap := make(map[[32]byte]*Transaction)
 	tempAccountMap := make(map[[4]byte]*Account)
 	tempNewAccountMap := make(map[[4]byte]*Account)
 	tempContractMap := make(map[[4]byte]*Contract)
@@ -160,11 +267,24 @@ func NewApp() (*App, error) {
 
 	//constructing the app
 	app = &App{
-		//initialize parameters
-		gas:           uint32(100),
-		emptyVoteLeak: int64(1),
-		blockReward:   int64(10000000),
-		accountWatch:  true, // toggle for watching accounts (register a db with bls public keys as db keys
+		//initialize parameters, the genesis app_state overrides them
+		gas:             config.Gas,
+		emptyVoteLeak:   config.EmptyVoteLeak,
+		blockReward:     config.BlockReward,
+		unbondingBlocks: config.UnbondingBlocks,
+
+		slashFractionDoubleSign: config.SlashFractionDoubleSign,
+		slashFractionDowntime:   config.SlashFractionDowntime,
+		downtimeWindow:          config.DowntimeWindow,
+		jailBlocks:              config.JailBlocks,
+
+		targetBlockBytes: config.TargetBlockBytes,
+		accountWatch:     config.AccountWatch, // toggle for watching accounts (register a db with bls public keys as db keys
+
+		dataDir:            config.DataDir,
+		snapshotInterval:   config.SnapshotInterval,
+		snapshotKeepRecent: config.SnapshotKeepRecent,
+		historyBlocks:      config.QueryHistory,
 
 		//parse databases and trees
 		accountLedgerDb:    accountLedgerDb,
@@ -177,16 +297,25 @@ func NewApp() (*App, error) {
 		txStorageDb2:       txStorageDb2,
 		blockHashDb:        blockHashDb,
 		validatorDb:        validatorDb,
+		delegationDb:       delegationDb,
+		unbondingDb:        unbondingDb,
+		stateDb:            stateDb,
+		snapshotDb:         snapshotDb,
 		accountTree:        accountTree,
 		contractTree:       contractTree,
 		txStorageTree:      txStorageTree,
 		txStorageTree2:     txStorageTree2,
 		blockHashTree:      blockHashTree,
 		validatorTree:      validatorTree,
+		delegationTree:     delegationTree,
+		unbondingTree:      unbondingTree,
 
 		//parse maps
-		txMap:              txMap,
+		txCache:            newTxCache(txCacheMaxSize, txCacheMaxAge, txCacheMaxBlocks),
+		metrics:            NopMetrics(),
+		onHalt:             exitOnHalt,
 		tempAccountMap:     tempAccountMap,
+		checkAccountMap:    make(map[[4]byte]*Account),
 		tempNewAccountMap:  tempNewAccountMap,
 		tempContractMap:    tempContractMap,
 		tempNewContractMap: tempNewContractMap,
@@ -195,273 +324,505 @@ func NewApp() (*App, error) {
 	app.dummySig = new(Signature)
 	app.dummyPk = new(PublicKey)
 
-	//log everything
-	logs.debugLogs = true
+	//trees written past the last committed height by a crash go back to it
+	err = app.recoverCommit()
+	if err != nil {
+		logs.logError("Failed to recover the last commit: ", err)
+		return nil, err
+	}
 
-	//example accounts creation
+	//resume from the last committed state, if any
+	err = app.loadState()
+	if err != nil {
+		return nil, err
+	}
 
-	app.accountNumOnDb = 0
+	//the tx and contract storage pairs are swapped every txStorageSwapBlocks
+	//blocks, put the front ones back in place after a restart
+	app.orderStorageDbs()
 
-	//first example account creation
-	app.createTemplateAccount([]byte("Iloveyou!"), 50000000)
+	//the retention window may have shrunk since the last run
+	err = app.pruneHistory()
+	if err != nil {
+		logs.logError("Failed to prune the tree states: ", err)
+		return nil, err
+	}
+
+	//widen balances of accounts stored with the 32 bit layout
+	err = app.migrateAccounts()
+	if err != nil {
+		return nil, err
+	}
 
-	//second example account creation
-	app.createTemplateAccount([]byte("Iloveher"), 500000)
+	//delegations of trees written before they were indexed by validator
+	indexed, err := app.stateMarked(stateDelegationIndexKey)
+	if err == nil && !indexed {
+		err = app.indexDelegations()
+	}
+	if err != nil {
+		logs.logError("Failed to index the delegations: ", err)
+		return nil, err
+	}
+
+	//unbondings of trees written before they were indexed by maturity height
+	indexed, err = app.stateMarked(stateUnbondingIndexKey)
+	if err == nil && !indexed {
+		err = app.indexUnbondings()
+	}
+	if err != nil {
+		logs.logError("Failed to index the unbondings: ", err)
+		return nil, err
+	}
 
-	//third example account creation
-	hx := make([]byte, 32)
-	hx, _ = hex.DecodeString("69c8349c1581cbe6cab3f137a6c17d9011f93dfde3d3716d0912d321f43b341c")
-	app.createTemplateAccount(hx[:], 50000000)
+	//parameters defined by the genesis app_state
+	err = app.loadParams()
+	if err != nil {
+		return nil, err
+	}
 
-	app.commitAccountsToDb()
+	//chains started before the fee market begin at the minimum base fee
+	if app.baseFee == 0 {
+		app.baseFee = app.minBaseFee()
+	}
 
 	return app, nil
 }
 
 var _ abcitypes.Application = (*App)(nil)
 
-func (App) Info(req abcitypes.RequestInfo) abcitypes.ResponseInfo {
-	return abcitypes.ResponseInfo{}
+func (app *App) Info(req abcitypes.RequestInfo) abcitypes.ResponseInfo {
+	return abcitypes.ResponseInfo{
+		Data:             "zkSpace",
+		Version:          Version,
+		AppVersion:       AppVersion,
+		LastBlockHeight:  app.blockHeight,
+		LastBlockAppHash: app.appHash,
+	}
 }
 
-func (App) SetOption(req abcitypes.RequestSetOption) abcitypes.ResponseSetOption {
+func (app *App) SetOption(req abcitypes.RequestSetOption) abcitypes.ResponseSetOption {
 	return abcitypes.ResponseSetOption{}
 }
 
-func (App) OfferSnapshot(req abcitypes.RequestOfferSnapshot) abcitypes.ResponseOfferSnapshot {
-	return abcitypes.ResponseOfferSnapshot{}
-}
-
-func (App) LoadSnapshotChunk(req abcitypes.RequestLoadSnapshotChunk) abcitypes.ResponseLoadSnapshotChunk {
-	return abcitypes.ResponseLoadSnapshotChunk{}
-}
+func (app *App) InitChain(req abcitypes.RequestInitChain) abcitypes.ResponseInitChain {
 
-func (App) ListSnapshots(req abcitypes.RequestListSnapshots) abcitypes.ResponseListSnapshots {
-	return abcitypes.ResponseListSnapshots{}
-}
+	// The handshake runs InitChain again after a crash before the first
+	// commit, the genesis state is then already saved
+	saved, err := app.stateMarked(stateHeightKey)
+	if err != nil {
+		app.halt("Failed to read the saved state: ", err)
+		return abcitypes.ResponseInitChain{}
+	}
+	if saved {
+		logs.log("Genesis state already saved")
+		return abcitypes.ResponseInitChain{AppHash: app.appHash}
+	}
 
-func (app *App) InitChain(req abcitypes.RequestInitChain) abcitypes.ResponseInitChain {
+	// Bind transaction signatures to this network
+	app.chainID = []byte(req.ChainId)
 
-	// Parse the initial validator set from the RequestInitChain message
-	for _, v := range req.Validators {
-		valAccount := make([]byte, 40)
+	// Parse the initial accounts, contracts and parameters from the app_state
+	err = app.initGenesisState(req.AppStateBytes)
+	if err != nil {
+		app.halt("Genesis app_state can not be applied: ", err)
+		return abcitypes.ResponseInitChain{}
+	}
 
-		pkey := valAccount[8:]
+	// Persist the parameters and the chain id, InitChain is not called again
+	err = app.saveParams()
+	if err != nil {
+		app.halt("Failed to store the genesis parameters: ", err)
+		return abcitypes.ResponseInitChain{}
+	}
+	if app.importedAppHash == nil {
+		app.baseFee = app.minBaseFee()
+	}
 
-		pk, err := encoding.PubKeyFromProto(v.PubKey)
+	// Parse the initial validator set from the RequestInitChain message,
+	// an exported state brings its validator tree with it
+	validators := req.Validators
+	if app.importedAppHash != nil {
+		validators = nil
+	}
+	for _, val := range validators {
+		pk, err := encoding.PubKeyFromProto(val.PubKey)
 		if err != nil {
-			logs.logError("Pubkey encoding failed: ", err)
-			panic(err)
+			app.halt("Pubkey encoding failed: ", err)
+			return abcitypes.ResponseInitChain{}
 		}
 
-		copy(pkey, pk.Bytes())
+		v := &Validator{
+			Address: app.toAddress(pk.Bytes()),
+			PubKey:  pk.Bytes(),
+			Power:   uint64(val.Power),
+		}
 
-		power := valAccount[:8]
-		binary.BigEndian.PutUint64(power, uint64(v.Power))
+		// Initialize the application state with the initial validator set
+		err = app.validatorTree.Add(v.Address, v.encode())
+		if err != nil {
+			app.halt("Validafor Tree failed to grow", err)
+			return abcitypes.ResponseInitChain{}
+		}
+	}
 
-		addr := app.toAddress(pkey)
+	// A plain genesis starts at its initial height
+	if app.importedAppHash == nil && req.InitialHeight > 1 {
+		app.blockHeight = req.InitialHeight - 1
+		binary.BigEndian.PutUint64(app.blockheight[:], uint64(app.blockHeight))
+	}
 
-		// Initialize the application state with the initial validator set
-		err = app.validatorTree.Add(addr, valAccount)
+	// An imported state continues the exported chain from its height and
+	// app hash
+	if app.importedAppHash != nil {
+		if req.InitialHeight != app.blockHeight+1 {
+			app.halt("Imported state does not continue at the initial height: ",
+				fmt.Errorf("initial height %d, exported height %d", req.InitialHeight, app.blockHeight))
+			return abcitypes.ResponseInitChain{}
+		}
+		appHash, err := app.computeAppHash()
 		if err != nil {
-			logs.logError("Validafor Tree failed to grow", err)
-			panic(err)
+			app.halt("Failed to compute the imported app hash: ", err)
+			return abcitypes.ResponseInitChain{}
+		}
+		if !bytes.Equal(appHash, app.importedAppHash) {
+			app.halt("Imported state does not match the exported app hash: ",
+				fmt.Errorf("got %x, exported %x", appHash, app.importedAppHash))
+			return abcitypes.ResponseInitChain{}
 		}
+		app.appHash = appHash
 	}
 
-	// Return a response indicating success
-	return abcitypes.ResponseInitChain{}
-}
+	// The genesis state is saved as the last committed one, the first commit
+	// journals its trees
+	err = app.saveState(app.appHash)
+	if err != nil {
+		app.halt("Failed to save the genesis state: ", err)
+		return abcitypes.ResponseInitChain{}
+	}
 
-func (App) ApplySnapshotChunk(req abcitypes.RequestApplySnapshotChunk) abcitypes.ResponseApplySnapshotChunk {
-	return abcitypes.ResponseApplySnapshotChunk{}
+	return abcitypes.ResponseInitChain{AppHash: app.appHash}
 }
 
 func (app *App) EndBlock(req abcitypes.RequestEndBlock) abcitypes.ResponseEndBlock {
 
 	binary.BigEndian.PutUint64(app.blockheight[:], uint64(req.Height))
 	app.blockHeight = req.Height
-	logs.dlog("valUpdates: ", app.valUpdates)
-	app.removeDuplicateValidatorUpdates()
 
-	return abcitypes.ResponseEndBlock{ValidatorUpdates: app.valUpdates}
+	//the base fee of the next block follows the size of this one
+	app.adjustBaseFee()
+
+	//pay out matured unbondings
+	err := app.releaseUnbondings(uint64(req.Height))
+	if err != nil {
+		app.halt("Failed to release unbondings: ", err)
+		return abcitypes.ResponseEndBlock{}
+	}
+
+	valUpdates, err := app.validatorUpdates()
+	if err != nil {
+		app.halt("Failed to compute the validator updates: ", err)
+		return abcitypes.ResponseEndBlock{}
+	}
+	valLogs.dlog("valUpdates: ", valUpdates)
+
+	return abcitypes.ResponseEndBlock{ValidatorUpdates: valUpdates}
 }
 
-func (app *App) CheckTx(req abcitypes.RequestCheckTx) abcitypes.ResponseCheckTx {
-	logs.log("Checking tx...")
+func (app *App) CheckTx(req abcitypes.RequestCheckTx) (res abcitypes.ResponseCheckTx) {
+	checkLogs.log("Checking tx...")
+	app.checking = true
+	defer func() { app.checking = false }()
+
+	//a malformed tx is rejected, it never takes the node down
+	defer func() {
+		if r := recover(); r != nil {
+			err := errInternal.wrap("recovered: %v", r)
+			checkLogs.logError("CheckTx panicked: ", err)
+			code, log, codespace := txResult(err)
+			res = abcitypes.ResponseCheckTx{Code: code, Log: log, Codespace: codespace}
+		}
+	}()
+
 	//var txr Transaction
 	tx := new(Transaction)
-	code := tx.fetchTx(req.Tx, app)
+	err := tx.fetchTx(req.Tx, app)
+
+	//txs left in the mempool after a block are checked again against the new state
+	if err == nil && req.Type == abcitypes.CheckTxType_Recheck {
+		app.txCache.remove(tx.hash)
+	}
 
-	if code == 0 {
-		code = tx.isValid(app)
+	if err == nil {
+		err = tx.isValid(app)
 	}
-	if code == 0 {
+	if err == nil {
 		//app.txCacheDb.Put(tx.hash[:], tx.data, nil)
-		app.txMap[tx.hash] = tx
+		app.txCache.add(tx, app.blockHeight)
+		tx.chargeCheckState(app)
 	}
 
-	logs.logTx(tx)
+	checkLogs.logTx(tx)
+	code, log, codespace := txResult(err)
+	app.metrics.countTx("check", tx, code)
+
+	//the priority mempool orders txs by tip
+	priority := int64(0)
+	if code == 0 && tx.Tip <= math.MaxInt64 {
+		priority = int64(tx.Tip)
+	} else if code == 0 {
+		priority = math.MaxInt64
+	}
 
-	return abcitypes.ResponseCheckTx{Code: code, GasWanted: 1}
+	return abcitypes.ResponseCheckTx{
+		Code:      code,
+		Log:       log,
+		Codespace: codespace,
+		GasWanted: int64(tx.length),
+		Priority:  priority,
+	}
 }
 
 func (app *App) BeginBlock(req abcitypes.RequestBeginBlock) abcitypes.ResponseBeginBlock {
-	app.valUpdates = make([]abcitypes.ValidatorUpdate, 0)
+	app.valTouched = nil
 	app.prevHash = req.Header.GetLastBlockId().Hash
+	app.blockBytes = 0
+	height := uint64(req.Header.Height)
 
-	wVal := app.validatorDb.WriteTx()
-
-	valNum := int64(len(req.LastCommitInfo.Votes) * 256)
+	valNum := uint64(len(req.LastCommitInfo.Votes) * 256)
 
 	//reward validators
-	for _, v := range req.LastCommitInfo.Votes {
-		var ValUpdate abcitypes.ValidatorUpdate
-
-		_, val, err := app.validatorTree.Get(v.Validator.Address)
-		if err != nil {
-			logs.logError("Failed to get element from Validafor Tree: ", err)
-			panic(err)
-		}
-
-		ValUpdate.PubKey, err = app.toPk(val[8:])
+	for _, vote := range req.LastCommitInfo.Votes {
+		v, err := app.fetchValidator(vote.Validator.Address)
 		if err != nil {
-			logs.logError("Public key convertion failed: ", err)
-			panic(err)
+			//every node has the same tree, a vote of an unknown validator is skipped by all of them
+			valLogs.logError("Voting validator not found: ", err)
+			continue
 		}
 
-		logs.dlog("Validator: ", v.Validator.Address)
-
-		ValUpdate.Power = int64(binary.BigEndian.Uint64(val[:8]))
+		valLogs.dlog("Validator: ", vote.Validator.Address)
 
-		if ValUpdate.Power == 0 {
+		//jailed validators can still be part of the last commit
+		if v.Power == 0 || v.jailed() {
 			continue
 		}
 
-		//ValUpdate.Power = v.Validator.Power
-		logs.dlog("POWER before: ", ValUpdate.Power)
+		valLogs.dlog("POWER before: ", v.Power)
 		//increased reward for proposer
-		if bytes.Equal(v.Validator.Address, req.Header.ProposerAddress) {
-			totalReward := app.blockReward + int64(app.totalFees)
-			ValUpdate.Power += totalReward
-			logs.dlog("REWARD!!! +", totalReward)
-		} else if v.SignedLastBlock {
+		if bytes.Equal(vote.Validator.Address, req.Header.ProposerAddress) {
+			totalReward := uint64(app.blockReward) + app.totalFees
+
+			//a reward taking the validators above the power tendermint
+			//accepts is not paid
+			power, ok := addAmount(v.Power, totalReward)
+			if ok {
+				ok, err = app.powerInRange(v, power)
+				if err != nil {
+					app.halt("Failed to sum the validator powers: ", err)
+					return abcitypes.ResponseBeginBlock{}
+				}
+			}
+			if ok {
+				//delegators receive their share of the reward
+				err = app.distributeReward(v.Address, v.Power, totalReward)
+				if err != nil {
+					app.halt("Failed to distribute delegator rewards: ", err)
+					return abcitypes.ResponseBeginBlock{}
+				}
+				v.Power = power
+				valLogs.dlog("REWARD!!! +", totalReward)
+			}
+		} else if vote.SignedLastBlock {
+			if v.Missed != 0 {
+				v.Missed = 0
+				err = app.storeValidator(v)
+				if err != nil {
+					app.halt("Validafor Tree update failed", err)
+					return abcitypes.ResponseBeginBlock{}
+				}
+			}
 			continue
 		}
+
+		if !vote.SignedLastBlock {
+			v.Missed++
+		} else {
+			v.Missed = 0
+		}
+
 		//inactive validators leak power (and money)
-		leak := app.emptyVoteLeak*ValUpdate.Power/valNum + 1
-		if ValUpdate.Power < leak {
+		leak := uint64(app.emptyVoteLeak)*v.Power/valNum + 1
+		if v.Power < leak {
 			continue
 		}
-		ValUpdate.Power -= leak
+		v.Power -= leak
+		valLogs.dlog("LEAK: -", leak)
+
+		//validators missing too many blocks in a row are slashed and jailed
+		if app.downtimeWindow > 0 && v.Missed >= app.downtimeWindow {
+			err = app.punishDowntime(v, height)
+			if err != nil {
+				app.halt("Failed to slash validator: ", err)
+				return abcitypes.ResponseBeginBlock{}
+			}
+		}
 
-		logs.dlog("LEAK: -", leak)
-		logs.dlog("POWER after: ", ValUpdate.Power)
-		app.valUpdates = append(app.valUpdates, ValUpdate)
+		valLogs.dlog("POWER after: ", v.Power)
 
-		binary.BigEndian.PutUint64(val[:8], uint64(ValUpdate.Power))
-		err = app.validatorTree.UpdateWithTx(wVal, v.Validator.Address, val)
+		err = app.storeValidator(v)
 		if err != nil {
-			logs.logError("Validafor Tree update failed", err)
-			panic(err)
+			app.halt("Validafor Tree update failed", err)
+			return abcitypes.ResponseBeginBlock{}
 		}
 	}
 
 	//punish byzantines
-	for _, b := range req.ByzantineValidators {
-		var ValUpdate abcitypes.ValidatorUpdate
-		_, val, err := app.validatorTree.Get(b.Validator.Address)
+	for _, evidence := range req.ByzantineValidators {
+		v, err := app.fetchValidator(evidence.Validator.Address)
 		if err != nil {
-			logs.logError("Failed to retrieve element from Validafor Tree: ", err)
-			panic(err)
+			//evidence can be submitted after the validator has left the tree
+			valLogs.logError("Byzantine validator not found: ", err)
+			continue
+		}
+
+		//a tombstoned validator has already paid for its infraction
+		if v.tombstoned() {
+			continue
 		}
-		ValUpdate.PubKey, err = app.toPk(val[8:])
+
+		err = app.punishDoubleSign(v)
 		if err != nil {
-			logs.logError("Public key convertion failed: ", err)
-			panic(err)
+			app.halt("Failed to slash validator: ", err)
+			return abcitypes.ResponseBeginBlock{}
 		}
-		ValUpdate.Power = 0
-		app.valUpdates = append(app.valUpdates, ValUpdate)
 
-		binary.BigEndian.PutUint64(val[:8], uint64(0))
-		err = app.validatorTree.UpdateWithTx(wVal, b.Validator.Address, val)
+		err = app.storeValidator(v)
 		if err != nil {
-			logs.logError("Validafor Tree update failed", err)
-			panic(err)
+			app.halt("Validafor Tree update failed", err)
+			return abcitypes.ResponseBeginBlock{}
 		}
 	}
 
-	wVal.Commit()
-	wVal.Discard()
-
 	app.totalFees = 0
 
 	return abcitypes.ResponseBeginBlock{}
 }
 
-func (app *App) DeliverTx(req abcitypes.RequestDeliverTx) abcitypes.ResponseDeliverTx {
+func (app *App) DeliverTx(req abcitypes.RequestDeliverTx) (res abcitypes.ResponseDeliverTx) {
 	//
-	logs.log("Delivering tx...")
-	tx := new(Transaction)
-	code := tx.fetchTx(req.Tx, app)
-	if code == 0 {
-		if !tx.inCache(app) {
-			code = tx.isValid(app)
-		} else {
-			tx = app.txMap[tx.hash]
-			code = tx.verifyAccounts(app)
+	execLogs.log("Delivering tx...")
+
+	//a tx the proposer should not have included fails the same way on every node
+	defer func() {
+		if r := recover(); r != nil {
+			err := errInternal.wrap("recovered: %v", r)
+			execLogs.logError("DeliverTx panicked: ", err)
+			code, log, codespace := txResult(err)
+			res = abcitypes.ResponseDeliverTx{Code: code, Log: log, Codespace: codespace}
 		}
+	}()
+
+	//every tx of the block counts towards its size, valid or not
+	app.blockBytes += uint64(len(req.Tx))
+	app.txEvents = nil
+
+	tx := new(Transaction)
+	err := tx.fetchTx(req.Tx, app)
+	if err == nil {
+		//the cached tx was checked against the check state, verify it again
+		//against the block state and only reuse its proofs of possession
+		err = tx.verifyTx(app, app.txCache.get(tx.hash))
 	}
 
-	logs.logTx(tx)
+	execLogs.logTx(tx)
 
-	if code != 0 {
-		return abcitypes.ResponseDeliverTx{Code: code}
+	if err != nil {
+		//a signed tx the block carries pays for it even if it is invalid
+		if tx.signed {
+			tx.chargeFailed(app, tx.source)
+			app.queueTxLeaf(tx)
+		}
+		code, log, codespace := txResult(err)
+		app.metrics.countTx("deliver", tx, code)
+		return abcitypes.ResponseDeliverTx{Code: code, Log: log, Codespace: codespace}
 	}
 
+	//batches move tx.source through their participants
+	source := tx.source
+
+	app.emitEvent(eventTx,
+		"source", eventAddress(tx.source),
+		"type", tx.typeName(),
+	)
+
 	if tx.isUpdate {
-		logs.log("	update")
-		tx.execUpdate(app)
+		execLogs.log("	update")
+		_, err = tx.execUpdate(app)
 	}
 
 	if tx.isTransfer {
-		logs.log("	transfer")
-		tx.execTransfer(app)
+		execLogs.log("	transfer")
+		err = tx.execTransfer(app)
 	}
 
 	if tx.isStake {
-		logs.log("	stake")
-		tx.execStake(app)
+		execLogs.log("	stake")
+		err = tx.execStake(app)
 	}
 
 	if tx.isRelease {
-		logs.log("	release")
-		tx.execRelease(app)
+		execLogs.log("	release")
+		err = tx.execRelease(app)
+	}
+
+	if tx.isDelegate {
+		execLogs.log("	delegate")
+		err = tx.execDelegate(app)
+	}
+
+	if tx.isUnjail {
+		execLogs.log("	unjail")
+		err = tx.execUnjail(app)
 	}
 
 	var dat []byte
 
 	if tx.isContract {
-		logs.log("	contract")
-		dat = tx.execContract(app)
+		execLogs.log("	contract")
+		dat, err = tx.execContract(app)
 	}
 
 	if tx.isAccountCreator {
-		logs.log("	create")
-		dat = tx.execCreateAccount(app)
+		execLogs.log("	create")
+		dat, err = tx.execCreateAccount(app)
 	}
 
 	if tx.isAccountKeyChanger {
-		logs.log("	change")
-		tx.execAccountKeyChanger(app)
+		execLogs.log("	change")
+		err = tx.execAccountKeyChanger(app)
 	}
 
 	if tx.isBatch {
-		logs.log("	batch")
-		tx.execBatch(app)
+		execLogs.log("	batch")
+		err = tx.execBatch(app)
+	}
+
+	app.queueTxLeaf(tx)
+
+	//a tx failing on execution is still part of the block and its tx tree
+	code, log, codespace := txResult(err)
+	app.metrics.countTx("deliver", tx, code)
+	if err != nil {
+		tx.chargeFailed(app, source)
+		execLogs.debug("Tx failed", "hash", tx.hash, "code", code, "log", log)
+		return abcitypes.ResponseDeliverTx{Code: code, Log: log, Codespace: codespace}
 	}
 
-	//add tx to the queue to be included in the tx merkle tree
+	return abcitypes.ResponseDeliverTx{Code: code, Data: dat, Events: app.txEvents}
+}
+
+// queueTxLeaf adds a delivered tx to the queue to be included in the tx
+// merkle tree and releases its space on the cache
+func (app *App) queueTxLeaf(tx *Transaction) {
 	var key [8]byte
 	copy(key[:4], tx.source)
 	copy(key[4:], tx.counter)
@@ -469,90 +830,116 @@ func (app *App) DeliverTx(req abcitypes.RequestDeliverTx) abcitypes.ResponseDeli
 	app.txDbKeys = append(app.txDbKeys, key[:])
 	app.txDbVals = append(app.txDbVals, tx.hash[:])
 
-	//release space on the map by deleting the processed tx
-	delete(app.txMap, tx.hash)
-
-	return abcitypes.ResponseDeliverTx{Code: code, Data: dat}
+	app.txCache.remove(tx.hash)
 }
 
 func (app *App) Commit() abcitypes.ResponseCommit {
+	commitStart := time.Now()
+	defer app.metrics.observeCommit("total", commitStart)
 
-	//permanent storage of account updates
-	app.commitAccountsToDb()
+	//journal the block before the trees are written
+	err := app.writeJournal(app.committed)
+	if err != nil {
+		app.halt("Failed to write the commit journal: ", err)
+		return abcitypes.ResponseCommit{}
+	}
 
-	//write deliver txs results on db
-	app.txDbMutex.Lock()
-	app.txStorageTree.AddBatch(app.txDbKeys, app.txDbVals)
-	app.txDbMutex.Unlock()
+	//permanent storage of account updates
+	start := time.Now()
+	err = app.commitAccountsToDb()
+	if err != nil {
+		app.halt("Failed to commit accounts: ", err)
+		return abcitypes.ResponseCommit{}
+	}
 
 	//take the number of total processed accounts
 	accountNumOnDb, err := app.accountTree.GetNLeafs()
 	if err != nil {
-		logs.logError("Failed to count leaves on the Account Tree: ", err)
-		panic(err)
+		app.halt("Failed to count leaves on the Account Tree: ", err)
+		return abcitypes.ResponseCommit{}
 	}
 	app.accountNumOnDb = accountNumOnDb
+	app.metrics.observeCommit("accounts", start)
 
 	//permanent storage of contract updates
-	app.commitContractsToDb()
+	start = time.Now()
+	err = app.commitContractsToDb()
+	if err != nil {
+		app.halt("Failed to commit contracts: ", err)
+		return abcitypes.ResponseCommit{}
+	}
 
 	//take the number of total processed contracts
 	contractNumOnDb, err := app.contractTree.GetNLeafs()
 	if err != nil {
-		logs.logError("Failed to count leaves on the Contract Tree: ", err)
-		panic(err)
+		app.halt("Failed to count leaves on the Contract Tree: ", err)
+		return abcitypes.ResponseCommit{}
 	}
 	app.contractNumOnDb = contractNumOnDb
+	app.metrics.observeCommit("contracts", start)
+
+	//mempool checks and rechecks start again from the committed state
+	app.checkAccountMap = make(map[[4]byte]*Account)
+
+	//drop cached txs the mempool no longer rechecks
+	app.txCache.expire(app.blockHeight, time.Now())
+	commitLogs.dlog("Tx cache size: ", app.txCache.len())
+	commitLogs.dlog("Tx cache evictions: ", app.txCache.evicted)
+
+	//write deliver txs results on db
+	start = time.Now()
+	app.txDbMutex.Lock()
+	_, err = app.txStorageTree.AddBatch(app.txDbKeys, app.txDbVals)
+	app.txDbMutex.Unlock()
+	if err != nil {
+		app.halt("Failed to add txs to the Transaction storage Tree: ", err)
+		return abcitypes.ResponseCommit{}
+	}
 
 	//reset batches
 	app.txDbKeys = make([][]byte, 0)
 	app.txDbVals = make([][]byte, 0)
 
-	//get merkle roots of the trees
-	ledgerRoot, err := app.accountTree.Root()
-	if err != nil {
-		logs.logError("Failed to get the Account Tree root: ", err)
-		panic(err)
-	}
+	//get the merkle root of the transactions of this block
 	app.txDbMutex.Lock()
 	blockRoot, err := app.txStorageTree.Root()
 	app.txDbMutex.Unlock()
 	if err != nil {
-		logs.logError("Failed to get the Transaction storage Tree root: ", err)
-		panic(err)
+		app.halt("Failed to get the Transaction storage Tree root: ", err)
+		return abcitypes.ResponseCommit{}
 	}
-	result := blockRoot
+	app.metrics.observeCommit("txtree", start)
 
-	validatorRoot, err := app.validatorTree.Root()
+	//add it as a block hash to the blockhash tree
+	start = time.Now()
+	err = app.blockHashTree.Add(app.blockheight[:], blockRoot)
 	if err != nil {
-		logs.logError("Failed to get the Validator Tree root: ", err)
-		panic(err)
+		app.halt("BlockHashTree Error: ", err)
+		return abcitypes.ResponseCommit{}
 	}
-	byteSlice := append(ledgerRoot, validatorRoot...)
-
-	//sha256 hash of the roots
-	resthash := app.sha2(byteSlice)
+	app.metrics.observeCommit("blockhash", start)
 
-	//add it as a block hash to the blockhash tree
-	err = app.blockHashTree.Add(app.blockheight[:], result)
+	//app hash from the roots of the account, validator and blockhash trees
+	resp, err := app.computeAppHash()
 	if err != nil {
-		//error
-		logs.logError("BlockHashTree Error: ", err)
-		panic(err)
+		app.halt("Failed to compute the app hash: ", err)
+		return abcitypes.ResponseCommit{}
 	}
 
-	//take the root to commit it
-	chainroot, err := app.blockHashTree.Root()
+	commitLogs.info("Commit", "height", app.blockHeight, "blockRoot", blockRoot, "appHash", resp)
+	app.recordState()
+
+	//persist height and app hash for the handshake after a restart
+	err = app.saveState(resp)
 	if err != nil {
-		logs.logError("Failed to get the BlockHash Tree root: ", err)
-		panic(err)
+		app.halt("Failed to save the application state: ", err)
+		return abcitypes.ResponseCommit{}
 	}
 
-	resp := append(resthash, chainroot...)
-	logs.log("Commit: ")
-	logs.log(ledgerRoot)
-	logs.log(blockRoot)
-	logs.log(resp)
+	//periodic snapshots for state sync
+	if app.snapshotInterval > 0 && app.blockHeight%app.snapshotInterval == 0 {
+		app.takeSnapshot()
+	}
 
 	// Create a new ResponseCommit message with the data and retainHeight values
 	response := abcitypes.ResponseCommit{
@@ -562,8 +949,8 @@ func (app *App) Commit() abcitypes.ResponseCommit {
 	//swap and clear old databases
 	err = app.swapDb()
 	if err != nil {
-		logs.logError("Swapping databases Failed: ", err)
-		panic(err)
+		app.halt("Swapping databases Failed: ", err)
+		return abcitypes.ResponseCommit{}
 	}
 
 	// Return the ResponseCommit message
@@ -573,11 +960,27 @@ func (app *App) Commit() abcitypes.ResponseCommit {
 func (app *App) Query(reqQuery abcitypes.RequestQuery) (resQuery abcitypes.ResponseQuery) {
 	resQuery.Key = reqQuery.Data
 	key := reqQuery.Data
-	logs.log("Query:")
-	logs.log(key)
+	queryLogs.debug("Query", "path", reqQuery.Path, "data", key, "height", reqQuery.Height)
+
+	//trees as committed at the requested height, 0 is the last one
+	view, err := app.stateAt(reqQuery.Height)
+	if err != nil {
+		return queryResult(reqQuery, err)
+	}
 
 	value := key
 
+	//routes such as /account/{addr}
+	if resQuery, ok := app.routeQuery(view, reqQuery); ok {
+		return resQuery
+	}
+
+	//the remaining queries are told apart by the length of the data
+	if !view.latest && (len(key) == 1 || len(key) == 2 || len(key) == 8) {
+		return queryResult(reqQuery, errNotHistorical.wrap("query of %d bytes", len(key)))
+	}
+
+	var proof *crypto.ProofOps
 	switch len(key) {
 	case 1:
 		value = app.prevHash
@@ -585,88 +988,44 @@ func (app *App) Query(reqQuery abcitypes.RequestQuery) (resQuery abcitypes.Respo
 	case 2:
 		app.accountWatch = !app.accountWatch
 	case 4:
-		account, err := app.fetchAccount(key)
+		//unknown accounts echo the address back
+		data, ops, err := view.get(view.account, "account", key, reqQuery.Prove)
 		if err == nil {
-			value = account.Data
+			value, proof = data, ops
 		}
 	case 8:
-		app.txDbMutex.Lock()
-		k, val1, val2, _, err := app.txStorageTree.GenProof(key)
-		blockroot, _ := app.txStorageTree.Root()
+		p, err := app.proveTx(key)
 		if err != nil {
-			k, val1, val2, _, err = app.txStorageTree2.GenProof(key)
-			blockroot, _ = app.txStorageTree2.Root()
-		}
-		k2, val3, val4, _, _ := app.blockHashTree.GenProof(app.blockheight[:]) ////TODO:diff blockheight for tree2
-		app.txDbMutex.Unlock()
-		/*
-			originalK := make([]byte, len(k))
-			copy(originalK, k)
-			checkProofK := make([]byte, len(k))
-			copy(checkProofK, k)
-
-			originalVal1 := make([]byte, len(val1))
-			copy(originalVal1, val1)
-			checkProofVal1 := make([]byte, len(val1))
-			copy(checkProofVal1, val1)
-
-			originalVal2 := make([]byte, len(val2))
-			copy(originalVal2, val2)
-			checkProofVal2 := make([]byte, len(val2))
-			copy(checkProofVal2, val2)
-
-			originalBlockRoot := make([]byte, len(blockroot))
-			copy(originalBlockRoot, blockroot)
-			checkProofBlockRoot := make([]byte, len(blockroot))
-			copy(checkProofBlockRoot, blockroot)
-		*/
-		value = append(k, val1...)
-		value = append(value, blockroot...)
-		value = append(value, val2...)
-
-		/*
-			value = append(checkProofK, checkProofVal1...)
-			value = append(value, checkProofBlockRoot...)
-			value = append(value, checkProofVal2...)
-		*/
-		value = append(value, k2...)
-		value = append(value, val3...)
-		vv, _ := app.blockHashTree.Root()
-		value = append(value, vv...)
-		value = append(value, val4...)
-
-		//CheckProofPrint(originalK, originalVal1, originalBlockRoot, originalVal2)
-		//CheckProofPrint(k, val1, blockroot, val2)
-		//CheckProofPrint(k2, val3, vv, val4)
-
-		key = val1
-
-		if err != nil {
-			value = key
+			value = p.value
+		} else {
+			value = p.encode()
 		}
+		key = p.value
 	case 32:
-		contract, err := app.findContractBypHash(key)
-		if err == nil {
-			value = contract.Address
+		//the ledger is not versioned, the contract must exist at the height
+		address, err := app.ledgerAddress(app.contractLedgerDb, key)
+		if err == nil && view.has(view.contract, address) {
+			value = address
 		}
 	case 48:
-		logs.log("By key...")
-		account, err := app.findAccountByPubKey(key)
-		if err == nil {
-			value = account.Address
+		queryLogs.log("By key...")
+		address, err := app.ledgerAddress(app.accountLedgerDb, key)
+		if err == nil && view.has(view.account, address) {
+			value = address
 		}
 	default:
-		logs.log("DEFAULT")
+		queryLogs.log("DEFAULT")
 		value = key
 	}
 
-	logs.log("Response:")
-	logs.log(value)
+	queryLogs.debug("Response", "value", value)
 
 	return abcitypes.ResponseQuery{
-		Code:  0,
-		Key:   key,
-		Value: value,
+		Code:     0,
+		Key:      key,
+		Value:    value,
+		ProofOps: proof,
+		Height:   view.height,
 	}
 }
 
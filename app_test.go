@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	abcitypes "github.com/tendermint/tendermint/abci/types"
+	tmproto "github.com/tendermint/tendermint/proto/tendermint/types"
+
+	"kvstore/sdk"
+)
+
+const testChainID = "test-chain"
+
+// testAccount is a genesis account with the keys to sign its txs
+type testAccount struct {
+	key     ed25519.PrivateKey
+	bls     *sdk.BlsKey
+	address uint32
+}
+
+// pubKey returns the ed25519 key of the account, also its validator key
+func (a *testAccount) pubKey() ed25519.PublicKey {
+	return a.key.Public().(ed25519.PublicKey)
+}
+
+// signer signs txs of the account over its current counter on the app
+func (a *testAccount) signer(t *testing.T, app *App) *sdk.Signer {
+	addr := make([]byte, 4)
+	binary.BigEndian.PutUint32(addr, a.address)
+	account, err := app.fetchAccount(addr)
+	require.Nil(t, err)
+	return sdk.NewSigner(a.key, a.address, account.Counter, testChainID)
+}
+
+// newTestAccounts creates n accounts with addresses in genesis order
+func newTestAccounts(t *testing.T, n int) []*testAccount {
+	accounts := make([]*testAccount, n)
+	for i := range accounts {
+		_, key, err := ed25519.GenerateKey(nil)
+		require.Nil(t, err)
+		bls, err := sdk.GenerateBlsKey(nil)
+		require.Nil(t, err)
+		accounts[i] = &testAccount{key: key, bls: bls, address: uint32(i)}
+	}
+	return accounts
+}
+
+// testGenesis returns the app_state funding every account with balance
+func testGenesis(t *testing.T, accounts []*testAccount, balance uint64, params *genesisParams) []byte {
+	genesis := genesisState{Params: params}
+	for _, a := range accounts {
+		genesis.Accounts = append(genesis.Accounts, genesisAccount{
+			PubKey:    hex.EncodeToString(a.pubKey()),
+			BlsPubKey: hex.EncodeToString(a.bls.PubKey()),
+			Balance:   balance,
+		})
+	}
+	appState, err := json.Marshal(genesis)
+	require.Nil(t, err)
+	return appState
+}
+
+// openTestApp opens the app stored in dir, a halt fails the test
+func openTestApp(t *testing.T, dir string) *App {
+	config := DefaultAppConfig()
+	config.DataDir = dir
+	app, err := NewApp(config)
+	require.Nil(t, err)
+	app.onHalt = func() { t.Fatal("app halted") }
+	return app
+}
+
+// newTestApp starts a chain from the app_state with the given validators
+func newTestApp(t *testing.T, appState []byte, validators ...*testAccount) *App {
+	app := openTestApp(t, t.TempDir())
+	t.Cleanup(app.closeDbs)
+
+	req := abcitypes.RequestInitChain{ChainId: testChainID, AppStateBytes: appState}
+	for _, v := range validators {
+		req.Validators = append(req.Validators, abcitypes.UpdateValidator(v.pubKey(), 1000, "ed25519"))
+	}
+	app.InitChain(req)
+	return app
+}
+
+// reopenTestApp closes the databases of app and opens them again as a
+// restarted node would
+func reopenTestApp(t *testing.T, app *App) *App {
+	app.closeDbs()
+	app = openTestApp(t, app.dataDir)
+	t.Cleanup(app.closeDbs)
+	return app
+}
+
+// deliverBlock runs the next block with txs and returns their results and
+// the validator updates of EndBlock, the block is not committed
+func deliverBlock(app *App, req abcitypes.RequestBeginBlock, txs ...[]byte) ([]abcitypes.ResponseDeliverTx, []abcitypes.ValidatorUpdate) {
+	height := app.blockHeight + 1
+	req.Header.Height = height
+	req.Header.ChainID = testChainID
+	app.BeginBlock(req)
+
+	results := make([]abcitypes.ResponseDeliverTx, len(txs))
+	for i, tx := range txs {
+		results[i] = app.DeliverTx(abcitypes.RequestDeliverTx{Tx: tx})
+	}
+	end := app.EndBlock(abcitypes.RequestEndBlock{Height: height})
+	return results, end.ValidatorUpdates
+}
+
+// commitBlock runs and commits the next block with txs
+func commitBlock(t *testing.T, app *App, txs ...[]byte) []abcitypes.ResponseDeliverTx {
+	results, _ := deliverBlock(app, abcitypes.RequestBeginBlock{Header: tmproto.Header{}}, txs...)
+	app.Commit()
+	return results
+}
+
+// testBalance returns the balance of an account of the block state
+func testBalance(t *testing.T, app *App, address uint32) uint64 {
+	addr := make([]byte, 4)
+	binary.BigEndian.PutUint32(addr, address)
+	account, err := app.fetchAccount(addr)
+	require.Nil(t, err)
+	return account.Amount
+}
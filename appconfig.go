@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/viper"
+)
+
+// AppConfig is the [app] section of config.toml, e.g.
+//
+//	[app]
+//	data_dir = "data/app"
+//	account_watch = true
+//	snapshot_interval = 1000
+//
+// the economic parameters are the defaults of the parameters missing from
+// the genesis app_state, they must be the same on every node of a network
+type AppConfig struct {
+	// Databases of the application, relative to the tendermint home
+	DataDir string `mapstructure:"data_dir"`
+
+	// Index accounts by bls public key and contracts by payload hash
+	AccountWatch bool `mapstructure:"account_watch"`
+
+	// Economic parameters
+	Gas                     uint32 `mapstructure:"gas"`
+	BlockReward             int64  `mapstructure:"block_reward"`
+	EmptyVoteLeak           int64  `mapstructure:"empty_vote_leak"`
+	UnbondingBlocks         uint64 `mapstructure:"unbonding_blocks"`
+	SlashFractionDoubleSign uint64 `mapstructure:"slash_fraction_double_sign"`
+	SlashFractionDowntime   uint64 `mapstructure:"slash_fraction_downtime"`
+	DowntimeWindow          uint64 `mapstructure:"downtime_window"`
+	JailBlocks              uint64 `mapstructure:"jail_blocks"`
+	TargetBlockBytes        uint64 `mapstructure:"target_block_bytes"`
+
+	// Retention of state sync snapshots, taken every SnapshotInterval blocks
+	SnapshotInterval   int64 `mapstructure:"snapshot_interval"`
+	SnapshotKeepRecent int   `mapstructure:"snapshot_keep_recent"`
+
+	// Heights served to historical queries, 0 keeps every height
+	QueryHistory int64 `mapstructure:"query_history"`
+
+	// Accounts and tx sources to trace, overridden by the command line flags
+	TraceAccounts string `mapstructure:"trace_accounts"`
+	TraceTxs      string `mapstructure:"trace_txs"`
+}
+
+// DefaultAppConfig returns the configuration used when config.toml has no [app] section
+func DefaultAppConfig() *AppConfig {
+	return &AppConfig{
+		DataDir:      filepath.Join("data", "app"),
+		AccountWatch: true,
+
+		Gas:                     100,
+		BlockReward:             10000000,
+		EmptyVoteLeak:           1,
+		UnbondingBlocks:         1000,
+		SlashFractionDoubleSign: 500,
+		SlashFractionDowntime:   10,
+		DowntimeWindow:          100,
+		JailBlocks:              600,
+		TargetBlockBytes:        100000,
+
+		SnapshotInterval:   1000,
+		SnapshotKeepRecent: 2,
+
+		QueryHistory: 10000,
+	}
+}
+
+// loadAppConfig reads the [app] section of the config file already read by
+// viper, the data directory is resolved against the tendermint home
+func loadAppConfig(rootDir string) (*AppConfig, error) {
+	config := DefaultAppConfig()
+	if err := viper.UnmarshalKey("app", config); err != nil {
+		return nil, err
+	}
+	if !filepath.IsAbs(config.DataDir) {
+		config.DataDir = filepath.Join(rootDir, config.DataDir)
+	}
+	return config, config.ValidateBasic()
+}
+
+// ValidateBasic checks the values that would stop the node later on
+func (c *AppConfig) ValidateBasic() error {
+	if c.DataDir == "" {
+		return errors.New("app data_dir can not be empty")
+	}
+	if c.SnapshotInterval < 0 {
+		return errors.New("app snapshot_interval can not be negative")
+	}
+	if c.SnapshotKeepRecent < 0 {
+		return errors.New("app snapshot_keep_recent can not be negative")
+	}
+	//pruning would delete every snapshot as soon as it is taken
+	if c.SnapshotInterval > 0 && c.SnapshotKeepRecent < 1 {
+		return errors.New("app snapshot_keep_recent must keep at least one snapshot")
+	}
+	if c.QueryHistory < 0 {
+		return errors.New("app query_history can not be negative")
+	}
+	if c.SlashFractionDoubleSign > slashFractionBase || c.SlashFractionDowntime > slashFractionBase {
+		return errors.New("app slash fractions can not exceed 10000")
+	}
+	return nil
+}
+
+// writeAppConfig appends an [app] section with the given values to config.toml
+func writeAppConfig(configFile string, c *AppConfig) error {
+	f, err := os.OpenFile(configFile, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintf(f, `
+#######################################################
+###            Application Configuration            ###
+#######################################################
+[app]
+
+# Databases of the application, relative to the home directory
+data_dir = %q
+
+# Index accounts by bls public key and contracts by payload hash
+account_watch = %t
+
+# Blocks between state sync snapshots, 0 disables them
+snapshot_interval = %d
+snapshot_keep_recent = %d
+
+# Heights served to queries at a past height, 0 keeps every height
+query_history = %d
+
+# Comma separated addresses whose accounts and txs are traced, or all
+trace_accounts = %q
+trace_txs = %q
+
+# Economic parameters used when the genesis app_state has none
+gas = %d
+block_reward = %d
+empty_vote_leak = %d
+unbonding_blocks = %d
+slash_fraction_double_sign = %d
+slash_fraction_downtime = %d
+downtime_window = %d
+jail_blocks = %d
+target_block_bytes = %d
+`, c.DataDir, c.AccountWatch, c.SnapshotInterval, c.SnapshotKeepRecent, c.QueryHistory, c.TraceAccounts, c.TraceTxs,
+		c.Gas, c.BlockReward, c.EmptyVoteLeak, c.UnbondingBlocks, c.SlashFractionDoubleSign,
+		c.SlashFractionDowntime, c.DowntimeWindow, c.JailBlocks, c.TargetBlockBytes)
+	return err
+}
+
+// genesisParams returns the economic parameters of the config as written to a new genesis file
+func (c *AppConfig) genesisParams() *genesisParams {
+	return &genesisParams{
+		Gas:                     c.Gas,
+		BlockReward:             c.BlockReward,
+		EmptyVoteLeak:           c.EmptyVoteLeak,
+		UnbondingBlocks:         c.UnbondingBlocks,
+		SlashFractionDoubleSign: c.SlashFractionDoubleSign,
+		SlashFractionDowntime:   c.SlashFractionDowntime,
+		DowntimeWindow:          c.DowntimeWindow,
+		JailBlocks:              c.JailBlocks,
+		TargetBlockBytes:        c.TargetBlockBytes,
+	}
+}
@@ -2,6 +2,8 @@
 package main
 
 import (
+	"time"
+
 	"golang.org/x/crypto/sha3"
 
 	blst "github.com/supranational/blst/bindings/go"
@@ -15,23 +17,26 @@ type PublicKey = blst.P1Affine
 //type AggregatePublicKey = blst.P1Aggregate
 
 func (tx *Transaction) blsCompressedVerify(sig *Signature, sg, blspk, msg, dst []byte) bool {
-	logs.log("Verifying Bls...")
+	checkLogs.log("Verifying Bls...")
 	if sig.VerifyCompressed(sg, true, blspk, true, msg, dst) {
-		logs.log("Pop Valid!")
+		checkLogs.log("Pop Valid!")
 		return true
 	} else {
-		logs.log("fuck")
+		checkLogs.log("Invalid BLS signature")
 		return false
 	}
 }
 
-func (tx *Transaction) verifyBlsTx(app *App) bool {
+func (tx *Transaction) verifyBlsTx(app *App) error {
 	if tx.isAccountCreator {
 		//fetch proof of posession and the public key
 		tx.pop = tx.data[88:]
 		tx.blspk = tx.data[40:88]
 
-		return tx.verifyTxPop(app)
+		if !tx.verifyTxPop(app) {
+			return errBadBls.wrap("proof of possession")
+		}
+		return nil
 	}
 
 	if tx.isAccountKeyChanger {
@@ -39,7 +44,10 @@ func (tx *Transaction) verifyBlsTx(app *App) bool {
 		tx.pop = tx.data[84:]
 		tx.blspk = tx.data[36:84]
 
-		return tx.verifyTxPop(app)
+		if !tx.verifyTxPop(app) {
+			return errBadBls.wrap("proof of possession")
+		}
+		return nil
 	}
 
 	if tx.isBatch {
@@ -48,10 +56,14 @@ func (tx *Transaction) verifyBlsTx(app *App) bool {
 		return tx.verifyBatch(app)
 	}
 
-	return true
+	return nil
 }
 
 func (tx *Transaction) verifyTxPop(app *App) bool {
+	if tx.popVerified {
+		return true
+	}
+
 	var dst = []byte("BLS_SIG_BLS12381G2_XMD:SHA-256_SSWU_RO_NUL_")
 
 	//hash mecessary tx data
@@ -61,5 +73,8 @@ func (tx *Transaction) verifyTxPop(app *App) bool {
 	h.Write(tx.counter)
 	hash := h.Sum(nil)
 
-	return tx.blsCompressedVerify(app.dummySig, tx.pop, tx.blspk, hash, dst)
+	start := time.Now()
+	tx.popVerified = tx.blsCompressedVerify(app.dummySig, tx.pop, tx.blspk, hash, dst)
+	app.metrics.BlsSeconds.With("type", "pop").Observe(time.Since(start).Seconds())
+	return tx.popVerified
 }
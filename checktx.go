@@ -3,95 +3,88 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"time"
 
 	"github.com/tendermint/tendermint/crypto/ed25519"
 )
 
-func (tx *Transaction) isSigned(app *App) (code bool) {
+func (tx *Transaction) isSigned(app *App) error {
 	//load public key from account database
-	logs.log("is it signed?")
+	checkLogs.log("is it signed?")
 	account, err := app.fetchAccount(tx.source)
 	if err != nil {
-		logs.logError("Could not fetch account to verify signature!!!", err)
-		return false
+		checkLogs.logError("Could not fetch account to verify signature!!!", err)
+		return errUnknownSource.wrap("%v", err)
 	}
 	tx.pubkey = account.schnorrPubKey
 	pubkey := ed25519.PubKey(tx.pubkey)
 
 	//parse message data
 	tx.counter = account.counter
-	hash := app.sha2(append(tx.hash[:], account.counter...))
+	msg := append(tx.hash[:], account.counter...)
+
+	//versioned signatures are bound to the chain
+	if tx.version != 0 {
+		msg = append(msg, app.chainID...)
+	}
+	hash := app.sha2(msg)
 
 	//signature verification
-	if !pubkey.VerifySignature(hash[:], tx.signature) {
-		logs.log("Bad signature")
-		logs.logTx(tx)
-		return false
+	start := time.Now()
+	verified := pubkey.VerifySignature(hash[:], tx.signature)
+	app.metrics.SignatureSeconds.Observe(time.Since(start).Seconds())
+	if !verified {
+		checkLogs.log("Bad signature")
+		checkLogs.logTx(tx)
+		return errBadSignature
 	}
+	tx.signed = true
 
-	return true
+	return nil
 }
 
 func (tx *Transaction) selectTxType() (code bool) {
-	logs.log("Type?")
+	checkLogs.log("Type?")
 	//tx.source = tx.data[:4]	//the same on all occasions
 
-	//transaction format and type defined by the tx blob size
+	//versioned transactions carry an explicit type tag
+	if tx.version != 0 {
+		return tx.selectVersionedTxType()
+	}
+
+	//legacy transaction format and type defined by the tx blob size
 
 	switch tx.length {
 	case 100:
-		tx.isUpdate = true
-		logs.log("	Update state")
-		tx.state = tx.data[4:]
+		tx.parseUpdate()
 		return true
 
 	case 68: //releases funds from staking (or delegation)
-		tx.isRelease = true
-		logs.log("	Release from staking")
+		tx.parseRelease()
 		return true
 
 	case 72:
-		tx.isStake = true
-		logs.log("	Stake")
-		tx.amount = tx.data[4:8]
+		tx.parseStake()
 		return true
 
 	case 74:
-		tx.isDelegate = true
-		logs.log("	Delegate")
-		tx.amount = tx.data[8:10]
-		tx.target = tx.data[4:8]
+		tx.parseDelegate()
 		return true
 
 	case 76:
-		tx.isTransfer = true
-		logs.log("	Transfer simple")
-		tx.target = tx.data[4:8]
-		tx.amount = tx.data[8:12]
+		tx.parseTransfer()
 		return true
 
 	case 108:
-		tx.isTransfer = true
-		logs.log("	Transfer with state update")
-		tx.target = tx.data[4:8]
-		tx.amount = tx.data[8:12]
-		tx.state = tx.data[12:]
+		tx.parseTransfer()
 		return true
 
 	case 244: // tx change account keys
-		tx.isAccountKeyChanger = true
-		logs.log("	Change Account keys")
-		tx.target = nil
-		tx.amount = nil
-		tx.publickeys = tx.data[4:]
+		tx.parseChangeKeys()
 		return true
 
 	case 248: // tx create account
-		tx.isAccountCreator = true
-		logs.log("	Create account")
-		tx.target = nil
-		tx.amount = tx.data[4:8]
-		tx.publickeys = tx.data[8:]
+		tx.parseCreateAccount()
 		return true
 
 	default:
@@ -100,33 +93,32 @@ func (tx *Transaction) selectTxType() (code bool) {
 		}
 
 		//batch or contract
-		tx.amount = tx.data[4:8]
-		tx.pad = tx.data[8]
-		if uint8(tx.pad) > 1 {
-			tx.isBatch = true
-			logs.log("	Batch transaction")
+		if uint8(tx.data[8]) > 1 {
+			if len(tx.data) < 113 {
+				return false
+			}
+			tx.parseBatch()
 		} else {
-			tx.isContract = true
-			logs.log("	Contract")
-			tx.target = tx.data[9:13]
-			tx.payload = tx.data[13:]
+			if len(tx.data) < 13 {
+				return false
+			}
+			tx.parseContract()
 		}
 		return true
 	}
-	return false
 }
 
 func (tx *Transaction) verify() bool {
 	return true
 }
 
-func (tx *Transaction) verifyBatch(app *App) bool {
-	logs.log("verifying batch")
+func (tx *Transaction) verifyBatch(app *App) error {
+	checkLogs.log("verifying batch")
 
 	//check that height recorded into the state is not larger than the current height
 	maxheight := binary.BigEndian.Uint64(tx.state[32:40])
 	if app.blockHeight > int64(maxheight) {
-		return false
+		return errBatchExpired.wrap("height %d", maxheight)
 	}
 
 	//parse participating  account addresses
@@ -140,10 +132,10 @@ func (tx *Transaction) verifyBatch(app *App) bool {
 		address := tx.addresses[i : i+4]
 		account, err := app.fetchAccount(address)
 		if err != nil {
-			logs.logError("Problem with a batch entry: ", err)
-			continue
+			checkLogs.logError("Problem with a batch entry: ", err)
+			return errBatchEntry.wrap("address %s", eventAddress(address))
 		}
-		blsPubKey := account.Data[36:84]
+		blsPubKey := account.Data[accPubKeyEnd:accBlsKeyEnd]
 		cpKeys = append(cpKeys, blsPubKey)
 	}
 
@@ -153,110 +145,188 @@ func (tx *Transaction) verifyBatch(app *App) bool {
 
 	//verify aggregate signature
 	var dst = []byte("BLS_SIG_BLS12381G2_XMD:SHA-256_SSWU_RO_NUL_")
-	return sig.FastAggregateVerify(false, PKeys, tx.state, dst)
+	start := time.Now()
+	verified := sig.FastAggregateVerify(false, PKeys, tx.state, dst)
+	app.metrics.BlsSeconds.With("type", "batch").Observe(time.Since(start).Seconds())
+	if !verified {
+		return errBadBls.wrap("batch aggregate signature")
+	}
+	return nil
 }
 
 func (tx *Transaction) inCache(app *App) bool {
-	logs.log("Checking cache for tx...")
+	checkLogs.log("Checking cache for tx...")
 
 	// Check the map first
-	value, found := app.txMap[tx.hash]
-	if found == false {
+	value := app.txCache.get(tx.hash)
+	if value == nil {
 		return false
 	}
 
 	if bytes.Equal(tx.data, value.data) {
-		logs.log("Already in cache!")
+		checkLogs.log("Already in cache!")
 		return true
 	}
 
 	return false
 }
 
-func (tx *Transaction) verifyAccounts(app *App) (code uint32) {
-	logs.log("Has valid accounts?")
+func (tx *Transaction) verifyAccounts(app *App) error {
+	checkLogs.log("Has valid accounts?")
 
-	logs.log("Source account: ")
+	checkLogs.log("Source account: ")
 	account, err := app.fetchAccount(tx.source)
 	if err != nil {
-		logs.logError("source account not found: ", err)
-		return 17
+		checkLogs.logError("source account not found: ", err)
+		return errUnknownSource.wrap("%v", err)
 	}
 
-	logs.log("Target account: ")
+	checkLogs.log("Target account: ")
 	if tx.target != nil {
 		_, err = app.fetchAccount(tx.target)
 	}
 
 	if err != nil {
-		logs.logError("target account not found: ", err)
-		return 18
+		checkLogs.logError("target account not found: ", err)
+		return errUnknownTarget.wrap("%v", err)
 	}
 
 	if tx.amount != nil {
-		tx.Amount = binary.BigEndian.Uint32(tx.amount)
+		tx.Amount = parseAmount(tx.amount)
 	}
 
 	return tx.verifyFee(account, app)
 }
 
-func (tx *Transaction) verifyFee(account *Account, app *App) (code uint32) {
-	logs.log("Has enough amount to pay fees?")
+func (tx *Transaction) verifyFee(account *Account, app *App) error {
+	checkLogs.log("Has enough amount to pay fees?")
 
-	tx.Fee = app.gas * uint32(tx.length)
-	if tx.Amount+tx.Fee > account.Amount {
-		logs.log("NO!")
-		return 23
+	//the base fee is burned, the tip goes to the proposer
+	fee, ok := mulAmount(app.baseFee, uint64(tx.length))
+	if ok {
+		fee, ok = addAmount(fee, tx.Tip)
+	}
+	if !ok {
+		checkLogs.log("Fee overflow!")
+		return errFeeOverflow
 	}
-	return 0
+	tx.Fee = fee
+
+	total, ok := addAmount(tx.Amount, tx.Fee)
+	if !ok || total > account.Amount {
+		checkLogs.log("NO!")
+		return errInsufficient.wrap("balance %d, amount %d, fee %d", account.Amount, tx.Amount, tx.Fee)
+	}
+	return nil
 }
 
-func (tx *Transaction) fetchTx(rawtx []byte, app *App) (code uint32) {
-	logs.log("Fetching tx...")
+// chargeCheckState debits an accepted mempool tx from the check state of its
+// source account, so that following txs of the account are checked against
+// the pending balance and signed with the next counter
+func (tx *Transaction) chargeCheckState(app *App) {
+	account, err := app.fetchAccount(tx.source)
+	if err != nil {
+		checkLogs.logError("source account not found: ", err)
+		return
+	}
+
+	//verifyFee has checked that the balance covers amount and fee
+	charge, ok := addAmount(tx.Amount, tx.Fee)
+	if !ok || charge > account.Amount {
+		charge = account.Amount
+	}
+	account.Amount -= charge
+
+	account.Counter++
+	account.counter = make([]byte, 4)
+	binary.BigEndian.PutUint32(account.counter, account.Counter)
+}
+
+func (tx *Transaction) fetchTx(rawtx []byte, app *App) error {
+	checkLogs.log("Fetching tx...")
 	// check format
 	tx.length = len(rawtx)
 
 	//tx max size check
 	if tx.length > 1401 {
-		logs.log("Too big!")
-		return 1
+		checkLogs.log("Too big!")
+		return errTxTooBig.wrap("%d bytes", tx.length)
 	}
 
 	// tx min size check
 	if tx.length < 68 {
-		logs.log("Too small!")
-		return 2
+		checkLogs.log("Too small!")
+		return errTxTooSmall.wrap("%d bytes", tx.length)
 	}
 
 	//parse values
 	tx.signature = rawtx[:64]
-	tx.data = rawtx[64:]
+	signed := rawtx[64:]
+	tx.data = signed
+
+	//strip the header of versioned transactions, the body keeps the legacy layout
+	if signed[0] == txFormatV1 {
+		if len(signed) < txHeaderSize+4 {
+			checkLogs.log("Too small!")
+			return errTxTooSmall.wrap("%d bytes", tx.length)
+		}
+		tx.version = signed[0]
+		tx.txType = signed[1]
+		tx.validUntil = binary.BigEndian.Uint64(signed[2:10])
+		tx.Tip = binary.BigEndian.Uint64(signed[10:18])
+		tx.data = signed[txHeaderSize:]
+
+		if tx.validUntil != 0 && app.executingHeight() > tx.validUntil {
+			checkLogs.log("Expired!")
+			return errTxExpired.wrap("valid until %d", tx.validUntil)
+		}
+	}
+
+	//legacy transactions are retired from the cutoff height on
+	if tx.version == 0 && app.legacyTxCutoff > 0 && app.executingHeight() >= uint64(app.legacyTxCutoff) {
+		checkLogs.log("Legacy format no longer accepted!")
+		return errLegacyFormat
+	}
+
 	tx.source = tx.data[:4]
-	hash := app.sha2(tx.data)
+
+	//the header is covered by the signature
+	hash := app.sha2(signed)
 	copy(tx.hash[:], hash)
 
-	return 0
+	return nil
 }
 
-func (tx *Transaction) isValid(app *App) (code uint32) {
-	logs.log("Is valid?")
+func (tx *Transaction) isValid(app *App) error {
+	checkLogs.log("Is valid?")
 	if tx.inCache(app) {
-		return 33
+		return errTxInCache
 	}
 
-	if !tx.isSigned(app) {
-		return 39
+	return tx.verifyTx(app, nil)
+}
+
+// verifyTx checks signature, type, bls proofs and accounts of a tx, a proof of
+// possession already verified on the cached tx with the same key and counter is reused
+func (tx *Transaction) verifyTx(app *App, cached *Transaction) error {
+	err := tx.isSigned(app)
+	if err != nil {
+		return err
 	}
 
 	if !tx.selectTxType() {
-		return 44
+		return errUnknownTxType
 	}
 
-	if !tx.verifyBlsTx(app) {
-		return 89
+	if cached != nil && bytes.Equal(cached.data, tx.data) &&
+		bytes.Equal(cached.pubkey, tx.pubkey) && bytes.Equal(cached.counter, tx.counter) {
+		tx.popVerified = cached.popVerified
 	}
 
-	return tx.verifyAccounts(app)
+	err = tx.verifyBlsTx(app)
+	if err != nil {
+		return err
+	}
 
-	return 11
+	return tx.verifyAccounts(app)
 }
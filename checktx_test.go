@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLegacyTxCutoff(t *testing.T) {
+	accounts := newTestAccounts(t, 1)
+	app := newTestApp(t, testGenesis(t, accounts, 1000, &genesisParams{Gas: 1, LegacyTxCutoff: 10}))
+
+	signer := accounts[0].signer(t, app)
+	signer.Legacy = true
+	legacy, err := signer.Stake(10)
+	require.Nil(t, err)
+	signer.Legacy = false
+	versioned, err := signer.Stake(10)
+	require.Nil(t, err)
+
+	tests := []struct {
+		name      string
+		committed int64
+		//EndBlock of the next block ran, Commit did not yet
+		ended bool
+		tx    []byte
+		err   error
+	}{
+		{"legacy before the cutoff", 8, false, legacy, nil},
+		{"legacy before the cutoff between EndBlock and Commit", 8, true, legacy, nil},
+		{"legacy in the cutoff block", 9, false, legacy, errLegacyFormat},
+		{"legacy after the cutoff", 20, false, legacy, errLegacyFormat},
+		{"versioned after the cutoff", 20, false, versioned, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app.committedHeight = tt.committed
+			app.blockHeight = tt.committed
+			if tt.ended {
+				app.blockHeight++
+			}
+			err := new(Transaction).fetchTx(tt.tx, app)
+			if tt.err == nil {
+				assert.Nil(t, err)
+			} else {
+				assert.ErrorIs(t, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestTxFormats(t *testing.T) {
+	tests := []struct {
+		name    string
+		legacy  bool
+		chainID string
+		code    uint32
+	}{
+		{"versioned", false, testChainID, 0},
+		{"versioned for another chain", false, "other-chain", errBadSignature.Code},
+		{"versioned without chain id", false, "", errBadSignature.Code},
+		{"legacy", true, "", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			accounts := newTestAccounts(t, 2)
+			app := newTestApp(t, testGenesis(t, accounts, 1000000, nil))
+
+			signer := accounts[0].signer(t, app)
+			signer.Legacy = tt.legacy
+			signer.ChainID = tt.chainID
+			tx, err := signer.Transfer(accounts[1].address, 10)
+			require.Nil(t, err)
+
+			results := commitBlock(t, app, tx)
+			assert.Equal(t, tt.code, results[0].Code, results[0].Log)
+		})
+	}
+}
@@ -0,0 +1,240 @@
+// wallet generates keys, queries accounts and submits transactions to a zkSpace node
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	rpchttp "github.com/tendermint/tendermint/rpc/client/http"
+
+	"kvstore/sdk"
+)
+
+const usage = `usage: wallet <command> [flags]
+
+commands:
+  keygen     generate an ed25519 and BLS12-381 keypair
+  pop        derive the BLS proof of possession for a source account and counter
+  balance    query the balance and counter of an account
+  transfer   transfer funds to another account
+  stake      stake funds on the validator key of the account
+  contract   write a payload to a contract
+
+run "wallet <command> -h" for the flags of a command
+`
+
+// keyFile holds the hex encoded secret keys of an account
+type keyFile struct {
+	Ed25519 string `json:"ed25519"`
+	Bls     string `json:"bls"`
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Print(usage)
+		os.Exit(2)
+	}
+
+	var err error
+	args := os.Args[2:]
+	switch os.Args[1] {
+	case "keygen":
+		err = keygen(args)
+	case "pop":
+		err = pop(args)
+	case "balance":
+		err = balance(args)
+	case "transfer", "stake", "contract":
+		err = submit(os.Args[1], args)
+	default:
+		fmt.Print(usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func keygen(args []string) error {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	out := fs.String("out", "key.json", "file to write the secret keys to")
+	fs.Parse(args)
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return err
+	}
+	bls, err := sdk.GenerateBlsKey(nil)
+	if err != nil {
+		return err
+	}
+
+	keys, err := json.MarshalIndent(keyFile{
+		Ed25519: hex.EncodeToString(priv),
+		Bls:     hex.EncodeToString(bls.Bytes()),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(*out, keys, 0600); err != nil {
+		return err
+	}
+
+	fmt.Println("ed25519 public key:", hex.EncodeToString(pub))
+	fmt.Println("bls public key:    ", hex.EncodeToString(bls.PubKey()))
+	return nil
+}
+
+func pop(args []string) error {
+	fs := flag.NewFlagSet("pop", flag.ExitOnError)
+	keyPath := fs.String("key", "key.json", "key file")
+	source := fs.Uint("source", 0, "address of the account sending the create or key change tx")
+	counter := fs.Uint("counter", 0, "counter of the source account")
+	fs.Parse(args)
+
+	_, bls, err := loadKeys(*keyPath)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("bls public key:", hex.EncodeToString(bls.PubKey()))
+	fmt.Println("pop:           ", hex.EncodeToString(bls.Pop(uint32(*source), uint32(*counter))))
+	return nil
+}
+
+func balance(args []string) error {
+	fs := flag.NewFlagSet("balance", flag.ExitOnError)
+	node := fs.String("node", "http://localhost:26657", "tendermint rpc endpoint")
+	address := fs.Uint("address", 0, "account address")
+	fs.Parse(args)
+
+	client, err := rpchttp.New(*node, "/websocket")
+	if err != nil {
+		return err
+	}
+
+	account, err := fetchAccount(client, uint32(*address))
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("balance:", account.Balance)
+	fmt.Println("counter:", account.Counter)
+	fmt.Println("pubkey: ", hex.EncodeToString(account.PubKey))
+	return nil
+}
+
+func submit(command string, args []string) error {
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	node := fs.String("node", "http://localhost:26657", "tendermint rpc endpoint")
+	keyPath := fs.String("key", "key.json", "key file")
+	from := fs.Uint("from", 0, "address of the sending account")
+	to := fs.Uint("to", 0, "target account (transfer) or contract (contract)")
+	amount := fs.Uint("amount", 0, "amount to transfer, stake or pay to the contract")
+	payload := fs.String("payload", "", "hex encoded contract payload")
+	legacy := fs.Bool("legacy", false, "use the legacy length based tx format")
+	validUntil := fs.Uint64("valid-until", 0, "last height the tx can be included at, 0 never expires")
+	tip := fs.Uint64("tip", 0, "tip paid to the proposer on top of the base fee")
+	fs.Parse(args)
+
+	priv, _, err := loadKeys(*keyPath)
+	if err != nil {
+		return err
+	}
+
+	client, err := rpchttp.New(*node, "/websocket")
+	if err != nil {
+		return err
+	}
+
+	//transactions are signed over the current counter of the account
+	account, err := fetchAccount(client, uint32(*from))
+	if err != nil {
+		return err
+	}
+	//versioned transactions are bound to the chain id of the node
+	status, err := client.Status(context.Background())
+	if err != nil {
+		return err
+	}
+	signer := sdk.NewSigner(priv, uint32(*from), account.Counter, status.NodeInfo.Network)
+	signer.ValidUntil = *validUntil
+	signer.Tip = *tip
+	signer.Legacy = *legacy
+
+	var tx []byte
+	switch command {
+	case "transfer":
+		tx, err = signer.Transfer(uint32(*to), uint32(*amount))
+	case "stake":
+		tx, err = signer.Stake(uint32(*amount))
+	case "contract":
+		var data []byte
+		data, err = hex.DecodeString(*payload)
+		if err != nil {
+			return err
+		}
+		tx, err = signer.Contract(uint32(*to), uint32(*amount), data)
+	}
+	if err != nil {
+		return err
+	}
+
+	res, err := client.BroadcastTxSync(context.Background(), tx)
+	if err != nil {
+		return err
+	}
+	if res.Code != 0 {
+		return fmt.Errorf("tx %X rejected with code %d %s", res.Hash, res.Code, res.Log)
+	}
+
+	fmt.Printf("tx %X accepted\n", res.Hash)
+	return nil
+}
+
+func fetchAccount(client *rpchttp.HTTP, address uint32) (*sdk.Account, error) {
+	res, err := client.ABCIQuery(context.Background(), "", sdk.AddressQuery(address))
+	if err != nil {
+		return nil, err
+	}
+	return sdk.ParseAccount(res.Response.Value)
+}
+
+func loadKeys(path string) (ed25519.PrivateKey, *sdk.BlsKey, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var keys keyFile
+	if err = json.Unmarshal(raw, &keys); err != nil {
+		return nil, nil, err
+	}
+
+	priv, err := hex.DecodeString(keys.Ed25519)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(priv) != ed25519.PrivateKeySize {
+		return nil, nil, errors.New("invalid ed25519 key in key file")
+	}
+
+	blsKey, err := hex.DecodeString(keys.Bls)
+	if err != nil {
+		return nil, nil, err
+	}
+	bls, err := sdk.BlsKeyFromBytes(blsKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return ed25519.PrivateKey(priv), bls, nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	cfg "github.com/tendermint/tendermint/config"
+	tmos "github.com/tendermint/tendermint/libs/os"
+	tmrand "github.com/tendermint/tendermint/libs/rand"
+	nm "github.com/tendermint/tendermint/node"
+	"github.com/tendermint/tendermint/p2p"
+	"github.com/tendermint/tendermint/privval"
+	tmtypes "github.com/tendermint/tendermint/types"
+	tmtime "github.com/tendermint/tendermint/types/time"
+	tmversion "github.com/tendermint/tendermint/version"
+)
+
+// initNode writes the files a node needs to start, existing ones are kept
+func initNode(args []string) error {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	home := homeFlag(fs)
+	chainID := fs.String("chain-id", "", "chain id of the genesis file, random if empty")
+	accounts := fs.String("accounts", "", "json file with the initial accounts of the app_state, see GENESIS")
+	fs.Parse(args)
+
+	configFile := homeConfigFile(*home)
+	newConfig := !tmos.FileExists(configFile)
+	cfg.EnsureRoot(*home)
+	if newConfig {
+		err := writeAppConfig(configFile, DefaultAppConfig())
+		if err != nil {
+			return errors.Wrap(err, "failed to write the app config")
+		}
+	}
+
+	config, appConfig, err := loadConfig(configFile)
+	if err != nil {
+		return err
+	}
+
+	privValKeyFile := config.PrivValidatorKeyFile()
+	privValStateFile := config.PrivValidatorStateFile()
+	var pv *privval.FilePV
+	if tmos.FileExists(privValKeyFile) {
+		pv = privval.LoadFilePV(privValKeyFile, privValStateFile)
+		logs.info("Found private validator", "keyFile", privValKeyFile)
+	} else {
+		pv = privval.GenFilePV(privValKeyFile, privValStateFile)
+		pv.Save()
+		logs.info("Generated private validator", "keyFile", privValKeyFile)
+	}
+
+	_, err = p2p.LoadOrGenNodeKey(config.NodeKeyFile())
+	if err != nil {
+		return errors.Wrap(err, "failed to create the node key")
+	}
+
+	genFile := config.GenesisFile()
+	if tmos.FileExists(genFile) {
+		logs.info("Found genesis file", "path", genFile)
+		return nil
+	}
+
+	state := genesisState{Accounts: []genesisAccount{}, Contracts: []genesisContract{}, Params: appConfig.genesisParams()}
+	if *accounts != "" {
+		data, err := os.ReadFile(*accounts)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(data, &state.Accounts)
+		if err != nil {
+			return errors.Wrap(err, "invalid accounts file")
+		}
+	}
+	appState, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if *chainID == "" {
+		*chainID = "zkspace-" + tmrand.Str(6)
+	}
+	pubKey, err := pv.GetPubKey()
+	if err != nil {
+		return err
+	}
+	genDoc := tmtypes.GenesisDoc{
+		ChainID:         *chainID,
+		GenesisTime:     tmtime.Now(),
+		ConsensusParams: tmtypes.DefaultConsensusParams(),
+		Validators: []tmtypes.GenesisValidator{{
+			Address: pubKey.Address(),
+			PubKey:  pubKey,
+			Power:   10,
+		}},
+		AppState: appState,
+	}
+	genDoc.ConsensusParams.Version.AppVersion = AppVersion
+
+	err = genDoc.SaveAs(genFile)
+	if err != nil {
+		return err
+	}
+	logs.info("Generated genesis file", "path", genFile, "chainId", *chainID)
+	return nil
+}
+
+// tendermint databases removed by unsafe-reset-all, relative to its data directory
+var tendermintDbNames = []string{"blockstore.db", "state.db", "evidence.db", "tx_index.db", "cs.wal"}
+
+// resetAll removes the blockchain and the application state, keeping the
+// keys, config and genesis file. The private validator forgets its last sign state
+func resetAll(args []string) error {
+	fs := flag.NewFlagSet("unsafe-reset-all", flag.ExitOnError)
+	home := homeFlag(fs)
+	keepAddrBook := fs.Bool("keep-addr-book", false, "keep the address book")
+	fs.Parse(args)
+
+	config, appConfig, err := loadConfig(homeConfigFile(*home))
+	if err != nil {
+		return err
+	}
+
+	err = resetAppData(appConfig.DataDir)
+	if err != nil {
+		return errors.Wrap(err, "failed to remove the application databases")
+	}
+	logs.info("Removed application databases", "dir", appConfig.DataDir)
+
+	for _, name := range tendermintDbNames {
+		err = os.RemoveAll(filepath.Join(config.DBDir(), name))
+		if err != nil {
+			return errors.Wrap(err, "failed to remove the tendermint databases")
+		}
+	}
+	logs.info("Removed tendermint databases", "dir", config.DBDir())
+
+	if !*keepAddrBook {
+		err = os.Remove(config.P2P.AddrBookFile())
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if tmos.FileExists(config.PrivValidatorKeyFile()) {
+		privval.LoadFilePV(config.PrivValidatorKeyFile(), config.PrivValidatorStateFile()).Reset()
+		logs.info("Reset private validator state", "file", config.PrivValidatorStateFile())
+	}
+	return nil
+}
+
+// exportGenesisFile writes the state of the last committed height as a genesis
+// file, the node must be stopped
+func exportGenesisFile(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	home := homeFlag(fs)
+	height := fs.Int64("height", 0, "height to export, 0 for the last committed one")
+	out := fs.String("out", "exported_genesis.json", "file to write the genesis to")
+	allowPruned := fs.Bool("allow-pruned-payloads", false, "export contracts whose last payload is no longer stored with an empty one")
+	fs.Parse(args)
+
+	config, appConfig, err := loadConfig(homeConfigFile(*home))
+	if err != nil {
+		return err
+	}
+	current, err := nm.DefaultGenesisDocProviderFunc(config)()
+	if err != nil {
+		return errors.Wrap(err, "failed to read genesis file")
+	}
+
+	app, err := NewApp(appConfig)
+	if err != nil {
+		return errors.Wrap(err, "failed to open the application")
+	}
+	defer app.closeDbs()
+
+	err = app.bindChainID(current.ChainID)
+	if err != nil {
+		return err
+	}
+	genDoc, err := app.exportGenesis(current, *height, *allowPruned)
+	if err != nil {
+		return err
+	}
+	err = genDoc.SaveAs(*out)
+	if err != nil {
+		return err
+	}
+	logs.info("Exported state", "height", app.blockHeight, "file", *out)
+	return nil
+}
+
+// importGenesisFile makes an exported genesis file the genesis of a node without
+// any state, the previous genesis file is kept with a .bak extension
+func importGenesisFile(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	home := homeFlag(fs)
+	in := fs.String("in", "exported_genesis.json", "genesis file written by export")
+	fs.Parse(args)
+
+	config, appConfig, err := loadConfig(homeConfigFile(*home))
+	if err != nil {
+		return err
+	}
+
+	genDoc, err := tmtypes.GenesisDocFromFile(*in)
+	if err != nil {
+		return errors.Wrap(err, "invalid genesis file")
+	}
+	var state genesisState
+	err = json.Unmarshal(genDoc.AppState, &state)
+	if err != nil {
+		return errors.Wrap(err, "invalid app_state")
+	}
+
+	if hasAppData(appConfig.DataDir) || tmos.FileExists(filepath.Join(config.DBDir(), "blockstore.db")) {
+		return errors.New("the node has state, run unsafe-reset-all first")
+	}
+
+	genFile := config.GenesisFile()
+	if tmos.FileExists(genFile) {
+		err = os.Rename(genFile, genFile+".bak")
+		if err != nil {
+			return err
+		}
+	}
+	err = genDoc.SaveAs(genFile)
+	if err != nil {
+		return err
+	}
+	logs.info("Imported genesis", "chainId", genDoc.ChainID, "initialHeight", genDoc.InitialHeight,
+		"accounts", len(state.Accounts), "contracts", len(state.Contracts))
+	return nil
+}
+
+func printVersion() {
+	fmt.Printf("version:     %s\n", Version)
+	fmt.Printf("app version: %d\n", AppVersion)
+	fmt.Printf("tendermint:  %s\n", tmversion.TMCoreSemVer)
+	fmt.Printf("abci:        %s\n", tmversion.ABCISemVer)
+}
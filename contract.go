@@ -13,27 +13,36 @@ type Contract struct {
 	Payload []byte
 }
 
-func (app *App) commitContractsToDb() {
-	logs.log("Commiting contracts to db... ")
+func (app *App) commitContractsToDb() error {
+	execLogs.log("Commiting contracts to db... ")
 
 	app.ctxDbMutex.Lock()
+	defer app.ctxDbMutex.Unlock()
 	conBatch := db.NewBatch(app.contractStorageDb)
+	defer conBatch.Discard()
 	conLedgBatch := db.NewBatch(app.contractLedgerDb)
+	defer conLedgBatch.Discard()
 	wCn := app.contractDb.WriteTx()
+	defer wCn.Discard()
 
 	//prepare old contracts for updating
 	for _, contract := range app.tempContractMap {
 		err := app.contractTree.UpdateWithTx(wCn, contract.Address, contract.counter)
 		if err != nil {
-			logs.logError("Failed to update contract Tree: ", err)
-			panic(err)
+			execLogs.logError("Failed to update contract Tree: ", err)
+			return err
+		}
+		err = app.commitContractToDb(contract, conBatch)
+		if err != nil {
+			return err
 		}
-		app.commitContractToDb(contract, conBatch)
 	}
 
 	//commit old contracts to tree
-	wCn.Commit()
-	wCn.Discard()
+	err := wCn.Commit()
+	if err != nil {
+		return err
+	}
 
 	//prepare new contracts for writing on tree and db
 	zerocounter := []byte{0, 0, 0, 0, 0, 0, 0, 0}
@@ -43,55 +52,73 @@ func (app *App) commitContractsToDb() {
 		newContractKeys = append(newContractKeys, contract.Address)
 		newContractValues = append(newContractValues, zerocounter)
 		contract.counter = zerocounter[:]
-		app.commitContractToDb(contract, conBatch)
-		app.commitContractToLedger(contract, conLedgBatch)
+		err = app.commitContractToDb(contract, conBatch)
+		if err != nil {
+			return err
+		}
+		err = app.commitContractToLedger(contract, conLedgBatch)
+		if err != nil {
+			return err
+		}
 	}
 
 	//add new contracts to contract tree
-	app.contractTree.AddBatch(newContractKeys, newContractValues)
+	invalids, err := app.contractTree.AddBatch(newContractKeys, newContractValues)
+	if err != nil {
+		execLogs.logError("Failed to add contracts to the contract Tree: ", err)
+		return err
+	}
+	if len(invalids) != 0 {
+		execLogs.debug("Contracts not added to the contract Tree", "count", len(invalids))
+	}
 
 	//now write contract payloads to db for data availability
-	conBatch.Commit()
-	conBatch.Discard()
-
-	conLedgBatch.Commit()
-	conLedgBatch.Discard()
+	err = conBatch.Commit()
+	if err != nil {
+		return err
+	}
 
-	app.ctxDbMutex.Unlock()
+	err = conLedgBatch.Commit()
+	if err != nil {
+		return err
+	}
 
 	//reset contract maps
 	app.tempContractMap = make(map[[4]byte]*Contract)
 	app.tempNewContractMap = make(map[[4]byte]*Contract)
+	return nil
 }
 
-func (app *App) commitContractToLedger(contract *Contract, conLedgBatch *db.Batch) {
-	logs.log("Commiting contract to ledger... ")
+func (app *App) commitContractToLedger(contract *Contract, conLedgBatch *db.Batch) error {
+	execLogs.log("Commiting contract to ledger... ")
 
 	if !app.accountWatch {
-		return
+		return nil
 	}
 
 	hash := app.sha2(contract.Payload)
 	err := conLedgBatch.Set(hash, contract.Address)
 	if err != nil {
-		logs.logError("Failed to insert element to conLedgBatch: ", err)
-		panic(err)
+		execLogs.logError("Failed to insert element to conLedgBatch: ", err)
+		return err
 	}
+	return nil
 }
 
-func (app *App) commitContractToDb(contract *Contract, conBatch *db.Batch) {
-	logs.log("Commiting contract to db... ")
+func (app *App) commitContractToDb(contract *Contract, conBatch *db.Batch) error {
+	execLogs.log("Commiting contract to db... ")
 
 	address := append(contract.Address, contract.counter...)
 	err := conBatch.Set(address, contract.Payload)
 	if err != nil {
-		logs.logError("Failed to insert element to conBatch: ", err)
-		panic(err)
+		execLogs.logError("Failed to insert element to conBatch: ", err)
+		return err
 	}
+	return nil
 }
 
 func (contract *Contract) createContract(app *App, key [4]byte) {
-	logs.log("Creating contract... ")
+	execLogs.log("Creating contract... ")
 
 	var nextaddr [4]byte
 	nextAddr := uint32(app.contractNumOnDb + len(app.tempNewContractMap))
@@ -102,14 +129,14 @@ func (contract *Contract) createContract(app *App, key [4]byte) {
 }
 
 func (contract *Contract) writeContract(app *App, key [4]byte) {
-	logs.log("Writting contract to temporary map... ")
+	execLogs.log("Writting contract to temporary map... ")
 	contract.counter = make([]byte, 8)
 	binary.BigEndian.PutUint64(contract.counter, contract.Counter)
 	app.tempContractMap[key] = contract
 }
 
 func (app *App) fetchContract(key [4]byte) *Contract {
-	logs.log("Fetching contract... ")
+	execLogs.log("Fetching contract... ")
 
 	contract := &Contract{}
 
@@ -123,7 +150,7 @@ func (app *App) fetchContract(key [4]byte) *Contract {
 	/////TODO: explanation
 	_, counter, err := app.contractTree.Get(key[:])
 	if err != nil {
-		logs.dlog("Failed to get element from contract tree: ", err)
+		execLogs.dlog("Failed to get element from contract tree: ", err)
 		return contract
 	}
 
@@ -136,14 +163,14 @@ func (app *App) fetchContract(key [4]byte) *Contract {
 }
 
 func (app *App) findContractBypHash(pHash []byte) (*Contract, error) {
-	logs.log("Searching contract in db by pHash... ")
+	execLogs.log("Searching contract in db by pHash... ")
 
-	rTx := app.accountLedgerDb.ReadTx()
+	rTx := app.contractLedgerDb.ReadTx()
 	var address [4]byte
 
 	addr, err := rTx.Get(pHash)
 	if err != nil {
-		logs.logError("Contract cannot be not found: ", err)
+		execLogs.logError("Contract cannot be not found: ", err)
 		return nil, err
 	}
 
@@ -2,30 +2,66 @@ package main
 
 import (
 	"os"
+	"path/filepath"
+
 	badb "go.vocdoni.io/dvote/db/badgerdb"
 )
 
-// helper strings for swapping databases
-var badg0 string = "badg0"
-var badg1 string = "badg1"
-var badg2 string = "badg2"
-var badg3 string = "badg3"
+// blocks between swaps of the tx and contract storage databases
+const txStorageSwapBlocks = 1024
+
+// dbPath returns the location of a database in the data directory
+func (app *App) dbPath(name string) string {
+	return filepath.Join(app.dataDir, name)
+}
 
-var contractdb string = "contractdb"
-var contractdb2 string = "contractdb2"
+// databases created by NewApp in the data directory
+var appDbNames = []string{
+	"accdb", "condb", "contractdb", "contractdb2",
+	"badg", "badg0", "badg2", "badg3", "badg4", "badg5", "badg6", "badg7",
+	"statedb", "snapdb",
+}
+
+// resetAppData removes the databases and halt dumps of the application,
+// anything else in the data directory is left alone
+func resetAppData(dataDir string) error {
+	for _, name := range appDbNames {
+		err := os.RemoveAll(filepath.Join(dataDir, name))
+		if err != nil {
+			return err
+		}
+	}
+	dumps, err := filepath.Glob(filepath.Join(dataDir, "halt-*.json"))
+	if err != nil {
+		return err
+	}
+	for _, dump := range dumps {
+		err = os.Remove(dump)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasAppData reports whether the application has committed any state in the data directory
+func hasAppData(dataDir string) bool {
+	_, err := os.Stat(filepath.Join(dataDir, "statedb"))
+	return err == nil
+}
 
 func (app *App) destroyDb(dbpoint *badb.BadgerDB, dbname string) error {
 	// Close any existing database and delete the files
 	err := dbpoint.Close()
 	if err != nil {
-		logs.logError("Failed to close database "+dbname+" !!!", err)
+		commitLogs.logError("Failed to close database "+dbname+" !!!", err)
 		return err
 	}
 
 	// Remove the directory and its contents
 	err = os.RemoveAll(dbname)
 	if err != nil {
-		logs.logError("Failed to remove database "+dbname+" files!!!", err)
+		commitLogs.logError("Failed to remove database "+dbname+" files!!!", err)
 		return err
 	}
 	return nil
@@ -39,7 +75,7 @@ func (app *App) clearDb(db *badb.BadgerDB) error {
 	err := db.Iterate(nil, func(key, value []byte) bool {
 		// Delete the key
 		if err := tx.Delete(key); err != nil {
-			logs.logError("ClearDb Failed to delete one entry: ", err)
+			commitLogs.logError("ClearDb Failed to delete one entry: ", err)
 			return false
 		}
 		return true
@@ -47,14 +83,14 @@ func (app *App) clearDb(db *badb.BadgerDB) error {
 
 	// Check for any errors during iteration
 	if err != nil {
-		logs.logError("ClearDb iteration Failed: ", err)
+		commitLogs.logError("ClearDb iteration Failed: ", err)
 		return err
 	}
 
 	// Commit the transaction to clear the database
 	err = tx.Commit()
 	if err != nil {
-		logs.logError("ClearDb Failed to commit: ", err)
+		commitLogs.logError("ClearDb Failed to commit: ", err)
 		return err
 	}
 	return nil
@@ -62,58 +98,90 @@ func (app *App) clearDb(db *badb.BadgerDB) error {
 
 func (app *App) swapDb() error {
 	//swap and reset tx databases periodically
-	if app.blockHeight%1024 == 0 {
-		//swap tx db
-		app.txDbMutex.Lock()
-
-		//clear one database
-		err := app.clearDb(app.txStorageDb2)
-		if err != nil {
-			return err
-		}
-
-		//swap db names and references
-		tempdbname := badg2
-		badg2 = badg3
-		badg3 = tempdbname
+	if app.blockHeight%txStorageSwapBlocks != 0 {
+		return nil
+	}
+	err := app.swapTxDb()
+	if err != nil {
+		return err
+	}
+	return app.swapContractDb()
+}
 
-		tempdb := app.txStorageDb
-		app.txStorageDb = app.txStorageDb2
-		app.txStorageDb2 = tempdb
+// orderStorageDbs puts the front tx and contract storage databases in place
+// for the current height, as swapDb left them
+func (app *App) orderStorageDbs() {
+	if (app.blockHeight/txStorageSwapBlocks)%2 == 1 {
+		app.txStorageDb, app.txStorageDb2 = app.txStorageDb2, app.txStorageDb
+		app.txStorageTree, app.txStorageTree2 = app.txStorageTree2, app.txStorageTree
+		app.contractStorageDb, app.contractStorageDb2 = app.contractStorageDb2, app.contractStorageDb
+	}
+}
 
-		temptree := app.txStorageTree
-		app.txStorageTree = app.txStorageTree2
-		app.txStorageTree2 = temptree
+// swapTxDb clears the back tx database and brings it to the front
+func (app *App) swapTxDb() error {
+	app.txDbMutex.Lock()
+	defer app.txDbMutex.Unlock()
 
-		//reopen front db and recreate tree
-		app.txStorageDb, app.txStorageTree, err = app.createTree(app.txStorageDb, 64, true)
-		if err != nil {
-			logs.logError("Failed to recreate tree: ", err)
-			return err
-		}
+	//clear one database
+	err := app.clearDb(app.txStorageDb2)
+	if err != nil {
+		return err
+	}
 
-		app.txDbMutex.Unlock()
+	//swap db references
+	tempdb := app.txStorageDb
+	app.txStorageDb = app.txStorageDb2
+	app.txStorageDb2 = tempdb
 
-		//swap contract db
-		app.ctxDbMutex.Lock()
+	temptree := app.txStorageTree
+	app.txStorageTree = app.txStorageTree2
+	app.txStorageTree2 = temptree
 
-		//swap db names and references
-		tempdbname = contractdb
-		contractdb = contractdb2
-		contractdb2 = tempdbname
+	//reopen front db and recreate tree
+	app.txStorageDb, app.txStorageTree, err = app.createTree(app.txStorageDb, 64, true)
+	if err != nil {
+		commitLogs.logError("Failed to recreate tree: ", err)
+		return err
+	}
+	return nil
+}
 
-		tempcdb := app.contractStorageDb
-		app.contractStorageDb = app.contractStorageDb2
-		app.contractStorageDb2 = tempcdb
+// swapContractDb swaps the contract databases and clears the new front one
+func (app *App) swapContractDb() error {
+	app.ctxDbMutex.Lock()
+	defer app.ctxDbMutex.Unlock()
 
-		//reset contract db
-		err = app.clearDb(app.contractStorageDb)
-		if err != nil {
-			logs.logError("Failed to clear contract storage database: ", err)
-			return err
-		}
+	//swap db references
+	tempcdb := app.contractStorageDb
+	app.contractStorageDb = app.contractStorageDb2
+	app.contractStorageDb2 = tempcdb
 
-		app.ctxDbMutex.Unlock()
+	//reset contract db
+	err := app.clearDb(app.contractStorageDb)
+	if err != nil {
+		commitLogs.logError("Failed to clear contract storage database: ", err)
+		return err
 	}
 	return nil
 }
+
+// closeDbs closes every database of the application
+func (app *App) closeDbs() {
+	//app.ndb.Close()
+	//app.txCacheDb.Close()
+	app.accountLedgerDb.Close()
+	app.contractLedgerDb.Close()
+	app.contractDb.Close()
+	app.contractStorageDb.Close()
+	app.contractStorageDb2.Close()
+	app.accountDb.Close()
+	app.txStorageDb.Close()
+	app.txStorageDb2.Close()
+	app.blockHashDb.Close()
+	app.validatorDb.Close()
+	app.delegationDb.Close()
+	app.unbondingDb.Close()
+	app.stateDb.Close()
+	app.snapshotDb.Close()
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/vocdoni/arbo"
+	"go.vocdoni.io/dvote/db"
+)
+
+// delegation leaves are keyed by delegator account (4 bytes) and validator address (20 bytes)
+// [ 8 bytes | 8 bytes ]
+// [ stake   | rewards ]
+// arbo can not delete leaves, an undelegated entry is left with zero stake and rewards
+
+func delegationKey(delegator, valAddr []byte) []byte {
+	key := make([]byte, 24)
+	copy(key[:4], delegator)
+	copy(key[4:], valAddr)
+	return key
+}
+
+// validatorOf returns the validator of the key registered on an account
+func (app *App) validatorOf(address []byte) (*Validator, error) {
+	account, err := app.fetchAccount(address)
+	if err != nil {
+		return nil, err
+	}
+	return app.fetchValidator(app.toAddress(account.schnorrPubKey))
+}
+
+// delegations are indexed by validator address and delegator account in the
+// database of the delegation tree, next to the nodes of the tree. Index entries
+// are never removed, an entry of a rolled back leaf points to a missing leaf
+var (
+	delegationIndexPrefix   = []byte("vd/")
+	stateDelegationIndexKey = []byte("delegationindex")
+)
+
+// delegationIndexKey returns the index entry of a delegation key
+func delegationIndexKey(key []byte) []byte {
+	index := make([]byte, 0, len(delegationIndexPrefix)+24)
+	index = append(index, delegationIndexPrefix...)
+	index = append(index, key[4:]...)
+	return append(index, key[:4]...)
+}
+
+// indexDelegations builds the index of the delegations on the tree, for trees
+// written before the index and trees restored from a snapshot or an export
+func (app *App) indexDelegations() error {
+	var keys [][]byte
+	err := iterateLeaves(app.delegationTree, func(k, _ []byte) {
+		if len(k) == 24 {
+			keys = append(keys, delegationIndexKey(k))
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	batch := db.NewBatch(app.delegationDb)
+	defer batch.Discard()
+	for _, key := range keys {
+		err = batch.Set(key, nil)
+		if err != nil {
+			return err
+		}
+	}
+	err = batch.Commit()
+	if err != nil {
+		return err
+	}
+	valLogs.dlog("Indexed delegations: ", len(keys))
+
+	wSt := app.stateDb.WriteTx()
+	defer wSt.Discard()
+	err = wSt.Set(stateDelegationIndexKey, []byte{1})
+	if err != nil {
+		return err
+	}
+	return wSt.Commit()
+}
+
+// validatorDelegations returns the keys and values of the delegations to a validator
+// with stake or rewards, together with the sum of their stakes and rewards
+func (app *App) validatorDelegations(valAddr []byte) ([][]byte, [][]byte, uint64, error) {
+	prefix := append(append([]byte{}, delegationIndexPrefix...), valAddr...)
+	var indexed [][]byte
+	err := app.delegationDb.Iterate(prefix, func(k, _ []byte) bool {
+		indexed = append(indexed, append([]byte{}, k[len(prefix):]...))
+		return true
+	})
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	var keys, values [][]byte
+	total := uint64(0)
+	for _, delegator := range indexed {
+		key := delegationKey(delegator, valAddr)
+		_, d, err := app.delegationTree.Get(key)
+		if err == arbo.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		stake, rewards := binary.BigEndian.Uint64(d[:8]), binary.BigEndian.Uint64(d[8:])
+		if stake == 0 && rewards == 0 {
+			continue
+		}
+		keys = append(keys, key)
+		values = append(values, append([]byte{}, d...))
+		//the sum of all delegated funds can not exceed the total supply
+		total += stake + rewards
+	}
+	return keys, values, total, nil
+}
+
+// setDelegation adds or updates a delegation leaf, new leaves are indexed
+// in the same write
+func (app *App) setDelegation(key, value []byte) error {
+	_, _, err := app.delegationTree.Get(key)
+	if err == nil {
+		return app.delegationTree.Update(key, value)
+	}
+
+	wDl := app.delegationDb.WriteTx()
+	defer wDl.Discard()
+	err = app.delegationTree.AddWithTx(wDl, key, value)
+	if err == nil {
+		err = wDl.Set(delegationIndexKey(key), nil)
+	}
+	if err != nil {
+		return err
+	}
+	return wDl.Commit()
+}
+
+// setValidatorPower stores the power of a validator
+func (app *App) setValidatorPower(v *Validator, power uint64) error {
+	v.Power = power
+	return app.storeValidator(v)
+}
+
+func (tx *Transaction) execDelegate(app *App) error {
+	execLogs.log("Executing delegation")
+
+	v, err := app.validatorOf(tx.target)
+	if err != nil {
+		execLogs.logError("Delegation target is not a validator: ", err)
+		return errNotValidator.wrap("%v", err)
+	}
+	if v.tombstoned() {
+		execLogs.log("Delegation target is tombstoned")
+		return errTombstoned
+	}
+
+	key := delegationKey(tx.source, v.Address)
+	delegation := make([]byte, 16)
+	_, d, err := app.delegationTree.Get(key)
+	if err == nil {
+		copy(delegation, d)
+	}
+
+	stake, ok := addAmount(binary.BigEndian.Uint64(delegation[:8]), tx.Amount)
+	if !ok {
+		execLogs.log("Delegation out of range")
+		return errBalanceRange.wrap("delegation")
+	}
+	power, ok := addAmount(v.Power, tx.Amount)
+	if ok {
+		ok, err = app.powerInRange(v, power)
+		if err != nil {
+			execLogs.logError("Failed to sum the validator powers: ", err)
+			return err
+		}
+	}
+	if !ok {
+		execLogs.log("Validator power out of range")
+		return errPowerRange
+	}
+
+	//the delegator pays amount and fee
+	if _, err := tx.execUpdate(app); err != nil {
+		return err
+	}
+
+	binary.BigEndian.PutUint64(delegation[:8], stake)
+	err = app.setDelegation(key, delegation)
+	if err != nil {
+		execLogs.logError("Failed to store delegation: ", err)
+		return err
+	}
+
+	err = app.setValidatorPower(v, power)
+	if err != nil {
+		execLogs.logError("Failed to update validator power: ", err)
+		return err
+	}
+
+	app.emitEvent(eventDelegate,
+		"account", eventAddress(tx.source),
+		"validator", eventAddress(v.Address),
+		"amount", eventAmount(tx.Amount),
+	)
+	return nil
+}
+
+func (tx *Transaction) execUndelegate(app *App) error {
+	execLogs.log("Executing release from delegation")
+
+	v, err := app.validatorOf(tx.target)
+	if err != nil {
+		execLogs.logError("Undelegation target is not a validator: ", err)
+		return errNotValidator.wrap("%v", err)
+	}
+
+	key := delegationKey(tx.source, v.Address)
+	_, d, err := app.delegationTree.Get(key)
+	if err != nil {
+		execLogs.logError("Delegation not found: ", err)
+		return errNoDelegation
+	}
+
+	//stake and accumulated rewards are released together
+	amount, ok := addAmount(binary.BigEndian.Uint64(d[:8]), binary.BigEndian.Uint64(d[8:16]))
+	if !ok || amount == 0 {
+		execLogs.log("Nothing to release")
+		return errNothingRelease
+	}
+	tx.Amount = amount
+
+	if _, err := tx.execUpdate(app); err != nil {
+		return err
+	}
+
+	err = app.delegationTree.Update(key, make([]byte, 16))
+	if err != nil {
+		execLogs.logError("Failed to clear delegation: ", err)
+		return err
+	}
+
+	err = app.queueUnbonding(tx.source, v.Address, amount)
+	if err != nil {
+		execLogs.logError("Failed to queue unbonding: ", err)
+		return err
+	}
+
+	//rounding of slashes can leave the delegations slightly above the power
+	power := v.Power
+	if power < amount {
+		power = amount
+	}
+	err = app.setValidatorPower(v, power-amount)
+	if err != nil {
+		execLogs.logError("Failed to update validator power: ", err)
+		return err
+	}
+
+	app.emitEvent(eventRelease,
+		"account", eventAddress(tx.source),
+		"validator", eventAddress(v.Address),
+		"amount", eventAmount(amount),
+	)
+	return nil
+}
+
+// distributeReward credits every delegator of a validator with a share of the
+// reward proportional to its delegation, the validator keeps the rest
+func (app *App) distributeReward(valAddr []byte, power, reward uint64) error {
+	keys, values, total, err := app.validatorDelegations(valAddr)
+	if err != nil {
+		return err
+	}
+	if total == 0 || reward == 0 {
+		return nil
+	}
+
+	//power leaks can leave the delegations above the power of the validator
+	if total > power {
+		power = total
+	}
+
+	wDl := app.delegationDb.WriteTx()
+	defer wDl.Discard()
+
+	for i, key := range keys {
+		d := values[i]
+		stake := binary.BigEndian.Uint64(d[:8]) + binary.BigEndian.Uint64(d[8:])
+		if stake == 0 {
+			continue
+		}
+		share, ok := mulDiv(reward, stake, power)
+		if !ok {
+			return errors.New("delegator reward out of range")
+		}
+		rewards, ok := addAmount(binary.BigEndian.Uint64(d[8:]), share)
+		if !ok {
+			return errors.New("delegator reward out of range")
+		}
+		binary.BigEndian.PutUint64(d[8:], rewards)
+
+		err = app.delegationTree.UpdateWithTx(wDl, key, d)
+		if err != nil {
+			return err
+		}
+	}
+
+	return wDl.Commit()
+}
+
+// slashDelegations burns a fraction of the stake and rewards of every delegation to a validator
+func (app *App) slashDelegations(valAddr []byte, fraction uint64) error {
+	keys, values, _, err := app.validatorDelegations(valAddr)
+	if err != nil {
+		return err
+	}
+
+	wDl := app.delegationDb.WriteTx()
+	defer wDl.Discard()
+
+	for i, key := range keys {
+		d := values[i]
+		for _, field := range [][]byte{d[:8], d[8:]} {
+			amount := binary.BigEndian.Uint64(field)
+			burn, _ := mulDiv(amount, fraction, slashFractionBase)
+			binary.BigEndian.PutUint64(field, amount-burn)
+		}
+
+		err = app.delegationTree.UpdateWithTx(wDl, key, d)
+		if err != nil {
+			return err
+		}
+	}
+
+	return wDl.Commit()
+}
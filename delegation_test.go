@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	abcitypes "github.com/tendermint/tendermint/abci/types"
+	tmproto "github.com/tendermint/tendermint/proto/tendermint/types"
+)
+
+// proposedBy returns a BeginBlock request of a block proposed and signed by v
+func proposedBy(app *App, v *testAccount) abcitypes.RequestBeginBlock {
+	addr := app.toAddress(v.pubKey())
+	return abcitypes.RequestBeginBlock{
+		Header: tmproto.Header{ProposerAddress: addr},
+		LastCommitInfo: abcitypes.LastCommitInfo{Votes: []abcitypes.VoteInfo{
+			{Validator: abcitypes.Validator{Address: addr}, SignedLastBlock: true},
+		}},
+	}
+}
+
+func TestValidatorDelegations(t *testing.T) {
+	accounts := newTestAccounts(t, 3)
+	app := newTestApp(t, testGenesis(t, accounts, 1000000, nil), accounts[0])
+	valAddr := app.toAddress(accounts[0].pubKey())
+
+	var txs [][]byte
+	for i, amount := range []uint16{100, 300} {
+		tx, err := accounts[i+1].signer(t, app).Delegate(accounts[0].address, amount)
+		require.Nil(t, err)
+		txs = append(txs, tx)
+	}
+	for _, res := range commitBlock(t, app, txs...) {
+		require.Equal(t, uint32(0), res.Code, res.Log)
+	}
+
+	keys, values, total, err := app.validatorDelegations(valAddr)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(keys))
+	assert.Equal(t, uint64(400), total)
+	for i, amount := range []uint64{100, 300} {
+		assert.Equal(t, delegationKey(addressKey(accounts[i+1].address), valAddr), keys[i])
+		assert.Equal(t, amount, binary.BigEndian.Uint64(values[i][:8]))
+	}
+
+	//the proposer shares its reward with the delegators
+	deliverBlock(app, proposedBy(app, accounts[0]))
+	app.Commit()
+	_, values, _, err = app.validatorDelegations(valAddr)
+	require.Nil(t, err)
+	assert.Less(t, uint64(0), binary.BigEndian.Uint64(values[0][8:]))
+	assert.InDelta(t, 3*binary.BigEndian.Uint64(values[0][8:]), binary.BigEndian.Uint64(values[1][8:]), 3)
+
+	//undelegated entries are left out
+	tx, err := accounts[1].signer(t, app).Undelegate(accounts[0].address)
+	require.Nil(t, err)
+	require.Equal(t, uint32(0), commitBlock(t, app, tx)[0].Code)
+	keys, _, _, err = app.validatorDelegations(valAddr)
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{delegationKey(addressKey(accounts[2].address), valAddr)}, keys)
+}
+
+func TestIndexDelegations(t *testing.T) {
+	accounts := newTestAccounts(t, 2)
+	app := newTestApp(t, testGenesis(t, accounts, 1000000, nil), accounts[0])
+	valAddr := app.toAddress(accounts[0].pubKey())
+
+	tx, err := accounts[1].signer(t, app).Delegate(accounts[0].address, 100)
+	require.Nil(t, err)
+	require.Equal(t, uint32(0), commitBlock(t, app, tx)[0].Code)
+
+	//trees written before the index are indexed on start
+	wDl := app.delegationDb.WriteTx()
+	require.Nil(t, wDl.Delete(delegationIndexKey(delegationKey(addressKey(accounts[1].address), valAddr))))
+	require.Nil(t, wDl.Commit())
+	wSt := app.stateDb.WriteTx()
+	require.Nil(t, wSt.Delete(stateDelegationIndexKey))
+	require.Nil(t, wSt.Commit())
+
+	app = reopenTestApp(t, app)
+	_, _, total, err := app.validatorDelegations(valAddr)
+	require.Nil(t, err)
+	assert.Equal(t, uint64(100), total)
+}
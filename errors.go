@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// txCodespace is returned with every non zero result code of CheckTx and DeliverTx
+const txCodespace = "kvstore"
+
+// TxError is the reason a transaction was rejected, codes are stable and
+// listed under RESULT CODES in the README
+type TxError struct {
+	Code uint32
+	Desc string
+
+	//details of a single failure, empty on the registered errors
+	detail string
+}
+
+var txErrors = make(map[uint32]*TxError)
+
+// registerTxError adds an error to the registry, codes can not be reused
+func registerTxError(code uint32, desc string) *TxError {
+	if code == 0 {
+		panic("tx error code 0 is reserved for success")
+	}
+	if e, ok := txErrors[code]; ok {
+		panic(fmt.Sprintf("tx error code %d already registered: %s", code, e.Desc))
+	}
+	e := &TxError{Code: code, Desc: desc}
+	txErrors[code] = e
+	return e
+}
+
+// format and signature errors, the codes are those returned before the registry
+var (
+	errTxTooBig       = registerTxError(1, "tx too big")
+	errTxTooSmall     = registerTxError(2, "tx too small")
+	errLegacyFormat   = registerTxError(3, "tx format no longer accepted")
+	errTxExpired      = registerTxError(4, "tx expired")
+	errUnknownSource  = registerTxError(17, "source account not found")
+	errUnknownTarget  = registerTxError(18, "target account not found")
+	errInsufficient   = registerTxError(23, "insufficient funds for amount and fee")
+	errFeeOverflow    = registerTxError(24, "fee out of range")
+	errTxInCache      = registerTxError(33, "tx already in cache")
+	errBadSignature   = registerTxError(39, "invalid signature")
+	errUnknownTxType  = registerTxError(44, "unknown tx type")
+	errBadBls         = registerTxError(89, "invalid bls signature")
+	errBatchExpired   = registerTxError(90, "batch state height passed")
+	errBatchEntry     = registerTxError(91, "batch participant not found")
+	errBalanceRange   = registerTxError(100, "balance out of range")
+	errNotValidator   = registerTxError(101, "not a validator")
+	errTombstoned     = registerTxError(102, "validator is tombstoned")
+	errPowerRange     = registerTxError(103, "validator power out of range")
+	errNothingRelease = registerTxError(104, "nothing to release")
+	errNoDelegation   = registerTxError(105, "delegation not found")
+	errNotJailed      = registerTxError(106, "validator is not jailed")
+	errStillJailed    = registerTxError(107, "validator is still jailed")
+	errInternal       = registerTxError(255, "internal error")
+)
+
+func (e *TxError) Error() string {
+	if e.detail == "" {
+		return e.Desc
+	}
+	return e.Desc + ": " + e.detail
+}
+
+// Is matches errors with the same code, whatever their details
+func (e *TxError) Is(target error) bool {
+	t, ok := target.(*TxError)
+	return ok && t.Code == e.Code
+}
+
+// wrap returns the error with the details of a failure
+func (e *TxError) wrap(format string, args ...interface{}) *TxError {
+	return &TxError{Code: e.Code, Desc: e.Desc, detail: fmt.Sprintf(format, args...)}
+}
+
+// txResult converts an error to the code, log and codespace of an ABCI
+// response, errors outside the registry are internal errors
+func txResult(err error) (code uint32, log string, codespace string) {
+	if err == nil {
+		return 0, "", ""
+	}
+	var txErr *TxError
+	if !errors.As(err, &txErr) {
+		txErr = errInternal.wrap("%v", err)
+	}
+	return txErr.Code, txErr.Error(), txCodespace
+}
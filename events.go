@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"strconv"
+
+	abcitypes "github.com/tendermint/tendermint/abci/types"
+)
+
+// event types emitted by DeliverTx, all attributes are indexed so that
+// tx_search can filter on them, e.g. "transfer.from='5'"
+const (
+	eventTx              = "tx"
+	eventTransfer        = "transfer"
+	eventStake           = "stake"
+	eventRelease         = "release"
+	eventDelegate        = "delegate"
+	eventUnjail          = "unjail"
+	eventAccountCreated  = "account_created"
+	eventKeyChanged      = "key_changed"
+	eventContractWritten = "contract_written"
+	eventBatch           = "batch"
+)
+
+// emitEvent adds an event to the response of the tx being delivered,
+// attributes are given as key, value pairs
+func (app *App) emitEvent(eventType string, attrs ...string) {
+	event := abcitypes.Event{Type: eventType}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		event.Attributes = append(event.Attributes, abcitypes.EventAttribute{
+			Key:   []byte(attrs[i]),
+			Value: []byte(attrs[i+1]),
+			Index: true,
+		})
+	}
+	app.txEvents = append(app.txEvents, event)
+}
+
+// eventAddress formats a 4 byte account or contract address as the decimal
+// number used by the wallet
+func eventAddress(address []byte) string {
+	if len(address) != 4 {
+		return hex.EncodeToString(address)
+	}
+	return strconv.FormatUint(uint64(binary.BigEndian.Uint32(address)), 10)
+}
+
+func eventAmount(amount uint64) string {
+	return strconv.FormatUint(amount, 10)
+}
@@ -2,142 +2,213 @@ package main
 
 import (
 	"encoding/binary"
-
-	abcitypes "github.com/tendermint/tendermint/abci/types"
+	"encoding/hex"
 )
 
-func (tx *Transaction) execBatch(app *App) {
-	logs.log("Executing Batch")
+func (tx *Transaction) execBatch(app *App) error {
+	execLogs.log("Executing Batch")
 
 	//truncate maxheight from state
 	tx.state = tx.state[:32]
 	tx.target = tx.source
 
+	//fees are paid from the batcher, not from the participants
+	fee := tx.Fee
+	tx.Fee = 0
+
+	paid := uint64(0)
+	participants := []string{}
 	length := len(tx.addresses)
 	for i := 0; i+4 < length; i += 4 {
 		tx.source = tx.addresses[i : i+4]
-		tx.length = 0      //this leads to zero fees fees are paid from the batcer
-		tx.execUpdate(app) //the amount will be subtracted from every participant
+		tx.length = 0 //this leads to zero fees fees are paid from the batcer
+		//the amount will be subtracted from every participant
+		if _, err := tx.execUpdate(app); err == nil {
+			paid++
+			participants = append(participants, "participant", eventAddress(tx.source))
+		}
 	}
+	tx.Fee = fee
 
 	account, err := app.fetchAccount(tx.target)
 	if err != nil {
-		logs.logError("Failed to fetch account: ", err)
-		panic(err)
+		execLogs.logError("Failed to fetch account: ", err)
+		return errUnknownSource.wrap("batcher: %v", err)
+	}
+
+	//only participants that could pay are credited to the batcher
+	credit, ok := mulAmount(tx.Amount, paid)
+	if ok {
+		credit, ok = addAmount(account.Amount, credit)
 	}
-	account.Amount += tx.Amount*uint32(length/4) - tx.Fee
-	app.totalFees += tx.Fee
+	if ok {
+		credit, ok = subAmount(credit, tx.Fee)
+	}
+	if !ok {
+		execLogs.log("Batcher balance out of range")
+		return errBalanceRange.wrap("batcher")
+	}
+	account.Amount = credit
+	app.collectFee(tx)
 
 	account.writeAccount(app)
+
+	app.emitEvent(eventBatch, append([]string{
+		"batcher", eventAddress(tx.target),
+		"amount", eventAmount(tx.Amount),
+	}, participants...)...)
+	return nil
 }
 
-func (tx *Transaction) execRelease(app *App) {
-	logs.log("Executing release from staking")
+func (tx *Transaction) execRelease(app *App) error {
+	//a release with a target account undelegates from its validator
+	if tx.target != nil {
+		return tx.execUndelegate(app)
+	}
 
-	var val abcitypes.ValidatorUpdate
-	val.Power = 0
-	var err error
+	execLogs.log("Executing release from staking")
 
 	account, err := app.fetchAccount(tx.source)
 	if err != nil {
 		//this should not happen
-		logs.logError("source account not found: ", err)
-		return
+		execLogs.logError("source account not found: ", err)
+		return errUnknownSource.wrap("%v", err)
 	}
 
-	val.PubKey, err = app.toPk(account.schnorrPubKey)
+	v, err := app.fetchValidator(app.toAddress(account.schnorrPubKey))
 	if err != nil {
-		logs.logError("Failed to convert public key: ", err)
-		panic(err)
+		execLogs.logError("Failed to get element from validator tree: ", err)
+		return errNotValidator.wrap("%v", err)
 	}
 
-	addr := app.toAddress(account.schnorrPubKey)
-
-	_, valAccount, err := app.validatorTree.Get(addr)
+	//delegated funds stay bonded until their delegators release them
+	_, _, delegated, err := app.validatorDelegations(v.Address)
 	if err != nil {
-		logs.logError("Failed to get element from validator tree: ", err)
-		return
+		execLogs.logError("Failed to iterate delegations: ", err)
+		return err
 	}
 
-	app.valUpdates = append(app.valUpdates, val)
-	Amount := binary.BigEndian.Uint64(valAccount[:8])
-	tx.Amount = uint32(Amount)
+	if v.Power <= delegated {
+		execLogs.log("No own stake to release")
+		return errNothingRelease
+	}
+	tx.Amount = v.Power - delegated
 
-	tx.execUpdate(app)
+	if _, err := tx.execUpdate(app); err != nil {
+		return err
+	}
 
-	binary.BigEndian.PutUint64(valAccount[:8], uint64(0))
+	err = app.queueUnbonding(tx.source, v.Address, tx.Amount)
+	if err != nil {
+		execLogs.logError("Failed to queue unbonding: ", err)
+		return err
+	}
 
-	logs.log("Updated validator amount (binary) and valpower: ")
-	logs.log(valAccount[:8])
-	logs.log(val.Power)
+	execLogs.debug("Updated validator power", "power", delegated)
 
-	app.validatorTree.Update(addr, valAccount)
-}
+	err = app.setValidatorPower(v, delegated)
+	if err != nil {
+		execLogs.logError("Failed to update validator power: ", err)
+		return err
+	}
 
-func (tx *Transaction) execStake(app *App) {
-	logs.log("Executing stake")
+	app.emitEvent(eventRelease,
+		"account", eventAddress(tx.source),
+		"validator", eventAddress(v.Address),
+		"amount", eventAmount(tx.Amount),
+	)
+	return nil
+}
 
-	account := tx.execUpdate(app)
-	var err error
+func (tx *Transaction) execStake(app *App) error {
+	execLogs.log("Executing stake")
 
-	var val abcitypes.ValidatorUpdate
-	val.Power = int64(tx.Amount)
+	account, err := app.fetchAccount(tx.source)
+	if err != nil {
+		//this should not happen
+		execLogs.logError("source account not found: ", err)
+		return errUnknownSource.wrap("%v", err)
+	}
 
-	val.PubKey, err = app.toPk(account.schnorrPubKey)
+	v, err := app.fetchValidator(app.toAddress(account.schnorrPubKey))
 	if err != nil {
-		logs.logError("Failed to convert public key: ", err)
-		panic(err)
+		execLogs.log("Validator not found, creating new...")
+		v = &Validator{
+			Address: app.toAddress(account.schnorrPubKey),
+			PubKey:  account.schnorrPubKey,
+		}
+	}
+	if v.tombstoned() {
+		execLogs.log("Validator is tombstoned")
+		return errTombstoned
 	}
 
-	addr := app.toAddress(account.schnorrPubKey)
+	power, ok := addAmount(v.Power, tx.Amount)
+	if ok {
+		ok, err = app.powerInRange(v, power)
+		if err != nil {
+			execLogs.logError("Failed to sum the validator powers: ", err)
+			return err
+		}
+	}
+	if !ok {
+		execLogs.log("Validator power out of range")
+		return errPowerRange
+	}
 
-	_, valAccount, err := app.validatorTree.Get(addr)
-	if err == nil {
-		val.Power += int64(binary.BigEndian.Uint64(valAccount[:8]))
-	} else {
-		logs.log("Validator not found, creating new...")
-		valAccount = make([]byte, 40)
+	if _, err := tx.execUpdate(app); err != nil {
+		return err
 	}
 
-	binary.BigEndian.PutUint64(valAccount[:8], uint64(val.Power))
-	logs.log("Updated validator amount (binary) and power: ")
-	logs.log(valAccount[:8])
-	logs.log(val.Power)
+	execLogs.debug("Updated validator power", "power", power)
 
-	if err == nil {
-		app.validatorTree.Update(addr, valAccount)
-	} else {
-		logs.log("Validator not found, adding new...")
-		copy(valAccount[8:], account.schnorrPubKey)
-		app.validatorTree.Add(addr, valAccount)
+	err = app.setValidatorPower(v, power)
+	if err != nil {
+		execLogs.logError("Failed to update validator power: ", err)
+		return err
 	}
 
-	app.valUpdates = append(app.valUpdates, val)
+	app.emitEvent(eventStake,
+		"account", eventAddress(tx.source),
+		"validator", eventAddress(v.Address),
+		"amount", eventAmount(tx.Amount),
+	)
+	return nil
 }
 
-func (tx *Transaction) execUpdate(app *App) *Account {
-	logs.log("Executing state update")
+func (tx *Transaction) execUpdate(app *App) (*Account, error) {
+	execLogs.log("Executing state update")
 
 	/// update source account
 	// Fetch account
 	account, err := app.fetchAccount(tx.source)
 	if err != nil {
 		//this should not happen
-		logs.logError("source account not found: ", err)
-		return nil
+		execLogs.logError("source account not found: ", err)
+		return nil, errUnknownSource.wrap("%v", err)
 	}
 
-	logs.log("Update source account: ")
-	logs.logAccount(account)
+	execLogs.log("Update source account: ")
+	execLogs.logAccount(account)
 
+	var amount uint64
+	var ok bool
 	if tx.isRelease {
-		// Add amount and subtract Fee from account
-		account.Amount += (tx.Amount - tx.Fee)
+		// Released funds go through the unbonding queue, only the fee is paid here
+		amount, ok = subAmount(account.Amount, tx.Fee)
 	} else {
 		// Subtract amount and Fee from account
-		account.Amount -= (tx.Amount + tx.Fee)
+		amount, ok = addAmount(tx.Amount, tx.Fee)
+		if ok {
+			amount, ok = subAmount(account.Amount, amount)
+		}
+	}
+	if !ok {
+		execLogs.log("Source balance out of range")
+		return nil, errInsufficient.wrap("balance %d, amount %d, fee %d", account.Amount, tx.Amount, tx.Fee)
 	}
-	app.totalFees += tx.Fee
+	account.Amount = amount
+	app.collectFee(tx)
 
 	//Update counter on every tx
 	account.Counter++
@@ -146,66 +217,136 @@ func (tx *Transaction) execUpdate(app *App) *Account {
 	account.State = tx.state
 
 	// Write updated account to database
-	logs.log("Updated source account: ")
+	execLogs.log("Updated source account: ")
 	account.writeAccount(app)
 
-	return account
+	return account, nil
+}
+
+// chargeFailed makes a signed tx that failed pay its fee, or what is left of
+// the balance, and consume its counter so that it cannot be replayed. A tx
+// whose execution already moved the counter has paid in execUpdate.
+func (tx *Transaction) chargeFailed(app *App, source []byte) {
+	account, err := app.fetchAccount(source)
+	if err != nil {
+		execLogs.logError("source account not found: ", err)
+		return
+	}
+	if account.Counter != binary.BigEndian.Uint32(tx.counter) {
+		return
+	}
+
+	//the tx may have failed before verifyFee priced it
+	if tx.Fee == 0 {
+		fee, ok := mulAmount(app.baseFee, uint64(tx.length))
+		if ok {
+			fee, ok = addAmount(fee, tx.Tip)
+		}
+		if !ok {
+			fee = account.Amount
+		}
+		tx.Fee = fee
+	}
+	if tx.Fee > account.Amount {
+		tx.Fee = account.Amount
+	}
+	account.Amount -= tx.Fee
+	app.collectFee(tx)
+
+	account.Counter++
+	account.writeAccount(app)
 }
 
-func (tx *Transaction) execTransfer(app *App) {
-	logs.log("Executing transfer")
+func (tx *Transaction) execTransfer(app *App) error {
+	execLogs.log("Executing transfer")
 
 	// update target account
 	// Fetch account
-	tx.execUpdate(app)
-
 	account, err := app.fetchAccount(tx.target)
 	if err != nil {
-		logs.logError("Target account not found!", err)
-		return
+		execLogs.logError("Target account not found!", err)
+		return errUnknownTarget.wrap("%v", err)
+	}
+
+	// the target must be able to receive before the source pays
+	amount, ok := addAmount(account.Amount, tx.Amount)
+	if !ok {
+		execLogs.log("Target balance out of range")
+		return errBalanceRange.wrap("target")
 	}
 
-	logs.log("Update target account: ")
-	logs.logAccount(account)
+	if _, err := tx.execUpdate(app); err != nil {
+		return err
+	}
+
+	execLogs.log("Update target account: ")
+	execLogs.logAccount(account)
 
-	// Subtract amount from account
-	account.Amount += tx.Amount
+	// Add amount to account
+	account.Amount = amount
 
 	// Write updated account to database
-	logs.log("Updated target account: ")
+	execLogs.log("Updated target account: ")
 	account.writeAccount(app)
+
+	app.emitEvent(eventTransfer,
+		"from", eventAddress(tx.source),
+		"to", eventAddress(tx.target),
+		"amount", eventAmount(tx.Amount),
+	)
+	return nil
 }
 
-func (tx *Transaction) execAccountKeyChanger(app *App) {
-	logs.log("Executing changing keys...")
+func (tx *Transaction) execAccountKeyChanger(app *App) error {
+	execLogs.log("Executing changing keys...")
 
 	account, err := app.fetchAccount(tx.source)
 	if err != nil {
-		logs.logError("ExecKeyChanger failed because account not found: ", err)
+		execLogs.logError("ExecKeyChanger failed because account not found: ", err)
+		return errUnknownSource.wrap("%v", err)
 	}
-	//source and public key !!!attention
-	account.Data = tx.data
-
-	account.Address = tx.source
 
 	//fees
-	account.Amount -= tx.Fee
-	app.totalFees += tx.Fee
+	amount, ok := subAmount(account.Amount, tx.Fee)
+	if !ok {
+		execLogs.log("Source balance out of range")
+		return errInsufficient.wrap("balance %d, fee %d", account.Amount, tx.Fee)
+	}
+	account.Amount = amount
+	app.collectFee(tx)
+
+	//new ed25519 and bls public keys
+	data := make([]byte, accBlsKeyEnd)
+	copy(data[accAmountEnd:accBlsKeyEnd], tx.data[4:84])
+	account.Data = data
+	account.schnorrPubKey = data[accAmountEnd:accPubKeyEnd]
+
+	account.Address = tx.source
 
 	//Update counter on every tx
 	account.Counter++
 
 	account.writeAccount(app)
+
+	app.emitEvent(eventKeyChanged, "address", eventAddress(tx.source))
+	return nil
 }
 
-func (tx *Transaction) execCreateAccount(app *App) []byte {
-	logs.log("Executing creating new account...")
+func (tx *Transaction) execCreateAccount(app *App) ([]byte, error) {
+	execLogs.log("Executing creating new account...")
+
+	//the creator funds the new account
+	if _, err := tx.execUpdate(app); err != nil {
+		return nil, err
+	}
+
 	account := new(Account)
 	account.isNew = true
 
-	//amount and public key
-	account.Data = tx.data[4:88]
-	account.schnorrPubKey = account.Data[4:36]
+	//amount and public keys
+	account.Data = make([]byte, accBlsKeyEnd)
+	copy(account.Data[accAmountEnd:accBlsKeyEnd], tx.data[8:88])
+	account.schnorrPubKey = account.Data[accAmountEnd:accPubKeyEnd]
 	account.Amount = tx.Amount
 
 	//find next account address
@@ -214,21 +355,26 @@ func (tx *Transaction) execCreateAccount(app *App) []byte {
 	//create new account entry
 	account.writeAccount(app)
 
-	//tx.target = account.Address
-	tx.execUpdate(app)
+	app.emitEvent(eventAccountCreated,
+		"address", eventAddress(account.Address),
+		"creator", eventAddress(tx.source),
+		"amount", eventAmount(tx.Amount),
+	)
 
-	return account.Address
+	return account.Address, nil
 }
 
-func (tx *Transaction) execContract(app *App) []byte {
-	logs.log("Executing contract")
+func (tx *Transaction) execContract(app *App) ([]byte, error) {
+	execLogs.log("Executing contract")
 
 	var key [4]byte
 	copy(key[:], tx.target)
 
 	Target := binary.BigEndian.Uint32(tx.target)
 
-	tx.execUpdate(app)
+	if _, err := tx.execUpdate(app); err != nil {
+		return nil, err
+	}
 
 	contract := app.fetchContract(key)
 
@@ -245,5 +391,12 @@ func (tx *Transaction) execContract(app *App) []byte {
 	hash := app.sha2(data)
 	copy(tx.hash[:], hash)
 
-	return contract.Address
+	app.emitEvent(eventContractWritten,
+		"address", eventAddress(contract.Address),
+		"writer", eventAddress(tx.source),
+		"counter", eventAmount(contract.Counter),
+		"payload_hash", hex.EncodeToString(app.sha2(tx.payload)),
+	)
+
+	return contract.Address, nil
 }
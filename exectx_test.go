@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChargeFailed(t *testing.T) {
+	tests := []struct {
+		name    string
+		balance uint64
+		tx      func(s *testAccount, app *App) ([]byte, error)
+		code    uint32
+		//the balance covers the fee
+		covered bool
+	}{
+		{
+			name:    "unknown target",
+			balance: 1000000,
+			tx:      func(s *testAccount, app *App) ([]byte, error) { return s.signer(t, app).Transfer(7, 100) },
+			code:    errUnknownTarget.Code,
+			covered: true,
+		},
+		{
+			name:    "insufficient funds",
+			balance: 1000000,
+			tx:      func(s *testAccount, app *App) ([]byte, error) { return s.signer(t, app).Transfer(0, 2000000) },
+			code:    errInsufficient.Code,
+			covered: true,
+		},
+		{
+			name:    "unjail of a non validator",
+			balance: 1000000,
+			tx:      func(s *testAccount, app *App) ([]byte, error) { return s.signer(t, app).Unjail() },
+			code:    errNotValidator.Code,
+			covered: true,
+		},
+		{
+			name:    "balance below the fee",
+			balance: 1,
+			tx:      func(s *testAccount, app *App) ([]byte, error) { return s.signer(t, app).Unjail() },
+			code:    errInsufficient.Code,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			accounts := newTestAccounts(t, 2)
+			app := newTestApp(t, testGenesis(t, accounts, tt.balance, nil), accounts[0])
+			s := accounts[1]
+
+			tx, err := tt.tx(s, app)
+			require.Nil(t, err)
+			fee := app.baseFee * uint64(len(tx))
+			if !tt.covered {
+				fee = tt.balance
+			}
+
+			res := commitBlock(t, app, tx)
+			require.Equal(t, tt.code, res[0].Code, res[0].Log)
+			assert.Equal(t, tt.balance-fee, testBalance(t, app, s.address))
+			assert.Equal(t, fee, app.burned)
+
+			//the counter moved, the same tx cannot be replayed
+			res = commitBlock(t, app, tx)
+			assert.Equal(t, errBadSignature.Code, res[0].Code)
+			assert.Equal(t, tt.balance-fee, testBalance(t, app, s.address))
+		})
+	}
+}
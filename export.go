@@ -0,0 +1,475 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/tendermint/tendermint/crypto/ed25519"
+	tmtypes "github.com/tendermint/tendermint/types"
+	tmtime "github.com/tendermint/tendermint/types/time"
+	"github.com/vocdoni/arbo"
+	"go.vocdoni.io/dvote/db"
+)
+
+// exportGenesis builds a genesis file starting the chain again from the last
+// committed height, with the consensus parameters of the current genesis.
+// Validators keep their voting power. Contract payloads no longer stored fail
+// the export unless allowPruned leaves them empty
+func (app *App) exportGenesis(current *tmtypes.GenesisDoc, height int64, allowPruned bool) (*tmtypes.GenesisDoc, error) {
+	if height != 0 && height != app.blockHeight {
+		return nil, fmt.Errorf("only the last committed height %d can be exported", app.blockHeight)
+	}
+	if app.blockHeight == 0 {
+		return nil, errors.New("nothing committed yet")
+	}
+
+	state, err := app.exportState(allowPruned)
+	if err != nil {
+		return nil, err
+	}
+	appState, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	validators, err := app.exportValidators()
+	if err != nil {
+		return nil, err
+	}
+
+	return &tmtypes.GenesisDoc{
+		GenesisTime:     tmtime.Now(),
+		ChainID:         string(app.chainID),
+		InitialHeight:   app.blockHeight + 1,
+		ConsensusParams: current.ConsensusParams,
+		Validators:      validators,
+		AppHash:         app.appHash,
+		AppState:        appState,
+	}, nil
+}
+
+// exportState reads the committed trees, the contract payloads and the
+// ledgers into an app_state that InitChain turns back into the same roots
+func (app *App) exportState(allowPruned bool) (*genesisState, error) {
+	state := &genesisState{
+		Params: app.genesisParams(),
+		Export: &genesisExport{
+			Height:  app.blockHeight,
+			AppHash: hex.EncodeToString(app.appHash),
+			BaseFee: app.baseFee,
+			Burned:  app.burned,
+			Tips:    app.totalFees,
+
+			Validators:  []genesisValidator{},
+			Delegations: []genesisDelegation{},
+			Unbondings:  []genesisUnbonding{},
+		},
+	}
+	exp := state.Export
+
+	//leaves of an unexpected size can not be listed and would change the root
+	var invalid error
+	var leaves int
+
+	accounts := make([]genesisAccount, app.accountNumOnDb)
+	err := iterateLeaves(app.accountTree, func(k, data []byte) {
+		if len(k) != 4 || int(binary.BigEndian.Uint32(k)) >= len(accounts) ||
+			(len(data) != accCounterEnd && len(data) != accStateEnd) {
+			invalid = fmt.Errorf("account leaf %x", k)
+			return
+		}
+		leaves++
+		accounts[binary.BigEndian.Uint32(k)] = genesisAccount{
+			PubKey:    hex.EncodeToString(data[accAmountEnd:accPubKeyEnd]),
+			BlsPubKey: hex.EncodeToString(data[accPubKeyEnd:accBlsKeyEnd]),
+			Balance:   binary.BigEndian.Uint64(data[:accAmountEnd]),
+			Counter:   binary.BigEndian.Uint32(data[accBlsKeyEnd:accCounterEnd]),
+			State:     hex.EncodeToString(data[accCounterEnd:]),
+		}
+	})
+	if err != nil {
+		logs.logError("Failed to iterate the Account Tree: ", err)
+		return nil, err
+	}
+	if leaves != len(accounts) {
+		invalid = fmt.Errorf("%d account leaves for %d accounts", leaves, len(accounts))
+	}
+	state.Accounts = accounts
+
+	leaves = 0
+	contracts := make([]genesisContract, app.contractNumOnDb)
+	err = iterateLeaves(app.contractTree, func(k, counter []byte) {
+		if len(k) != 4 || int(binary.BigEndian.Uint32(k)) >= len(contracts) || len(counter) != 8 {
+			invalid = fmt.Errorf("contract leaf %x", k)
+			return
+		}
+		leaves++
+		payload := app.storedPayload(k, counter)
+		if payload == nil && !allowPruned {
+			invalid = fmt.Errorf("payload %d of contract %x, no longer stored", binary.BigEndian.Uint64(counter), k)
+			return
+		}
+		contracts[binary.BigEndian.Uint32(k)] = genesisContract{
+			Payload: hex.EncodeToString(payload),
+			Counter: binary.BigEndian.Uint64(counter),
+		}
+	})
+	if err != nil {
+		logs.logError("Failed to iterate the Contract Tree: ", err)
+		return nil, err
+	}
+	if leaves != len(contracts) {
+		invalid = fmt.Errorf("%d contract leaves for %d contracts", leaves, len(contracts))
+	}
+	state.Contracts = contracts
+
+	err = iterateLeaves(app.validatorTree, func(k, d []byte) {
+		v, err := decodeValidator(k, d)
+		if err != nil || len(d) != valMissedEnd {
+			invalid = fmt.Errorf("validator leaf %x", k)
+			return
+		}
+		exp.Validators = append(exp.Validators, genesisValidator{
+			PubKey:      hex.EncodeToString(v.PubKey),
+			Power:       v.Power,
+			Status:      v.Status,
+			JailedUntil: v.JailedUntil,
+			Missed:      v.Missed,
+		})
+	})
+	if err != nil {
+		valLogs.logError("Failed to iterate the Validator Tree: ", err)
+		return nil, err
+	}
+
+	err = iterateLeaves(app.delegationTree, func(k, d []byte) {
+		if len(k) != 24 || len(d) != 16 {
+			invalid = fmt.Errorf("delegation leaf %x", k)
+			return
+		}
+		exp.Delegations = append(exp.Delegations, genesisDelegation{
+			Account:   binary.BigEndian.Uint32(k[:4]),
+			Validator: hex.EncodeToString(k[4:]),
+			Stake:     binary.BigEndian.Uint64(d[:8]),
+			Rewards:   binary.BigEndian.Uint64(d[8:]),
+		})
+	})
+	if err != nil {
+		logs.logError("Failed to iterate the Delegation Tree: ", err)
+		return nil, err
+	}
+
+	err = iterateLeaves(app.unbondingTree, func(k, amount []byte) {
+		if len(k) != 32 || len(amount) != 8 {
+			invalid = fmt.Errorf("unbonding leaf %x", k)
+			return
+		}
+		exp.Unbondings = append(exp.Unbondings, genesisUnbonding{
+			Height:    binary.BigEndian.Uint64(k[:8]),
+			Account:   binary.BigEndian.Uint32(k[8:12]),
+			Validator: hex.EncodeToString(k[12:]),
+			Amount:    binary.BigEndian.Uint64(amount),
+		})
+	})
+	if err != nil {
+		logs.logError("Failed to iterate the Unbonding Tree: ", err)
+		return nil, err
+	}
+
+	err = iterateLeaves(app.blockHashTree, func(k, root []byte) {
+		exp.BlockHashes = append(exp.BlockHashes, genesisEntry{hex.EncodeToString(k), hex.EncodeToString(root)})
+	})
+	if err != nil {
+		logs.logError("Failed to iterate the BlockHash Tree: ", err)
+		return nil, err
+	}
+	if invalid != nil {
+		return nil, fmt.Errorf("can not export %v", invalid)
+	}
+
+	//payloads of both contract storage databases, older ones are gone
+	for _, storage := range []db.Database{app.contractStorageDb, app.contractStorageDb2} {
+		exp.Payloads, err = appendEntries(exp.Payloads, storage)
+		if err != nil {
+			logs.logError("Failed to read the contract payloads: ", err)
+			return nil, err
+		}
+	}
+	exp.AccountLedger, err = appendEntries(nil, app.accountLedgerDb)
+	if err != nil {
+		logs.logError("Failed to read the account ledger: ", err)
+		return nil, err
+	}
+	exp.ContractLedger, err = appendEntries(nil, app.contractLedgerDb)
+	if err != nil {
+		logs.logError("Failed to read the contract ledger: ", err)
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// iterateLeaves calls f with the key and value of every leaf of a tree
+func iterateLeaves(tree *arbo.Tree, f func(k, v []byte)) error {
+	return tree.Iterate(nil, func(_, v []byte) {
+		if v[0] != arbo.PrefixValueLeaf {
+			return
+		}
+		f(arbo.ReadLeafValue(v))
+	})
+}
+
+// appendEntries appends every key and value of a database to entries
+func appendEntries(entries []genesisEntry, database db.Database) ([]genesisEntry, error) {
+	err := database.Iterate(nil, func(k, v []byte) bool {
+		entries = append(entries, genesisEntry{hex.EncodeToString(k), hex.EncodeToString(v)})
+		return true
+	})
+	return entries, err
+}
+
+// storedPayload looks up the payload written to a contract at a counter in
+// both contract storage databases, payloads older than two swaps are gone
+func (app *App) storedPayload(address, counter []byte) []byte {
+	key := append(append([]byte{}, address...), counter...)
+	for _, storage := range []db.Database{app.contractStorageDb, app.contractStorageDb2} {
+		rTx := storage.ReadTx()
+		payload, err := rTx.Get(key)
+		rTx.Discard()
+		if err == nil {
+			return payload
+		}
+	}
+	logs.info("Contract payload no longer stored", "address", address, "counter", counter)
+	return nil
+}
+
+// exportValidators lists the validators with voting power for the genesis file
+func (app *App) exportValidators() ([]tmtypes.GenesisValidator, error) {
+	var validators []tmtypes.GenesisValidator
+	err := iterateLeaves(app.validatorTree, func(k, d []byte) {
+		val, err := decodeValidator(k, d)
+		if err != nil || val.votingPower() == 0 {
+			return
+		}
+		pk := ed25519.PubKey(val.PubKey)
+		validators = append(validators, tmtypes.GenesisValidator{
+			Address: pk.Address(),
+			PubKey:  pk,
+			Power:   val.votingPower(),
+		})
+	})
+	if err != nil {
+		valLogs.logError("Failed to iterate the Validator Tree: ", err)
+		return nil, err
+	}
+	return validators, nil
+}
+
+// genesisParams returns the economic parameters in force
+func (app *App) genesisParams() *genesisParams {
+	return &genesisParams{
+		Gas:                     app.gas,
+		BlockReward:             app.blockReward,
+		EmptyVoteLeak:           app.emptyVoteLeak,
+		LegacyTxCutoff:          app.legacyTxCutoff,
+		UnbondingBlocks:         app.unbondingBlocks,
+		SlashFractionDoubleSign: app.slashFractionDoubleSign,
+		SlashFractionDowntime:   app.slashFractionDowntime,
+		DowntimeWindow:          app.downtimeWindow,
+		JailBlocks:              app.jailBlocks,
+		TargetBlockBytes:        app.targetBlockBytes,
+	}
+}
+
+// importGenesisState writes the leaves of an exported app_state to the
+// empty trees and restores the payloads, ledgers and fee market. InitChain
+// checks the resulting app hash against the exported one
+func (app *App) importGenesisState(genesis *genesisState) error {
+	exp := genesis.Export
+	appHash, err := hex.DecodeString(exp.AppHash)
+	if err != nil || len(appHash) == 0 {
+		return errors.New("invalid exported app hash")
+	}
+
+	//the chain goes on from the exported height, with its storage databases
+	//in place for it
+	app.blockHeight = exp.Height
+	binary.BigEndian.PutUint64(app.blockheight[:], uint64(exp.Height))
+	app.orderStorageDbs()
+
+	var keys, values [][]byte
+	for i, a := range genesis.Accounts {
+		data, err := a.accountData()
+		if err != nil {
+			return fmt.Errorf("account %d: %w", i, err)
+		}
+		keys = append(keys, addressKey(uint32(i)))
+		values = append(values, data)
+	}
+	err = addLeaves(app.accountTree, "account", keys, values)
+	if err != nil {
+		return err
+	}
+
+	keys, values = nil, nil
+	for i, c := range genesis.Contracts {
+		counter := make([]byte, 8)
+		binary.BigEndian.PutUint64(counter, c.Counter)
+		keys = append(keys, addressKey(uint32(i)))
+		values = append(values, counter)
+	}
+	err = addLeaves(app.contractTree, "contract", keys, values)
+	if err != nil {
+		return err
+	}
+
+	keys, values = nil, nil
+	for _, gv := range exp.Validators {
+		pk, err := hex.DecodeString(gv.PubKey)
+		if err != nil || len(pk) != 32 {
+			return errors.New("invalid exported validator key")
+		}
+		v := &Validator{PubKey: pk, Power: gv.Power, Status: gv.Status, JailedUntil: gv.JailedUntil, Missed: gv.Missed}
+		keys = append(keys, app.toAddress(pk))
+		values = append(values, v.encode())
+	}
+	err = addLeaves(app.validatorTree, "validator", keys, values)
+	if err != nil {
+		return err
+	}
+
+	keys, values = nil, nil
+	for _, d := range exp.Delegations {
+		valAddr, err := hex.DecodeString(d.Validator)
+		if err != nil || len(valAddr) != 20 {
+			return errors.New("invalid exported delegation validator")
+		}
+		value := make([]byte, 16)
+		binary.BigEndian.PutUint64(value[:8], d.Stake)
+		binary.BigEndian.PutUint64(value[8:], d.Rewards)
+		keys = append(keys, delegationKey(addressKey(d.Account), valAddr))
+		values = append(values, value)
+	}
+	err = addLeaves(app.delegationTree, "delegation", keys, values)
+	if err == nil {
+		err = app.indexDelegations()
+	}
+	if err != nil {
+		return err
+	}
+
+	keys, values = nil, nil
+	for _, u := range exp.Unbondings {
+		valAddr, err := hex.DecodeString(u.Validator)
+		if err != nil || len(valAddr) != 20 {
+			return errors.New("invalid exported unbonding validator")
+		}
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, u.Amount)
+		keys = append(keys, unbondingKey(u.Height, addressKey(u.Account), valAddr))
+		values = append(values, value)
+	}
+	err = addLeaves(app.unbondingTree, "unbonding", keys, values)
+	if err == nil {
+		err = app.indexUnbondings()
+	}
+	if err != nil {
+		return err
+	}
+
+	keys, values, err = decodeEntries(exp.BlockHashes)
+	if err != nil {
+		return err
+	}
+	err = addLeaves(app.blockHashTree, "blockHash", keys, values)
+	if err != nil {
+		return err
+	}
+
+	err = restoreEntries(app.contractStorageDb, exp.Payloads)
+	if err != nil {
+		logs.logError("Failed to restore the contract payloads: ", err)
+		return err
+	}
+	err = restoreEntries(app.accountLedgerDb, exp.AccountLedger)
+	if err != nil {
+		logs.logError("Failed to restore the account ledger: ", err)
+		return err
+	}
+	err = restoreEntries(app.contractLedgerDb, exp.ContractLedger)
+	if err != nil {
+		logs.logError("Failed to restore the contract ledger: ", err)
+		return err
+	}
+
+	app.accountNumOnDb = len(genesis.Accounts)
+	app.contractNumOnDb = len(genesis.Contracts)
+	app.baseFee = exp.BaseFee
+	app.burned = exp.Burned
+	app.totalFees = exp.Tips
+	app.importedAppHash = appHash
+
+	logs.info("Imported exported state", "height", exp.Height, "accounts", app.accountNumOnDb,
+		"contracts", app.contractNumOnDb, "validators", len(exp.Validators))
+	return nil
+}
+
+// addressKey is the 4 byte key of an account or contract address
+func addressKey(addr uint32) []byte {
+	key := make([]byte, 4)
+	binary.BigEndian.PutUint32(key, addr)
+	return key
+}
+
+// addLeaves adds the leaves of an exported tree, all of them have to be new
+func addLeaves(tree *arbo.Tree, name string, keys, values [][]byte) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	invalids, err := tree.AddBatch(keys, values)
+	if err != nil {
+		return fmt.Errorf("%s tree: %w", name, err)
+	}
+	if len(invalids) != 0 {
+		return fmt.Errorf("%s tree: %d leaves not added", name, len(invalids))
+	}
+	return nil
+}
+
+func decodeEntries(entries []genesisEntry) ([][]byte, [][]byte, error) {
+	keys := make([][]byte, len(entries))
+	values := make([][]byte, len(entries))
+	for i, e := range entries {
+		var err error
+		keys[i], err = hex.DecodeString(e.Key)
+		if err != nil {
+			return nil, nil, err
+		}
+		values[i], err = hex.DecodeString(e.Value)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return keys, values, nil
+}
+
+// restoreEntries writes raw exported entries back to a database
+func restoreEntries(database db.Database, entries []genesisEntry) error {
+	keys, values, err := decodeEntries(entries)
+	if err != nil {
+		return err
+	}
+	batch := db.NewBatch(database)
+	defer batch.Discard()
+	for i := range keys {
+		err = batch.Set(keys[i], values[i])
+		if err != nil {
+			return err
+		}
+	}
+	return batch.Commit()
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	abcitypes "github.com/tendermint/tendermint/abci/types"
+	tmtypes "github.com/tendermint/tendermint/types"
+)
+
+// exportedChain runs a chain with a contract, a delegation and a pending
+// unbonding and returns it
+func exportedChain(t *testing.T) (*App, []*testAccount) {
+	accounts := newTestAccounts(t, 3)
+	params := DefaultAppConfig().genesisParams()
+	params.UnbondingBlocks = 10
+	app := newTestApp(t, testGenesis(t, accounts, 1000000, params), accounts[0])
+
+	tx, err := accounts[1].signer(t, app).Contract(0, 0, []byte("payload"))
+	require.Nil(t, err)
+	require.Equal(t, uint32(0), commitBlock(t, app, tx)[0].Code)
+
+	var txs [][]byte
+	for _, a := range accounts[1:] {
+		tx, err = a.signer(t, app).Delegate(accounts[0].address, 100)
+		require.Nil(t, err)
+		txs = append(txs, tx)
+	}
+	for _, res := range commitBlock(t, app, txs...) {
+		require.Equal(t, uint32(0), res.Code, res.Log)
+	}
+	deliverBlock(app, proposedBy(app, accounts[0]))
+	app.Commit()
+
+	tx, err = accounts[1].signer(t, app).Undelegate(accounts[0].address)
+	require.Nil(t, err)
+	require.Equal(t, uint32(0), commitBlock(t, app, tx)[0].Code)
+	return app, accounts
+}
+
+func TestExportImport(t *testing.T) {
+	app, accounts := exportedChain(t)
+
+	genDoc, err := app.exportGenesis(&tmtypes.GenesisDoc{}, 0, false)
+	require.Nil(t, err)
+	var state genesisState
+	require.Nil(t, json.Unmarshal(genDoc.AppState, &state))
+
+	//InitChain halts unless the imported roots give back the app hash
+	imported := openTestApp(t, t.TempDir())
+	t.Cleanup(imported.closeDbs)
+	imported.InitChain(abcitypes.RequestInitChain{
+		ChainId:       genDoc.ChainID,
+		AppStateBytes: genDoc.AppState,
+		InitialHeight: genDoc.InitialHeight,
+	})
+	assert.Equal(t, app.appHash, imported.appHash)
+	assert.Equal(t, app.blockHeight, imported.blockHeight)
+
+	for _, a := range accounts {
+		assert.Equal(t, testBalance(t, app, a.address), testBalance(t, imported, a.address))
+	}
+	res := imported.Query(abcitypes.RequestQuery{Path: "/contract/0"})
+	require.Equal(t, uint32(0), res.Code, res.Log)
+	assert.Equal(t, append(make([]byte, 8), "payload"...), res.Value)
+
+	//the imported state runs the next block as the exported chain would
+	tx, err := accounts[2].signer(t, app).Undelegate(accounts[0].address)
+	require.Nil(t, err)
+	for _, chain := range []*App{app, imported} {
+		res := commitBlock(t, chain, tx)[0]
+		require.Equal(t, uint32(0), res.Code, res.Log)
+	}
+	//the new chain hashes its blocks from an empty tx storage
+	assert.Equal(t, app.appHash[:32], imported.appHash[:32])
+
+	//the imported unbonding is paid at its maturity
+	require.Len(t, state.Export.Unbondings, 1)
+	unbonding := state.Export.Unbondings[0]
+	maturity := int64(unbonding.Height)
+	balance := testBalance(t, imported, accounts[1].address)
+	for imported.blockHeight < maturity-1 {
+		commitBlock(t, imported)
+	}
+	assert.Equal(t, balance, testBalance(t, imported, accounts[1].address))
+	commitBlock(t, imported)
+	assert.Equal(t, balance+unbonding.Amount, testBalance(t, imported, accounts[1].address))
+}
+
+func TestExportPrunedPayload(t *testing.T) {
+	app, _ := exportedChain(t)
+
+	//payloads are gone after two tx storage swaps
+	require.Nil(t, app.clearDb(app.contractStorageDb))
+	require.Nil(t, app.clearDb(app.contractStorageDb2))
+
+	_, err := app.exportState(false)
+	assert.NotNil(t, err)
+
+	state, err := app.exportState(true)
+	require.Nil(t, err)
+	assert.Equal(t, "", state.Contracts[0].Payload)
+}
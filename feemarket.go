@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// the base fee moves by at most 1/baseFeeChangeDenominator per block
+const baseFeeChangeDenominator = 8
+
+var stateFeeMarketKey = []byte("feemarket")
+
+// fee market state:
+// [ 8 bytes  | 8 bytes | 8 bytes                        ]
+// [ base fee | burned  | tips owed to the next proposer ]
+func (app *App) encodeFeeMarket() []byte {
+	state := make([]byte, 24)
+	binary.BigEndian.PutUint64(state[:8], app.baseFee)
+	binary.BigEndian.PutUint64(state[8:16], app.burned)
+	binary.BigEndian.PutUint64(state[16:], app.totalFees)
+	return state
+}
+
+// decodeFeeMarket restores the fee market, states saved before the tips were
+// recorded have none
+func (app *App) decodeFeeMarket(state []byte) error {
+	if len(state) < 16 {
+		return errors.New("fee market state too short")
+	}
+	app.baseFee = binary.BigEndian.Uint64(state[:8])
+	app.burned = binary.BigEndian.Uint64(state[8:16])
+	app.totalFees = 0
+	if len(state) >= 24 {
+		app.totalFees = binary.BigEndian.Uint64(state[16:24])
+	}
+	return nil
+}
+
+// minBaseFee is the floor of the base fee, set by the gas parameter
+func (app *App) minBaseFee() uint64 {
+	if app.gas == 0 {
+		return 1
+	}
+	return uint64(app.gas)
+}
+
+// adjustBaseFee raises the base fee after blocks above the target size and
+// lowers it after blocks below it
+func (app *App) adjustBaseFee() {
+	target := app.targetBlockBytes
+	if target == 0 {
+		return
+	}
+	used := app.blockBytes
+
+	if used > target {
+		delta, ok := mulDiv(app.baseFee, used-target, target*baseFeeChangeDenominator)
+		if !ok {
+			delta = 0
+		}
+		if delta == 0 {
+			delta = 1
+		}
+		baseFee, ok := addAmount(app.baseFee, delta)
+		if ok {
+			app.baseFee = baseFee
+		}
+	} else {
+		delta, _ := mulDiv(app.baseFee, target-used, target*baseFeeChangeDenominator)
+		app.baseFee -= delta
+	}
+
+	if app.baseFee < app.minBaseFee() {
+		app.baseFee = app.minBaseFee()
+	}
+	commitLogs.dlog("Base fee: ", app.baseFee)
+}
+
+// collectFee burns the base fee part of a paid fee, the tip goes to the
+// proposer of the next block
+func (app *App) collectFee(tx *Transaction) {
+	tip := tx.Tip
+	if tip > tx.Fee {
+		tip = tx.Fee
+	}
+	app.totalFees += tip
+	app.metrics.Tips.Add(float64(tip))
+
+	burned, ok := addAmount(app.burned, tx.Fee-tip)
+	if ok {
+		app.burned = burned
+	}
+}
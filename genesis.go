@@ -0,0 +1,365 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"go.vocdoni.io/dvote/db"
+)
+
+// genesisAccount is an initial account of the app_state, keys and state are hex encoded
+type genesisAccount struct {
+	PubKey    string `json:"pubKey"`
+	BlsPubKey string `json:"blsPubKey"`
+	Balance   uint64 `json:"balance"`
+	Counter   uint32 `json:"counter,omitempty"`
+	State     string `json:"state,omitempty"`
+}
+
+// genesisContract is an initial contract of the app_state, the payload is hex
+// encoded. Only an exported app_state sets the counter
+type genesisContract struct {
+	Payload string `json:"payload"`
+	Counter uint64 `json:"counter,omitempty"`
+}
+
+// genesisParams are the economic parameters of the network
+type genesisParams struct {
+	Gas           uint32 `json:"gas"`
+	BlockReward   int64  `json:"blockReward"`
+	EmptyVoteLeak int64  `json:"emptyVoteLeak"`
+
+	LegacyTxCutoff  int64  `json:"legacyTxCutoff"`
+	UnbondingBlocks uint64 `json:"unbondingBlocks"`
+
+	//slash fractions are in parts of 10000
+	SlashFractionDoubleSign uint64 `json:"slashFractionDoubleSign"`
+	SlashFractionDowntime   uint64 `json:"slashFractionDowntime"`
+	DowntimeWindow          uint64 `json:"downtimeWindow"`
+	JailBlocks              uint64 `json:"jailBlocks"`
+
+	//block size the base fee aims at, zero keeps the base fee at gas
+	TargetBlockBytes uint64 `json:"targetBlockBytes"`
+}
+
+// genesisState is the app_state of the genesis file
+type genesisState struct {
+	Accounts  []genesisAccount  `json:"accounts"`
+	Contracts []genesisContract `json:"contracts"`
+	Params    *genesisParams    `json:"params,omitempty"`
+	Export    *genesisExport    `json:"export,omitempty"`
+}
+
+// genesisExport is the rest of the state of an exported chain, with it
+// InitChain rebuilds the trees of that chain with identical roots. Accounts
+// and contracts are listed by address
+type genesisExport struct {
+	Height  int64  `json:"height"`
+	AppHash string `json:"appHash"`
+	BaseFee uint64 `json:"baseFee"`
+	Burned  uint64 `json:"burned"`
+	Tips    uint64 `json:"tips"`
+
+	Validators  []genesisValidator  `json:"validators"`
+	Delegations []genesisDelegation `json:"delegations"`
+	Unbondings  []genesisUnbonding  `json:"unbondings"`
+	BlockHashes []genesisEntry      `json:"blockHashes"`
+
+	//contract payloads by address and counter, and the bls key and payload hash ledgers
+	Payloads       []genesisEntry `json:"payloads"`
+	AccountLedger  []genesisEntry `json:"accountLedger"`
+	ContractLedger []genesisEntry `json:"contractLedger"`
+}
+
+// genesisValidator is a validator leaf, jailed validators included
+type genesisValidator struct {
+	PubKey      string `json:"pubKey"`
+	Power       uint64 `json:"power"`
+	Status      byte   `json:"status,omitempty"`
+	JailedUntil uint64 `json:"jailedUntil,omitempty"`
+	Missed      uint64 `json:"missed,omitempty"`
+}
+
+// genesisDelegation is a delegation leaf, undelegated entries included
+type genesisDelegation struct {
+	Account   uint32 `json:"account"`
+	Validator string `json:"validator"`
+	Stake     uint64 `json:"stake"`
+	Rewards   uint64 `json:"rewards"`
+}
+
+// genesisUnbonding is an unbonding leaf, paid entries included
+type genesisUnbonding struct {
+	Height    uint64 `json:"height"`
+	Account   uint32 `json:"account"`
+	Validator string `json:"validator"`
+	Amount    uint64 `json:"amount"`
+}
+
+// genesisEntry is a raw key and value of a tree or database, hex encoded
+type genesisEntry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+var (
+	stateParamsKey  = []byte("params")
+	stateChainIDKey = []byte("chainid")
+)
+
+// initGenesisState seeds accounts, contracts and parameters from the app_state,
+// InitChain persists the parameters
+func (app *App) initGenesisState(appState []byte) error {
+	if len(appState) == 0 {
+		logs.log("Empty app_state, starting without accounts")
+		return nil
+	}
+
+	//params are decoded onto the configured ones, missing fields keep them
+	genesis := genesisState{Params: app.genesisParams()}
+	err := json.Unmarshal(appState, &genesis)
+	if err != nil {
+		logs.logError("Failed to parse app_state: ", err)
+		return err
+	}
+
+	if genesis.Params != nil {
+		app.gas = genesis.Params.Gas
+		app.blockReward = genesis.Params.BlockReward
+		app.emptyVoteLeak = genesis.Params.EmptyVoteLeak
+		app.legacyTxCutoff = genesis.Params.LegacyTxCutoff
+		app.unbondingBlocks = genesis.Params.UnbondingBlocks
+		app.slashFractionDoubleSign = genesis.Params.SlashFractionDoubleSign
+		app.slashFractionDowntime = genesis.Params.SlashFractionDowntime
+		app.downtimeWindow = genesis.Params.DowntimeWindow
+		app.jailBlocks = genesis.Params.JailBlocks
+		app.targetBlockBytes = genesis.Params.TargetBlockBytes
+	}
+	if genesis.Export != nil {
+		return app.importGenesisState(&genesis)
+	}
+
+	for _, a := range genesis.Accounts {
+		err = app.createGenesisAccount(a)
+		if err != nil {
+			logs.logError("Invalid genesis account: ", err)
+			return err
+		}
+	}
+	err = app.commitAccountsToDb()
+	if err != nil {
+		logs.logError("Failed to commit genesis accounts: ", err)
+		return err
+	}
+
+	app.accountNumOnDb, err = app.accountTree.GetNLeafs()
+	if err != nil {
+		logs.logError("Failed to count leaves on the Account Tree: ", err)
+		return err
+	}
+
+	for _, c := range genesis.Contracts {
+		if c.Counter != 0 {
+			err = errors.New("contract counters only come with an export")
+			logs.logError("Invalid genesis contract: ", err)
+			return err
+		}
+		payload, err := hex.DecodeString(c.Payload)
+		if err != nil {
+			logs.logError("Invalid genesis contract payload: ", err)
+			return err
+		}
+		contract := &Contract{Payload: payload}
+		var key [4]byte
+		contract.createContract(app, key)
+	}
+	err = app.commitContractsToDb()
+	if err != nil {
+		logs.logError("Failed to commit genesis contracts: ", err)
+		return err
+	}
+
+	app.contractNumOnDb, err = app.contractTree.GetNLeafs()
+	if err != nil {
+		logs.logError("Failed to count leaves on the Contract Tree: ", err)
+		return err
+	}
+
+	return nil
+}
+
+func (app *App) createGenesisAccount(a genesisAccount) error {
+	data, err := a.accountData()
+	if err != nil {
+		return err
+	}
+
+	//create and fund account
+	account := new(Account)
+	account.isNew = true
+	account.Amount = a.Balance
+	account.Counter = a.Counter
+	account.State = data[accCounterEnd:]
+	account.Data = data
+
+	//find next account address
+	account.nextAccountAddr(app)
+
+	//write to Dbs
+	account.writeAccount(app)
+	return nil
+}
+
+// accountData checks the keys and state of an account of the app_state
+// and builds its leaf
+func (a genesisAccount) accountData() ([]byte, error) {
+	pubkey, err := hex.DecodeString(a.PubKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(pubkey) != 32 {
+		return nil, errors.New("ed25519 public key must be 32 bytes")
+	}
+
+	blspk, err := hex.DecodeString(a.BlsPubKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(blspk) != 48 || new(PublicKey).Uncompress(blspk) == nil {
+		return nil, errors.New("invalid compressed bls public key")
+	}
+
+	state, err := hex.DecodeString(a.State)
+	if err != nil {
+		return nil, err
+	}
+	if len(state) != 0 && len(state) != 32 {
+		return nil, errors.New("account state must be 32 bytes")
+	}
+
+	data := make([]byte, accCounterEnd, accStateEnd)
+	binary.BigEndian.PutUint64(data[:accAmountEnd], a.Balance)
+	copy(data[accAmountEnd:accPubKeyEnd], pubkey)
+	copy(data[accPubKeyEnd:accBlsKeyEnd], blspk)
+	binary.BigEndian.PutUint32(data[accBlsKeyEnd:accCounterEnd], a.Counter)
+	return append(data, state...), nil
+}
+
+// encodeParams serializes the economic parameters
+func (app *App) encodeParams() []byte {
+	params := make([]byte, 76)
+	binary.BigEndian.PutUint32(params[:4], app.gas)
+	binary.BigEndian.PutUint64(params[4:12], uint64(app.blockReward))
+	binary.BigEndian.PutUint64(params[12:20], uint64(app.emptyVoteLeak))
+	binary.BigEndian.PutUint64(params[20:28], uint64(app.legacyTxCutoff))
+	binary.BigEndian.PutUint64(params[28:36], app.unbondingBlocks)
+	binary.BigEndian.PutUint64(params[36:44], app.slashFractionDoubleSign)
+	binary.BigEndian.PutUint64(params[44:52], app.slashFractionDowntime)
+	binary.BigEndian.PutUint64(params[52:60], app.downtimeWindow)
+	binary.BigEndian.PutUint64(params[60:68], app.jailBlocks)
+	binary.BigEndian.PutUint64(params[68:], app.targetBlockBytes)
+	return params
+}
+
+// decodeParams restores the economic parameters, fields missing from
+// parameters stored by older versions keep their defaults
+func (app *App) decodeParams(params []byte) error {
+	if len(params) < 20 {
+		return errors.New("stored parameters are too short")
+	}
+
+	app.gas = binary.BigEndian.Uint32(params[:4])
+	app.blockReward = int64(binary.BigEndian.Uint64(params[4:12]))
+	app.emptyVoteLeak = int64(binary.BigEndian.Uint64(params[12:20]))
+
+	//parameters stored before the versioned tx format have no cutoff
+	if len(params) >= 28 {
+		app.legacyTxCutoff = int64(binary.BigEndian.Uint64(params[20:28]))
+	}
+	if len(params) >= 36 {
+		app.unbondingBlocks = binary.BigEndian.Uint64(params[28:36])
+	}
+	if len(params) >= 68 {
+		app.slashFractionDoubleSign = binary.BigEndian.Uint64(params[36:44])
+		app.slashFractionDowntime = binary.BigEndian.Uint64(params[44:52])
+		app.downtimeWindow = binary.BigEndian.Uint64(params[52:60])
+		app.jailBlocks = binary.BigEndian.Uint64(params[60:68])
+	}
+	if len(params) >= 76 {
+		app.targetBlockBytes = binary.BigEndian.Uint64(params[68:76])
+	}
+	return nil
+}
+
+// saveParams persists the economic parameters and the chain id,
+// InitChain is not called again after a restart
+func (app *App) saveParams() error {
+	wSt := app.stateDb.WriteTx()
+	defer wSt.Discard()
+
+	err := wSt.Set(stateParamsKey, app.encodeParams())
+	if err != nil {
+		logs.logError("Failed to store parameters: ", err)
+		return err
+	}
+
+	err = wSt.Set(stateChainIDKey, app.chainID)
+	if err != nil {
+		logs.logError("Failed to store the chain id: ", err)
+		return err
+	}
+	return wSt.Commit()
+}
+
+// bindChainID sets the chain id of the genesis file the node runs with. Chains
+// initialized before the chain id was stored have none and store it now, a
+// stored chain id different from the genesis one is an error
+func (app *App) bindChainID(chainID string) error {
+	if len(app.chainID) != 0 {
+		if string(app.chainID) != chainID {
+			return fmt.Errorf("stored chain id %q does not match the genesis chain id %q", app.chainID, chainID)
+		}
+		return nil
+	}
+
+	app.chainID = []byte(chainID)
+	wSt := app.stateDb.WriteTx()
+	defer wSt.Discard()
+	err := wSt.Set(stateChainIDKey, app.chainID)
+	if err != nil {
+		logs.logError("Failed to store the chain id: ", err)
+		return err
+	}
+	return wSt.Commit()
+}
+
+// loadParams restores the economic parameters and the chain id,
+// the defaults are kept if none were stored
+func (app *App) loadParams() error {
+	rSt := app.stateDb.ReadTx()
+	defer rSt.Discard()
+
+	params, err := rSt.Get(stateParamsKey)
+	if err == nil {
+		err = app.decodeParams(params)
+	} else if err == db.ErrKeyNotFound {
+		err = nil
+	}
+	if err != nil {
+		logs.logError("Failed to read parameters: ", err)
+		return err
+	}
+
+	//chains initialized before the chain id was stored have none, see bindChainID
+	chainID, err := rSt.Get(stateChainIDKey)
+	if err == nil {
+		app.chainID = chainID
+	} else if err != db.ErrKeyNotFound {
+		logs.logError("Failed to read the chain id: ", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenesisAccountData(t *testing.T) {
+	a := newTestAccounts(t, 1)[0]
+	pubKey := hex.EncodeToString(a.pubKey())
+	blsKey := hex.EncodeToString(a.bls.PubKey())
+
+	tests := []struct {
+		name    string
+		account genesisAccount
+		size    int
+		valid   bool
+	}{
+		{"valid", genesisAccount{PubKey: pubKey, BlsPubKey: blsKey, Balance: 1 << 40, Counter: 3}, accCounterEnd, true},
+		{"with state", genesisAccount{PubKey: pubKey, BlsPubKey: blsKey, State: strings.Repeat("ab", 32)}, accStateEnd, true},
+		{"short ed25519 key", genesisAccount{PubKey: pubKey[2:], BlsPubKey: blsKey}, 0, false},
+		{"bad hex", genesisAccount{PubKey: "zz" + pubKey[2:], BlsPubKey: blsKey}, 0, false},
+		{"short bls key", genesisAccount{PubKey: pubKey, BlsPubKey: blsKey[2:]}, 0, false},
+		{"invalid bls key", genesisAccount{PubKey: pubKey, BlsPubKey: strings.Repeat("ff", 48)}, 0, false},
+		{"short state", genesisAccount{PubKey: pubKey, BlsPubKey: blsKey, State: "abcd"}, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := tt.account.accountData()
+			if !tt.valid {
+				assert.NotNil(t, err)
+				return
+			}
+			require.Nil(t, err)
+			require.Equal(t, tt.size, len(data))
+			assert.Equal(t, tt.account.Balance, binary.BigEndian.Uint64(data[:accAmountEnd]))
+			assert.Equal(t, pubKey, hex.EncodeToString(data[accAmountEnd:accPubKeyEnd]))
+			assert.Equal(t, blsKey, hex.EncodeToString(data[accPubKeyEnd:accBlsKeyEnd]))
+			assert.Equal(t, tt.account.Counter, binary.BigEndian.Uint32(data[accBlsKeyEnd:accCounterEnd]))
+		})
+	}
+}
+
+func TestInitGenesisState(t *testing.T) {
+	accounts := newTestAccounts(t, 3)
+
+	//params left out keep the configured values
+	partial := DefaultAppConfig().genesisParams()
+	partial.Gas = 7
+	partial.LegacyTxCutoff = 10
+
+	tests := []struct {
+		name     string
+		appState []byte
+		accounts int
+		params   *genesisParams
+	}{
+		{"empty app_state", nil, 0, DefaultAppConfig().genesisParams()},
+		{"accounts", testGenesis(t, accounts, 1000, nil), 3, DefaultAppConfig().genesisParams()},
+		{"params", testGenesis(t, accounts[:1], 1000, &genesisParams{Gas: 7, BlockReward: 5, LegacyTxCutoff: 10}), 1,
+			&genesisParams{Gas: 7, BlockReward: 5, LegacyTxCutoff: 10}},
+		{"partial params", []byte(`{"params":{"gas":7,"legacyTxCutoff":10}}`), 0, partial},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, tt.appState)
+			assert.Equal(t, tt.accounts, app.accountNumOnDb)
+			assert.Equal(t, tt.params, app.genesisParams())
+
+			for i := 0; i < tt.accounts; i++ {
+				assert.Equal(t, uint64(1000), testBalance(t, app, uint32(i)))
+			}
+
+			//the parameters survive a restart
+			app = reopenTestApp(t, app)
+			assert.Equal(t, tt.params, app.genesisParams())
+		})
+	}
+}
+
+func TestInitGenesisStateInvalid(t *testing.T) {
+	app := openTestApp(t, t.TempDir())
+	defer app.closeDbs()
+
+	assert.NotNil(t, app.initGenesisState([]byte("{")))
+	assert.NotNil(t, app.initGenesisState([]byte(`{"accounts":[{"pubKey":"00","blsPubKey":"00"}]}`)))
+	assert.NotNil(t, app.initGenesisState([]byte(`{"contracts":[{"payload":"00","counter":3}]}`)))
+}
+
+func TestChainID(t *testing.T) {
+	accounts := newTestAccounts(t, 1)
+
+	tests := []struct {
+		name     string
+		appState []byte
+		//chain initialized before the chain id was stored
+		unstored bool
+		genesis  string
+		valid    bool
+	}{
+		{"empty app_state", nil, false, testChainID, true},
+		{"accounts", testGenesis(t, accounts, 1000, nil), false, testChainID, true},
+		{"not stored", testGenesis(t, accounts, 1000, nil), true, testChainID, true},
+		{"other genesis", testGenesis(t, accounts, 1000, nil), false, "other-chain", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, tt.appState)
+			commitBlock(t, app)
+
+			if tt.unstored {
+				wSt := app.stateDb.WriteTx()
+				require.Nil(t, wSt.Delete(stateChainIDKey))
+				require.Nil(t, wSt.Commit())
+			}
+
+			//InitChain stored the chain id
+			app = reopenTestApp(t, app)
+			if !tt.unstored {
+				assert.Equal(t, testChainID, string(app.chainID))
+			}
+
+			err := app.bindChainID(tt.genesis)
+			if !tt.valid {
+				assert.NotNil(t, err)
+				return
+			}
+			require.Nil(t, err)
+			assert.Equal(t, testChainID, string(app.chainID))
+
+			app = reopenTestApp(t, app)
+			assert.Equal(t, testChainID, string(app.chainID))
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+
+	"github.com/vocdoni/arbo"
+)
+
+// exit code of a node halted on a corrupt state
+const haltExitCode = 3
+
+// haltDump is written to the data directory when the node halts, it records
+// what the application knew about its state at that moment
+type haltDump struct {
+	Time      time.Time         `json:"time"`
+	Reason    string            `json:"reason"`
+	Error     string            `json:"error"`
+	Height    int64             `json:"height"`
+	ChainID   string            `json:"chainId"`
+	AppHash   string            `json:"appHash"`
+	Roots     map[string]string `json:"roots"`
+	Accounts  int               `json:"accounts"`
+	Contracts int               `json:"contracts"`
+	Pending   map[string]int    `json:"pending"`
+	BaseFee   uint64            `json:"baseFee"`
+	Burned    uint64            `json:"burned"`
+	TotalFees uint64            `json:"totalFees"`
+	Stack     string            `json:"stack"`
+}
+
+// halt stops the node when the state can not be trusted anymore: a database
+// or tree failed while committing a block every node agrees on. Errors caused
+// by the content of txs, votes or evidence are handled where they happen and
+// never reach halt
+func (app *App) halt(reason string, err error) {
+	logs.logError(reason, err)
+
+	dump := haltDump{
+		Time:      time.Now(),
+		Reason:    reason,
+		Error:     fmt.Sprint(err),
+		Height:    app.blockHeight,
+		ChainID:   string(app.chainID),
+		AppHash:   hex.EncodeToString(app.appHash),
+		Roots:     make(map[string]string),
+		Accounts:  app.accountNumOnDb,
+		Contracts: app.contractNumOnDb,
+		Pending: map[string]int{
+			"accounts":     len(app.tempAccountMap),
+			"newAccounts":  len(app.tempNewAccountMap),
+			"contracts":    len(app.tempContractMap),
+			"newContracts": len(app.tempNewContractMap),
+			"txs":          len(app.txDbKeys),
+		},
+		BaseFee:   app.baseFee,
+		Burned:    app.burned,
+		TotalFees: app.totalFees,
+		Stack:     string(debug.Stack()),
+	}
+
+	trees := map[string]*arbo.Tree{
+		"account":    app.accountTree,
+		"contract":   app.contractTree,
+		"txStorage":  app.txStorageTree,
+		"blockHash":  app.blockHashTree,
+		"validator":  app.validatorTree,
+		"delegation": app.delegationTree,
+		"unbonding":  app.unbondingTree,
+	}
+	for name, tree := range trees {
+		if tree == nil {
+			continue
+		}
+		root, err := tree.Root()
+		if err != nil {
+			dump.Roots[name] = "error: " + err.Error()
+			continue
+		}
+		dump.Roots[name] = hex.EncodeToString(root)
+	}
+
+	file := filepath.Join(app.dataDir, fmt.Sprintf("halt-%d.json", app.blockHeight))
+	data, jsonErr := json.MarshalIndent(dump, "", "  ")
+	if jsonErr == nil {
+		jsonErr = os.WriteFile(file, data, 0o600)
+	}
+	if jsonErr != nil {
+		logs.logError("Failed to write the halt dump: ", jsonErr)
+	} else {
+		logs.info("Node halted, diagnostic dump written", "file", file)
+	}
+
+	app.onHalt()
+}
+
+// exitOnHalt is the default halt hook, main replaces it to close the databases first
+func exitOnHalt() {
+	os.Exit(haltExitCode)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	abcitypes "github.com/tendermint/tendermint/abci/types"
+	"github.com/tendermint/tendermint/proto/tendermint/crypto"
+	"github.com/vocdoni/arbo"
+	"go.vocdoni.io/dvote/db"
+)
+
+// tree states of every retained height are kept in the state db under
+// historyPrefix | height (8 bytes), arbo never prunes the nodes of old roots
+var historyPrefix = []byte("h/")
+
+// query errors, returned with the codespace of the tx errors
+var (
+	errHeightPruned   = registerTxError(120, "height no longer retained")
+	errHeightUnknown  = registerTxError(121, "height not committed")
+	errNotHistorical  = registerTxError(122, "query not served at past heights")
+	errQueryMalformed = registerTxError(123, "malformed query")
+	errQueryNotFound  = registerTxError(124, "not found")
+)
+
+func historyKey(height int64) []byte {
+	key := make([]byte, len(historyPrefix)+8)
+	copy(key, historyPrefix)
+	binary.BigEndian.PutUint64(key[len(historyPrefix):], uint64(height))
+	return key
+}
+
+// stateView reads the trees as they were committed at a height
+type stateView struct {
+	height int64
+	latest bool
+
+	account    *arbo.Tree
+	contract   *arbo.Tree
+	blockHash  *arbo.Tree
+	validator  *arbo.Tree
+	delegation *arbo.Tree
+	unbonding  *arbo.Tree
+
+	//encoded fee market of the height, nil for heights saved without it
+	feeMarket []byte
+}
+
+// stateAt opens the trees at a committed height, 0 is the last one. Queries
+// never see the writes of the block being executed, nor its height
+func (app *App) stateAt(height int64) (*stateView, error) {
+	committed := app.committedHeight
+	if height < 0 || height > committed {
+		return nil, errHeightUnknown.wrap("%d, last committed height is %d", height, committed)
+	}
+	if height == 0 {
+		height = committed
+	}
+
+	states := app.committed
+	var feeMarket []byte
+	var err error
+	if height != committed || states == nil {
+		states, feeMarket, err = app.historyStates(height)
+	} else {
+		feeMarket, err = app.committedFeeMarket()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	trees := make(map[string]*arbo.Tree)
+	for i, t := range app.journaledTrees() {
+		tree, err := t.tree.Snapshot(states[i].root)
+		if err != nil {
+			return nil, fmt.Errorf("%s tree at height %d: %w", t.name, height, err)
+		}
+		trees[t.name] = tree
+	}
+	return &stateView{
+		height:     height,
+		latest:     height == committed,
+		account:    trees["account"],
+		contract:   trees["contract"],
+		blockHash:  trees["blockHash"],
+		validator:  trees["validator"],
+		delegation: trees["delegation"],
+		unbonding:  trees["unbonding"],
+		feeMarket:  feeMarket,
+	}, nil
+}
+
+// historyStates reads the tree states and the fee market saved with a height
+func (app *App) historyStates(height int64) ([]treeState, []byte, error) {
+	rSt := app.stateDb.ReadTx()
+	blob, err := rSt.Get(historyKey(height))
+	rSt.Discard()
+	if err != nil && err != db.ErrKeyNotFound {
+		return nil, nil, err
+	}
+	if err != nil {
+		oldest, err := app.oldestHistory()
+		if err != nil {
+			return nil, nil, errHeightPruned.wrap("%d, oldest retained height unknown: %v", height, err)
+		}
+		return nil, nil, errHeightPruned.wrap("%d, oldest retained height is %d", height, oldest)
+	}
+
+	states, err := decodeTreeStates(blob, len(app.journaledTrees()))
+	if err != nil {
+		return nil, nil, err
+	}
+	//the fee market follows the tree states, heights saved before it have none
+	feeMarket := blob[len(encodeTreeStates(states)):]
+	if len(feeMarket) == 0 {
+		feeMarket = nil
+	}
+	return states, feeMarket, nil
+}
+
+// committedFeeMarket reads the fee market saved with the last committed
+// height, the one in memory moves with the block being executed
+func (app *App) committedFeeMarket() ([]byte, error) {
+	rSt := app.stateDb.ReadTx()
+	defer rSt.Discard()
+
+	feeMarket, err := rSt.Get(stateFeeMarketKey)
+	if err == db.ErrKeyNotFound {
+		return nil, nil
+	}
+	return feeMarket, err
+}
+
+// oldestHistory returns the first retained height, the last committed one without history
+func (app *App) oldestHistory() (int64, error) {
+	oldest := app.committedHeight
+	err := app.stateDb.Iterate(historyPrefix, func(key, _ []byte) bool {
+		oldest = int64(binary.BigEndian.Uint64(key[len(historyPrefix):]))
+		return false
+	})
+	return oldest, err
+}
+
+// pruneHistory drops the tree states of the heights past the retention
+// window, 0 keeps them all
+func (app *App) pruneHistory() error {
+	if app.historyBlocks <= 0 {
+		return nil
+	}
+	cutoff := app.blockHeight - app.historyBlocks
+
+	var keys [][]byte
+	err := app.stateDb.Iterate(historyPrefix, func(key, _ []byte) bool {
+		if int64(binary.BigEndian.Uint64(key[len(historyPrefix):])) > cutoff {
+			return false
+		}
+		keys = append(keys, append([]byte{}, key...))
+		return true
+	})
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+
+	wSt := app.stateDb.WriteTx()
+	defer wSt.Discard()
+	for _, key := range keys {
+		err = wSt.Delete(key)
+		if err != nil {
+			return err
+		}
+	}
+	return wSt.Commit()
+}
+
+// get returns the value of a leaf of a tree of the view with its proof
+// against the root of the tree
+func (view *stateView) get(tree *arbo.Tree, name string, key []byte, prove bool) ([]byte, *crypto.ProofOps, error) {
+	_, value, err := tree.Get(key)
+	if err != nil {
+		return nil, nil, errQueryNotFound.wrap("%s %x at height %d", name, key, view.height)
+	}
+	if !prove {
+		return value, nil, nil
+	}
+
+	_, _, siblings, _, err := tree.GenProof(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	ops := &crypto.ProofOps{Ops: []crypto.ProofOp{{Type: "arbo:" + name, Key: key, Data: siblings}}}
+
+	//the account, contract and validator roots are part of the app hash
+	if name == "account" || name == "contract" || name == "validator" {
+		roots, err := view.appHashRoots()
+		if err != nil {
+			return nil, nil, err
+		}
+		ops.Ops = append(ops.Ops, crypto.ProofOp{Type: "apphash", Data: roots})
+	}
+	return value, ops, nil
+}
+
+// appHashRoots returns the roots and the fee market hashed into the app hash,
+// in order: account | contract | validator | delegation | unbonding | fee market | blockhash
+func (view *stateView) appHashRoots() ([]byte, error) {
+	var roots []byte
+	for _, tree := range []*arbo.Tree{view.account, view.contract, view.validator, view.delegation, view.unbonding} {
+		root, err := tree.Root()
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, root...)
+	}
+	roots = append(roots, view.feeMarket...)
+
+	root, err := view.blockHash.Root()
+	if err != nil {
+		return nil, err
+	}
+	return append(roots, root...), nil
+}
+
+// has reports whether a key is a leaf of a tree of the view
+func (view *stateView) has(tree *arbo.Tree, key []byte) bool {
+	_, _, err := tree.Get(key)
+	return err == nil
+}
+
+// ledgerAddress returns the address indexed by a bls key or a payload hash
+func (app *App) ledgerAddress(ledger db.Database, key []byte) ([]byte, error) {
+	rTx := ledger.ReadTx()
+	defer rTx.Discard()
+	return rTx.Get(key)
+}
+
+// queryResult is the response of a failed query
+func queryResult(reqQuery abcitypes.RequestQuery, err error) abcitypes.ResponseQuery {
+	code, log, codespace := txResult(err)
+	return abcitypes.ResponseQuery{Code: code, Log: log, Codespace: codespace, Key: reqQuery.Data, Height: reqQuery.Height}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	abcitypes "github.com/tendermint/tendermint/abci/types"
+	tmproto "github.com/tendermint/tendermint/proto/tendermint/types"
+)
+
+func TestHistoricalQueries(t *testing.T) {
+	accounts := newTestAccounts(t, 2)
+	app := newTestApp(t, testGenesis(t, accounts, 1000000, nil), accounts[0])
+	app.historyBlocks = 3
+
+	//heights 2, 3 and 4 are retained, the transfer is committed at height 3
+	commitBlock(t, app)
+	commitBlock(t, app)
+	tx, err := accounts[1].signer(t, app).Transfer(accounts[0].address, 100)
+	require.Nil(t, err)
+	require.Equal(t, uint32(0), commitBlock(t, app, tx)[0].Code)
+	balance := testBalance(t, app, accounts[0].address)
+	commitBlock(t, app)
+
+	//height 5 is executed but not committed yet
+	tx, err = accounts[1].signer(t, app).Transfer(accounts[0].address, 100)
+	require.Nil(t, err)
+	results, _ := deliverBlock(app, abcitypes.RequestBeginBlock{Header: tmproto.Header{}}, tx)
+	require.Equal(t, uint32(0), results[0].Code)
+
+	tests := []struct {
+		name    string
+		height  int64
+		replied int64
+		balance uint64
+		code    uint32
+		log     string
+	}{
+		{"last committed", 0, 4, balance, 0, ""},
+		{"retained", 3, 3, balance, 0, ""},
+		{"before the transfer", 2, 2, balance - 100, 0, ""},
+		{"pruned", 1, 1, 0, errHeightPruned.Code, "oldest retained height is 2"},
+		{"executing", 5, 5, 0, errHeightUnknown.Code, "last committed height is 4"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := app.Query(abcitypes.RequestQuery{
+				Path:   fmt.Sprintf("/account/%d", accounts[0].address),
+				Height: tt.height,
+			})
+			require.Equal(t, tt.code, res.Code, res.Log)
+			assert.Equal(t, tt.replied, res.Height)
+			if tt.code != 0 {
+				assert.Contains(t, res.Log, tt.log)
+				return
+			}
+			assert.Equal(t, tt.balance, binary.BigEndian.Uint64(res.Value[:accAmountEnd]))
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/vocdoni/arbo"
+	"go.vocdoni.io/dvote/db"
+)
+
+// keys of the commit journal and of the tree states of the last committed height
+var (
+	stateJournalKey = []byte("journal")
+	stateRootsKey   = []byte("roots")
+)
+
+// arbo keeps the number of leaves next to the root, it does not follow SetRoot
+var arboNLeafsKey = []byte("nleafs")
+
+// journaledTree is a tree written by a block, with the database holding it
+type journaledTree struct {
+	name string
+	tree *arbo.Tree
+	db   db.Database
+}
+
+// treeState is the root and number of leaves of a tree at a committed height
+type treeState struct {
+	root   []byte
+	nLeafs uint64
+}
+
+// journaledTrees lists the trees a block writes to, in journal order. The
+// tx storage trees are swapped after the state is saved and left out, a
+// replayed block adds the same keys again and ends at the same root
+func (app *App) journaledTrees() []journaledTree {
+	return []journaledTree{
+		{"account", app.accountTree, app.accountDb},
+		{"contract", app.contractTree, app.contractDb},
+		{"blockHash", app.blockHashTree, app.blockHashDb},
+		{"validator", app.validatorTree, app.validatorDb},
+		{"delegation", app.delegationTree, app.delegationDb},
+		{"unbonding", app.unbondingTree, app.unbondingDb},
+	}
+}
+
+// treeStates reads the current root and number of leaves of every journaled tree
+func (app *App) treeStates() ([]treeState, error) {
+	trees := app.journaledTrees()
+	states := make([]treeState, len(trees))
+	for i, t := range trees {
+		root, err := t.tree.Root()
+		if err != nil {
+			return nil, fmt.Errorf("%s tree root: %w", t.name, err)
+		}
+		nLeafs, err := t.tree.GetNLeafs()
+		if err != nil {
+			return nil, fmt.Errorf("%s tree leaves: %w", t.name, err)
+		}
+		states[i] = treeState{root: root, nLeafs: uint64(nLeafs)}
+	}
+	return states, nil
+}
+
+// tree states encoding, one entry per journaled tree:
+// [ 8 bytes     | root size bytes | 8 bytes ]
+// [ root size   | root            | leaves  ]
+func encodeTreeStates(states []treeState) []byte {
+	var buf bytes.Buffer
+	for _, s := range states {
+		writeSized(&buf, s.root)
+		var nLeafs [8]byte
+		binary.BigEndian.PutUint64(nLeafs[:], s.nLeafs)
+		buf.Write(nLeafs[:])
+	}
+	return buf.Bytes()
+}
+
+func decodeTreeStates(blob []byte, count int) ([]treeState, error) {
+	states := make([]treeState, count)
+	for i := range states {
+		root, rest, err := readSized(blob)
+		if err != nil {
+			return nil, err
+		}
+		if len(rest) < 8 {
+			return nil, errors.New("tree states truncated")
+		}
+		states[i] = treeState{root: root, nLeafs: binary.BigEndian.Uint64(rest[:8])}
+		blob = rest[8:]
+	}
+	return states, nil
+}
+
+// commit journal:
+// [ 8 bytes         | tree states                        ]
+// [ intended height | states of the last committed height ]
+//
+// writeJournal records the block being committed before any tree is
+// written, saveState clears it together with the new height
+func (app *App) writeJournal(states []treeState) error {
+	var height [8]byte
+	binary.BigEndian.PutUint64(height[:], uint64(app.blockHeight))
+
+	wSt := app.stateDb.WriteTx()
+	defer wSt.Discard()
+
+	err := wSt.Set(stateJournalKey, append(height[:], encodeTreeStates(states)...))
+	if err != nil {
+		return err
+	}
+	return wSt.Commit()
+}
+
+// committedTreeStates returns the tree states saved with the last committed
+// height, nil for states saved before they were recorded
+func (app *App) committedTreeStates() ([]treeState, error) {
+	rSt := app.stateDb.ReadTx()
+	defer rSt.Discard()
+
+	blob, err := rSt.Get(stateRootsKey)
+	if err == db.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeTreeStates(blob, len(app.journaledTrees()))
+}
+
+// recoverCommit brings every tree back to the last committed height after a
+// crash, either in the middle of a commit (the journal is still there) or
+// while executing a block (roots moved past the committed ones). Tendermint
+// replays the lost block on the handshake
+func (app *App) recoverCommit() error {
+	rSt := app.stateDb.ReadTx()
+	journal, err := rSt.Get(stateJournalKey)
+	rSt.Discard()
+	if err != nil && err != db.ErrKeyNotFound {
+		return err
+	}
+
+	var states []treeState
+	if err == nil {
+		if len(journal) < 8 {
+			return errors.New("commit journal truncated")
+		}
+		commitLogs.info("Interrupted commit found, rolling back",
+			"height", binary.BigEndian.Uint64(journal[:8]))
+		//the commit of the first block has no committed states to go back to
+		if len(journal) > 8 {
+			states, err = decodeTreeStates(journal[8:], len(app.journaledTrees()))
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		states, err = app.committedTreeStates()
+		if err != nil {
+			return err
+		}
+		if states == nil {
+			return nil
+		}
+	}
+
+	if states != nil {
+		err = app.rollbackTrees(states)
+		if err != nil {
+			return err
+		}
+	}
+
+	wSt := app.stateDb.WriteTx()
+	defer wSt.Discard()
+	err = wSt.Delete(stateJournalKey)
+	if err != nil && err != db.ErrKeyNotFound {
+		return err
+	}
+	return wSt.Commit()
+}
+
+// rollbackTrees sets the root and the number of leaves of every tree that
+// moved away from the given states, the nodes of the old roots are still in
+// the databases as arbo never prunes them
+func (app *App) rollbackTrees(states []treeState) error {
+	for i, t := range app.journaledTrees() {
+		root, err := t.tree.Root()
+		if err != nil {
+			return fmt.Errorf("%s tree root: %w", t.name, err)
+		}
+		nLeafs, err := t.tree.GetNLeafs()
+		if err != nil {
+			return fmt.Errorf("%s tree leaves: %w", t.name, err)
+		}
+		if bytes.Equal(root, states[i].root) && uint64(nLeafs) == states[i].nLeafs {
+			continue
+		}
+
+		commitLogs.info("Rolling back tree", "tree", t.name, "root", root, "to", states[i].root)
+
+		wTx := t.db.WriteTx()
+		err = t.tree.SetRootWithTx(wTx, states[i].root)
+		if err == nil {
+			var b [8]byte
+			binary.LittleEndian.PutUint64(b[:], states[i].nLeafs)
+			err = wTx.Set(arboNLeafsKey, b[:])
+		}
+		if err == nil {
+			err = wTx.Commit()
+		}
+		wTx.Discard()
+		if err != nil {
+			return fmt.Errorf("rolling back %s tree: %w", t.name, err)
+		}
+	}
+	return nil
+}
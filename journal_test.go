@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	abcitypes "github.com/tendermint/tendermint/abci/types"
+	tmproto "github.com/tendermint/tendermint/proto/tendermint/types"
+)
+
+func TestRecoverCommit(t *testing.T) {
+	tests := []struct {
+		name string
+		//the commit journal was written before the crash
+		journal bool
+		//trees written before the crash
+		write bool
+	}{
+		{"clean restart", false, false},
+		{"crash in the middle of a commit", true, true},
+		{"crash after the journal", true, false},
+		{"trees moved without a journal", false, true},
+	}
+
+	accounts := newTestAccounts(t, 2)
+	genesis := testGenesis(t, accounts, 1000000, nil)
+
+	//the same block committed without a crash
+	ref := newTestApp(t, genesis, accounts[0])
+	commitBlock(t, ref)
+	tx, err := accounts[1].signer(t, ref).Transfer(accounts[0].address, 100)
+	require.Nil(t, err)
+	require.Equal(t, uint32(0), commitBlock(t, ref, tx)[0].Code)
+	refHash := ref.appHash
+	ref.closeDbs()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, genesis, accounts[0])
+			commitBlock(t, app)
+			committed := app.committed
+			appHash := app.appHash
+
+			results, _ := deliverBlock(app, abcitypes.RequestBeginBlock{Header: tmproto.Header{}}, tx)
+			require.Equal(t, uint32(0), results[0].Code)
+			if tt.journal {
+				require.Nil(t, app.writeJournal(app.committed))
+			}
+			if tt.write {
+				require.Nil(t, app.commitAccountsToDb())
+				require.Nil(t, app.blockHashTree.Add([]byte{0, 0, 0, 0, 0, 0, 0, 2}, make([]byte, 32)))
+			}
+
+			//the trees go back to the last committed height
+			app = reopenTestApp(t, app)
+			assert.Equal(t, int64(1), app.blockHeight)
+			assert.Equal(t, appHash, app.appHash)
+			states, err := app.treeStates()
+			require.Nil(t, err)
+			assert.Equal(t, committed, states)
+			assert.Equal(t, uint64(1000000), testBalance(t, app, accounts[0].address))
+
+			//tendermint replays the lost block
+			require.Equal(t, uint32(0), commitBlock(t, app, tx)[0].Code)
+			assert.Equal(t, refHash, app.appHash)
+		})
+	}
+}
@@ -1,102 +1,198 @@
 package main
 
 import (
-	"fmt"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
 
-	"github.com/fatih/color"
+	tmlog "github.com/tendermint/tendermint/libs/log"
 )
 
-var colorReset = color.New(color.FgBlack).SprintFunc()
-var colorRed = color.New(color.FgRed).SprintFunc()
-var colorGreen = color.New(color.FgGreen).SprintFunc()
-var colorYellow = color.New(color.FgYellow).SprintFunc()
-var colorBlue = color.New(color.FgBlue).SprintFunc()
-
+// Logger writes leveled key/value records through the tendermint logger,
+// tagged with the module of the application that produced them
 type Logger struct {
-	//set this to log all internal values
-	debugLogs     bool
-	followAccount bool
-	followTx      bool
+	module string
+	tm     tmlog.Logger
 }
 
-var logs Logger
+// module loggers, levels are set per module with the tendermint log_level
+// syntax, e.g. "checktx:debug,exec:info,*:error"
+var (
+	logs       = newModuleLogger("app")
+	checkLogs  = newModuleLogger("checktx")
+	execLogs   = newModuleLogger("exec")
+	commitLogs = newModuleLogger("commit")
+	queryLogs  = newModuleLogger("query")
+	valLogs    = newModuleLogger("validators")
+	traceLogs  = newModuleLogger("trace")
+)
+
+// trace modes print accounts and txs in full, nil filters trace nothing
+var (
+	traceAccounts *traceFilter
+	traceTxs      *traceFilter
+)
+
+func newModuleLogger(module string) *Logger {
+	base := tmlog.NewFilter(tmlog.NewTMLogger(tmlog.NewSyncWriter(os.Stdout)), tmlog.AllowInfo())
+	return &Logger{module: module, tm: base.With("module", module)}
+}
 
-func (logs *Logger) log(str interface{}) {
-	if logs.debugLogs {
-		fmt.Println(colorGreen(str))
+// setLogger routes all module loggers to the tendermint logger
+func setLogger(base tmlog.Logger) {
+	for _, l := range []*Logger{logs, checkLogs, execLogs, commitLogs, queryLogs, valLogs, traceLogs} {
+		l.tm = base.With("module", l.module)
 	}
 }
 
-func (logs *Logger) dlog(str string, intrfc interface{}) {
-	if logs.debugLogs {
-		fmt.Println(colorGreen(str), intrfc)
+// log writes a debug message, values other than strings are logged under "value"
+func (logs *Logger) log(msg interface{}) {
+	if str, ok := msg.(string); ok {
+		logs.tm.Debug(strings.TrimSpace(str))
+		return
 	}
+	logs.tm.Debug("value", "value", logValue(msg))
+}
+
+// dlog writes a debug message with a value
+func (logs *Logger) dlog(msg string, value interface{}) {
+	logs.tm.Debug(strings.TrimRight(strings.TrimSpace(msg), ": "), "value", logValue(value))
 }
 
-func (logs *Logger) logError(str string, err error) {
-	fmt.Println(colorBlue(str), colorRed(err))
+func (logs *Logger) debug(msg string, keyvals ...interface{}) {
+	logs.tm.Debug(msg, logValues(keyvals)...)
+}
+
+func (logs *Logger) info(msg string, keyvals ...interface{}) {
+	logs.tm.Info(msg, logValues(keyvals)...)
+}
+
+func (logs *Logger) logError(msg string, err error) {
+	logs.tm.Error(strings.TrimRight(strings.TrimSpace(msg), ": !"), "err", err)
+}
+
+// logValue hex encodes byte slices and arrays
+func logValue(v interface{}) interface{} {
+	switch b := v.(type) {
+	case []byte:
+		return hex.EncodeToString(b)
+	case [32]byte:
+		return hex.EncodeToString(b[:])
+	case [8]byte:
+		return hex.EncodeToString(b[:])
+	case [4]byte:
+		return hex.EncodeToString(b[:])
+	}
+	return v
+}
+
+func logValues(keyvals []interface{}) []interface{} {
+	for i := 1; i < len(keyvals); i += 2 {
+		keyvals[i] = logValue(keyvals[i])
+	}
+	return keyvals
+}
+
+// traceFilter selects accounts or txs by address
+type traceFilter struct {
+	all       bool
+	addresses map[uint32]bool
+}
+
+// parseTraceFilter reads a comma separated list of account addresses,
+// "all" matches every address and an empty list disables the trace
+func parseTraceFilter(list string) (*traceFilter, error) {
+	list = strings.TrimSpace(list)
+	if list == "" {
+		return nil, nil
+	}
+	if list == "all" || list == "*" {
+		return &traceFilter{all: true}, nil
+	}
+
+	f := &traceFilter{addresses: make(map[uint32]bool)}
+	for _, s := range strings.Split(list, ",") {
+		address, err := strconv.ParseUint(strings.TrimSpace(s), 10, 32)
+		if err != nil {
+			return nil, errors.New("invalid trace address: " + s)
+		}
+		f.addresses[uint32(address)] = true
+	}
+	return f, nil
+}
+
+func (f *traceFilter) match(address []byte) bool {
+	if f == nil {
+		return false
+	}
+	if f.all {
+		return true
+	}
+	if len(address) != 4 {
+		return false
+	}
+	return f.addresses[uint32(address[0])<<24|uint32(address[1])<<16|uint32(address[2])<<8|uint32(address[3])]
 }
 
 func (logs *Logger) logAccount(account *Account) {
-	if logs.followAccount {
+	if traceAccounts.match(account.Address) {
 		logs.printAccount(account)
 	}
 }
 
 func (logs *Logger) printAccount(account *Account) {
-	fmt.Println(colorYellow("ACCOUNT: "))
-	fmt.Println("Address: ", account.Address)
-	fmt.Println("Data: ", account.Data)
-	fmt.Println("State: ", account.State)
-	fmt.Println("schnorrPubKey: ", account.schnorrPubKey)
-	//fmt.Println("blsPubKey: ", account.blsPubKey)
-	//fmt.Println("pop: ", account.pop)
-	fmt.Println("counter: ", account.counter)
-	fmt.Println("Counter: ", account.Counter)
-	fmt.Println("Amount: ", account.Amount)
-	fmt.Println("Modified: ", account.Modified)
-	fmt.Println("isNew: ", account.isNew)
+	traceLogs.info("account",
+		"from", logs.module,
+		"address", account.Address,
+		"amount", account.Amount,
+		"counter", account.Counter,
+		"pubkey", account.schnorrPubKey,
+		"state", account.State,
+		"data", account.Data,
+		"modified", account.Modified,
+		"new", account.isNew,
+	)
 }
 
 func (logs *Logger) logTx(tx *Transaction) {
-	if logs.followTx {
+	if traceTxs.match(tx.source) {
 		logs.printTx(tx)
 	}
 }
 
 func (logs *Logger) printTx(tx *Transaction) {
-	fmt.Println(colorYellow("TX: "))
-	fmt.Println("signature: ", tx.signature)
-	fmt.Println("source: ", tx.source)
-	fmt.Println("target: ", tx.target)
-	fmt.Println("amount: ", tx.amount)
-	fmt.Println("state: ", tx.state)
-	fmt.Println("publickeys: ", tx.publickeys)
-	fmt.Println("blspk: ", tx.blspk)
-	fmt.Println("pop: ", tx.pop)
-	fmt.Println("multisignature: ", tx.multisignature)
-	fmt.Println("batchsize: ", tx.batchsize)
-	fmt.Println("batch: ", tx.batch)
-	fmt.Println("payload: ", tx.payload)
-	fmt.Println("hash: ", tx.hash)
-	fmt.Println("pubkey: ", tx.pubkey)
-	fmt.Println("sourceAmount: ", tx.sourceAmount)
-	fmt.Println("counter: ", tx.counter)
-	fmt.Println("pad: ", tx.pad)
-	fmt.Println("addresses: ", tx.addresses)
-	fmt.Println("Amount: ", tx.Amount)
-	fmt.Println("length: ", tx.length)
-	fmt.Println("isAccountCreator: ", tx.isAccountCreator)
-	fmt.Println("isAccountKeyChanger: ", tx.isAccountKeyChanger)
-	fmt.Println("isContractCreator: ", tx.isContractCreator)
-	fmt.Println("isContract: ", tx.isContract)
-	fmt.Println("isUpdate: ", tx.isUpdate)
-	fmt.Println("isTransfer: ", tx.isTransfer)
-	fmt.Println("isBatch: ", tx.isBatch)
-	fmt.Println("isStake: ", tx.isStake)
-	fmt.Println("isDelegate: ", tx.isDelegate)
-	fmt.Println("isRelease: ", tx.isRelease)
-	fmt.Println("isTransfer: ", tx.isTransfer)
-	fmt.Println("isCollateral: ", tx.isCollateral)
-	fmt.Println("isEvidence: ", tx.isEvidence)
+	traceLogs.info("tx",
+		"from", logs.module,
+		"hash", tx.hash,
+		"version", tx.version,
+		"type", tx.txType,
+		"length", tx.length,
+		"source", tx.source,
+		"target", tx.target,
+		"counter", tx.counter,
+		"amount", tx.Amount,
+		"fee", tx.Fee,
+		"tip", tx.Tip,
+		"validUntil", tx.validUntil,
+		"state", tx.state,
+		"pubkey", tx.pubkey,
+		"blspk", tx.blspk,
+		"pop", tx.pop,
+		"multisignature", tx.multisignature,
+		"payload", tx.payload,
+		"addresses", tx.addresses,
+		"signature", tx.signature,
+		"update", tx.isUpdate,
+		"transfer", tx.isTransfer,
+		"stake", tx.isStake,
+		"delegate", tx.isDelegate,
+		"release", tx.isRelease,
+		"unjail", tx.isUnjail,
+		"contract", tx.isContract,
+		"createAccount", tx.isAccountCreator,
+		"changeKeys", tx.isAccountKeyChanger,
+		"batch", tx.isBatch,
+	)
 }
@@ -2,9 +2,11 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
 
 	"github.com/pkg/errors"
@@ -19,34 +21,141 @@ import (
 	"github.com/tendermint/tendermint/proxy"
 )
 
-var configFile string
+const usage = `usage: kvstore <command> [flags]
 
-func init() {
-	flag.StringVar(&configFile, "config", "$HOME/.tendermint/config/config.toml", "Path to config.toml")
-}
+commands:
+  init              write the tendermint config, keys and a genesis file with an app_state
+  start             run the node (the default when no command is given)
+  unsafe-reset-all  remove the blockchain and application databases
+  export            write the state of the last committed height as a genesis file
+  import            install an exported genesis file on a reset node
+  version           print the software and protocol versions
+
+run "kvstore <command> -h" for the flags of a command
+`
+
+var (
+	configFile        string
+	logLevel          string
+	logFormat         string
+	traceAccountsFlag string
+	traceTxsFlag      string
+)
 
 func main() {
+	//flags without a command start the node, as before the commands existed
+	command, args := "start", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	var err error
+	switch command {
+	case "init":
+		err = initNode(args)
+	case "start":
+		err = start(args)
+	case "unsafe-reset-all":
+		err = resetAll(args)
+	case "export":
+		err = exportGenesisFile(args)
+	case "import":
+		err = importGenesisFile(args)
+	case "version":
+		printVersion()
+	default:
+		fmt.Print(usage)
+		os.Exit(2)
+	}
 
-	app, err := NewApp()
-	//defer app.ndb.Close()
-	//defer app.txCacheDb.Close()
-	defer app.accountLedgerDb.Close()
-	defer app.contractDb.Close()
-	defer app.contractStorageDb.Close()
-	defer app.contractStorageDb2.Close()
-	defer app.accountDb.Close()
-	defer app.txStorageDb.Close()
-	defer app.txStorageDb2.Close()
-	defer app.blockHashDb.Close()
-	defer app.validatorDb.Close()
-
-	flag.Parse()
-	node, err := newTendermint(app, configFile)
 	if err != nil {
-		logs.logError("Failed to start tendermint: ", err)
+		logs.logError("Command "+command+" failed: ", err)
 		os.Exit(2)
 	}
-	node.Start()
+}
+
+// homeFlag registers the -home flag shared by all commands
+func homeFlag(fs *flag.FlagSet) *string {
+	return fs.String("home", os.ExpandEnv("$HOME/.tendermint"), "tendermint home directory")
+}
+
+// homeConfigFile is the config.toml of a home directory
+func homeConfigFile(home string) string {
+	return filepath.Join(home, "config", "config.toml")
+}
+
+func start(args []string) error {
+	fs := flag.NewFlagSet("start", flag.ExitOnError)
+	home := homeFlag(fs)
+	fs.StringVar(&configFile, "config", "", "Path to config.toml, overrides -home")
+	fs.StringVar(&logLevel, "log_level", "", "log level per module, overrides config.toml (e.g. \"checktx:debug,*:info\")")
+	fs.StringVar(&logFormat, "log_format", "", "plain or json, overrides config.toml")
+	fs.StringVar(&traceAccountsFlag, "trace_accounts", "", "comma separated account addresses to trace, all for every account")
+	fs.StringVar(&traceTxsFlag, "trace_txs", "", "comma separated source addresses of the txs to trace, all for every tx")
+	fs.Parse(args)
+
+	if configFile == "" {
+		configFile = homeConfigFile(*home)
+	}
+	config, appConfig, err := loadConfig(configFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to read config")
+	}
+
+	logger, err := newLogger(config)
+	if err != nil {
+		return errors.Wrap(err, "failed to create logger")
+	}
+	setLogger(logger)
+
+	traceAccounts, err = parseTraceFilter(appConfig.TraceAccounts)
+	if err != nil {
+		return errors.Wrap(err, "invalid trace_accounts")
+	}
+	traceTxs, err = parseTraceFilter(appConfig.TraceTxs)
+	if err != nil {
+		return errors.Wrap(err, "invalid trace_txs")
+	}
+
+	app, err := NewApp(appConfig)
+	if err != nil {
+		return errors.Wrap(err, "failed to create the application")
+	}
+	defer app.closeDbs()
+
+	//signatures are bound to the chain id of the genesis file, also on
+	//chains initialized before it was stored
+	genDoc, err := nm.DefaultGenesisDocProviderFunc(config)()
+	if err != nil {
+		return errors.Wrap(err, "failed to read genesis file")
+	}
+	err = app.bindChainID(genDoc.ChainID)
+	if err != nil {
+		return err
+	}
+
+	//app metrics are served next to the tendermint ones
+	if config.Instrumentation.Prometheus {
+		app.metrics, err = newMetrics(config)
+		if err != nil {
+			return errors.Wrap(err, "failed to register metrics")
+		}
+	}
+
+	//a halted node closes its databases before exiting
+	app.onHalt = func() {
+		app.closeDbs()
+		os.Exit(haltExitCode)
+	}
+
+	node, err := newTendermint(app, config, logger)
+	if err != nil {
+		return errors.Wrap(err, "failed to start tendermint")
+	}
+	err = node.Start()
+	if err != nil {
+		return errors.Wrap(err, "failed to start tendermint")
+	}
 	defer func() {
 		node.Stop()
 		node.Wait()
@@ -55,28 +164,75 @@ func main() {
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	<-c
 
-	os.Exit(0)
+	return nil
 }
-func newTendermint(app abci.Application, configFile string) (*nm.Node, error) {
-	// read config
+
+// loadConfig reads the tendermint configuration and the [app] section of
+// the same config.toml
+func loadConfig(configFile string) (*cfg.Config, *AppConfig, error) {
 	config := cfg.DefaultConfig()
-	config.RootDir = filepath.Dir(filepath.Dir(configFile))
 	viper.SetConfigFile(configFile)
 	if err := viper.ReadInConfig(); err != nil {
-		return nil, errors.Wrap(err, "viper failed to read config file")
+		return nil, nil, errors.Wrap(err, "viper failed to read config file")
 	}
 	if err := viper.Unmarshal(config); err != nil {
-		return nil, errors.Wrap(err, "viper failed to unmarshal config")
+		return nil, nil, errors.Wrap(err, "viper failed to unmarshal config")
+	}
+	//every section resolves its paths against the home, not the working directory
+	config.SetRoot(filepath.Dir(filepath.Dir(configFile)))
+	appConfig, err := loadAppConfig(config.RootDir)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "app config is invalid")
+	}
+
+	//command line flags take precedence over the config file
+	if logLevel != "" {
+		config.LogLevel = logLevel
 	}
+	if logFormat != "" {
+		config.LogFormat = logFormat
+	}
+	if traceAccountsFlag != "" {
+		appConfig.TraceAccounts = traceAccountsFlag
+	}
+	if traceTxsFlag != "" {
+		appConfig.TraceTxs = traceTxsFlag
+	}
+
 	if err := config.ValidateBasic(); err != nil {
-		return nil, errors.Wrap(err, "config is invalid")
-	} // create logger
-	logger := log.NewTMLogger(log.NewSyncWriter(os.Stdout))
-	var err error
-	logger, err = tmflags.ParseLogLevel(config.LogLevel, logger, "info")
+		return nil, nil, errors.Wrap(err, "config is invalid")
+	}
+	return config, appConfig, nil
+}
+
+// newLogger creates the logger shared by tendermint and the application,
+// levels are filtered per module
+func newLogger(config *cfg.Config) (log.Logger, error) {
+	var logger log.Logger
+	if config.LogFormat == cfg.LogFormatJSON {
+		logger = log.NewTMJSONLogger(log.NewSyncWriter(os.Stdout))
+	} else {
+		logger = log.NewTMLogger(log.NewSyncWriter(os.Stdout))
+	}
+	logger, err := tmflags.ParseLogLevel(config.LogLevel, logger, "info")
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to parse log level")
-	} // read private validator
+	}
+	return logger, nil
+}
+
+// newMetrics registers the application metrics with the namespace and
+// chain_id label of the tendermint metrics
+func newMetrics(config *cfg.Config) (*Metrics, error) {
+	genDoc, err := nm.DefaultGenesisDocProviderFunc(config)()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read genesis file")
+	}
+	return PrometheusMetrics(config.Instrumentation.Namespace, "chain_id", genDoc.ChainID), nil
+}
+
+func newTendermint(app abci.Application, config *cfg.Config, logger log.Logger) (*nm.Node, error) {
+	// read private validator
 	pv := privval.LoadFilePV(
 		config.PrivValidatorKeyFile(),
 		config.PrivValidatorStateFile(),
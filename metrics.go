@@ -0,0 +1,234 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/go-kit/kit/metrics/prometheus"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+)
+
+// MetricsSubsystem is the subsystem of the application metrics, they are
+// served by the tendermint prometheus endpoint
+const MetricsSubsystem = "app"
+
+// Metrics contains the metrics exposed by the application
+type Metrics struct {
+	// Number of transactions by phase (check, deliver), type and result code.
+	Txs metrics.Counter
+
+	// Ed25519 signature verification time in seconds.
+	SignatureSeconds metrics.Histogram
+
+	// BLS verification time in seconds, by type (pop, batch).
+	BlsSeconds metrics.Histogram
+
+	// Commit time in seconds, by phase (accounts, contracts, txtree, blockhash, total).
+	CommitSeconds metrics.Histogram
+
+	// Number of transactions in the tx cache.
+	TxCacheSize metrics.Gauge
+
+	// Number of accounts and contracts on the trees.
+	Accounts  metrics.Gauge
+	Contracts metrics.Gauge
+
+	// Fees paid to proposers and burned.
+	Tips        metrics.Counter
+	BurnedFees  metrics.Gauge
+	BaseFee     metrics.Gauge
+	BlockBytes  metrics.Gauge
+	TotalPower  metrics.Gauge
+	ActivePower metrics.Gauge
+
+	//false for the no-op metrics, the gauges of the state are not computed
+	enabled bool
+}
+
+// PrometheusMetrics returns Metrics build using Prometheus client library.
+// Optionally, labels can be provided along with their values ("foo",
+// "fooValue").
+func PrometheusMetrics(namespace string, labelsAndValues ...string) *Metrics {
+	labels := []string{}
+	for i := 0; i < len(labelsAndValues); i += 2 {
+		labels = append(labels, labelsAndValues[i])
+	}
+	return &Metrics{
+		Txs: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "txs",
+			Help:      "Number of transactions by phase, type and result code.",
+		}, append(labels, "phase", "type", "code")).With(labelsAndValues...),
+
+		SignatureSeconds: prometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "signature_seconds",
+			Help:      "Ed25519 signature verification time in seconds.",
+			Buckets:   stdprometheus.ExponentialBuckets(0.00001, 2, 12),
+		}, labels).With(labelsAndValues...),
+
+		BlsSeconds: prometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "bls_seconds",
+			Help:      "BLS verification time in seconds.",
+			Buckets:   stdprometheus.ExponentialBuckets(0.0001, 2, 12),
+		}, append(labels, "type")).With(labelsAndValues...),
+
+		CommitSeconds: prometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "commit_seconds",
+			Help:      "Commit time in seconds by phase.",
+			Buckets:   stdprometheus.ExponentialBuckets(0.0001, 2, 16),
+		}, append(labels, "phase")).With(labelsAndValues...),
+
+		TxCacheSize: prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "tx_cache_size",
+			Help:      "Number of checked transactions waiting for delivery.",
+		}, labels).With(labelsAndValues...),
+
+		Accounts: prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "accounts",
+			Help:      "Number of accounts.",
+		}, labels).With(labelsAndValues...),
+
+		Contracts: prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "contracts",
+			Help:      "Number of contracts.",
+		}, labels).With(labelsAndValues...),
+
+		Tips: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "tips",
+			Help:      "Fees paid to block proposers.",
+		}, labels).With(labelsAndValues...),
+
+		BurnedFees: prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "burned_fees",
+			Help:      "Total burned base fees.",
+		}, labels).With(labelsAndValues...),
+
+		BaseFee: prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "base_fee",
+			Help:      "Base fee per transaction byte.",
+		}, labels).With(labelsAndValues...),
+
+		BlockBytes: prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "block_bytes",
+			Help:      "Size of the transactions of the last block.",
+		}, labels).With(labelsAndValues...),
+
+		TotalPower: prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "validator_power",
+			Help:      "Total power of all validators, jailed included.",
+		}, labels).With(labelsAndValues...),
+
+		ActivePower: prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "active_validator_power",
+			Help:      "Total voting power of the validators that are not jailed.",
+		}, labels).With(labelsAndValues...),
+
+		enabled: true,
+	}
+}
+
+// NopMetrics returns no-op Metrics.
+func NopMetrics() *Metrics {
+	return &Metrics{
+		Txs:              discard.NewCounter(),
+		SignatureSeconds: discard.NewHistogram(),
+		BlsSeconds:       discard.NewHistogram(),
+		CommitSeconds:    discard.NewHistogram(),
+		TxCacheSize:      discard.NewGauge(),
+		Accounts:         discard.NewGauge(),
+		Contracts:        discard.NewGauge(),
+		Tips:             discard.NewCounter(),
+		BurnedFees:       discard.NewGauge(),
+		BaseFee:          discard.NewGauge(),
+		BlockBytes:       discard.NewGauge(),
+		TotalPower:       discard.NewGauge(),
+		ActivePower:      discard.NewGauge(),
+	}
+}
+
+// countTx counts a checked or delivered tx by type and result code
+func (m *Metrics) countTx(phase string, tx *Transaction, code uint32) {
+	m.Txs.With("phase", phase, "type", tx.typeName(), "code", strconv.FormatUint(uint64(code), 10)).Add(1)
+}
+
+// observeCommit records the time spent on a commit phase since start
+func (m *Metrics) observeCommit(phase string, start time.Time) {
+	m.CommitSeconds.With("phase", phase).Observe(time.Since(start).Seconds())
+}
+
+// typeName names the type of a parsed tx, "unknown" when no type was selected
+func (tx *Transaction) typeName() string {
+	switch {
+	case tx.isBatch:
+		return "batch"
+	case tx.isAccountCreator:
+		return "create_account"
+	case tx.isAccountKeyChanger:
+		return "change_keys"
+	case tx.isContract:
+		return "contract"
+	case tx.isUnjail:
+		return "unjail"
+	case tx.isDelegate:
+		return "delegate"
+	case tx.isRelease:
+		return "release"
+	case tx.isStake:
+		return "stake"
+	case tx.isTransfer:
+		return "transfer"
+	case tx.isUpdate:
+		return "update"
+	}
+	return "unknown"
+}
+
+// recordState updates the gauges of the committed state, the validator
+// powers take a walk over the validator tree and are skipped without metrics
+func (app *App) recordState() {
+	m := app.metrics
+	if !m.enabled {
+		return
+	}
+	m.TxCacheSize.Set(float64(app.txCache.len()))
+	m.Accounts.Set(float64(app.accountNumOnDb))
+	m.Contracts.Set(float64(app.contractNumOnDb))
+	m.BaseFee.Set(float64(app.baseFee))
+	m.BurnedFees.Set(float64(app.burned))
+	m.BlockBytes.Set(float64(app.blockBytes))
+
+	total, active, err := app.validatorPowers()
+	if err != nil {
+		commitLogs.logError("Failed to sum validator powers: ", err)
+		return
+	}
+	m.TotalPower.Set(float64(total))
+	m.ActivePower.Set(float64(active))
+}
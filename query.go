@@ -0,0 +1,431 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	abcitypes "github.com/tendermint/tendermint/abci/types"
+	"github.com/tendermint/tendermint/proto/tendermint/crypto"
+)
+
+// queryRoutes are the path routes of Query, * matches one segment. Account and
+// contract addresses and counters are decimal, keys are hex. Paths outside
+// these roots keep the legacy dispatch on the length of the data
+var queryRoutes = []queryRoute{
+	{"/account/by-bls/*", false, (*App).routeAccountByBls},
+	{"/account/*", false, (*App).routeAccount},
+	{"/contract/*", false, (*App).routeContract},
+	{"/contract/*/payload/*", false, (*App).routePayload},
+	{"/tx/*/*/proof", true, (*App).routeTxProof},
+	{"/validators", false, (*App).routeValidators},
+	{"/validator/*", false, (*App).routeValidator},
+	{"/unbondings/*", false, (*App).routeUnbondings},
+	{"/feemarket", false, (*App).routeFeeMarket},
+	{"/params", false, (*App).routeParams},
+}
+
+type queryRoute struct {
+	pattern string
+	//tx proofs come from trees that are not versioned
+	latest  bool
+	handler func(app *App, view *stateView, args []string, prove bool) (*queryValue, error)
+}
+
+// queryValue is the answer of a route, raw is the binary encoding and info
+// is marshalled for ?format=json
+type queryValue struct {
+	raw   []byte
+	info  interface{}
+	proof *crypto.ProofOps
+}
+
+// match returns the segments matched by the wildcards of the route
+func (route queryRoute) match(segments []string) ([]string, bool) {
+	pattern := strings.Split(strings.Trim(route.pattern, "/"), "/")
+	if len(pattern) != len(segments) {
+		return nil, false
+	}
+	var args []string
+	for i, p := range pattern {
+		if p == "*" {
+			args = append(args, segments[i])
+		} else if p != segments[i] {
+			return nil, false
+		}
+	}
+	return args, true
+}
+
+// routeQuery answers the queries whose path is under the root of a route,
+// false leaves the query to the legacy dispatch
+func (app *App) routeQuery(view *stateView, reqQuery abcitypes.RequestQuery) (abcitypes.ResponseQuery, bool) {
+	path, rawQuery, _ := strings.Cut(reqQuery.Path, "?")
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+
+	routed := false
+	for _, route := range queryRoutes {
+		routed = routed || strings.HasPrefix(route.pattern, "/"+segments[0]+"/") || route.pattern == "/"+segments[0]
+	}
+	if !routed {
+		return abcitypes.ResponseQuery{}, false
+	}
+
+	options, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return queryResult(reqQuery, errQueryMalformed.wrap("options %q", rawQuery)), true
+	}
+	format := options.Get("format")
+	if format != "" && format != "binary" && format != "json" {
+		return queryResult(reqQuery, errQueryMalformed.wrap("unknown format %q", format)), true
+	}
+
+	for _, route := range queryRoutes {
+		args, ok := route.match(segments)
+		if !ok {
+			continue
+		}
+		if route.latest && !view.latest {
+			return queryResult(reqQuery, errNotHistorical.wrap("%s", path)), true
+		}
+
+		v, err := route.handler(app, view, args, reqQuery.Prove)
+		if err != nil {
+			return queryResult(reqQuery, err), true
+		}
+		value := v.raw
+		if format == "json" {
+			value, err = json.Marshal(v.info)
+			if err != nil {
+				return queryResult(reqQuery, err), true
+			}
+		}
+		queryLogs.debug("Response", "path", path, "value", value)
+		return abcitypes.ResponseQuery{Code: 0, Key: reqQuery.Data, Value: value, ProofOps: v.proof, Height: view.height}, true
+	}
+	return queryResult(reqQuery, errQueryMalformed.wrap("unknown path %s", path)), true
+}
+
+// accountInfo is the json encoding of an account leaf
+type accountInfo struct {
+	Address uint32 `json:"address"`
+	genesisAccount
+}
+
+// contractInfo is the json encoding of a contract and one of its payloads
+type contractInfo struct {
+	Address uint32 `json:"address"`
+	genesisContract
+}
+
+// validatorInfo is the json encoding of a validator leaf
+type validatorInfo struct {
+	Address     string `json:"address"`
+	VotingPower int64  `json:"votingPower"`
+	genesisValidator
+}
+
+// feeMarketInfo is the json encoding of the fee market
+type feeMarketInfo struct {
+	BaseFee uint64 `json:"baseFee"`
+	Burned  uint64 `json:"burned"`
+	Tips    uint64 `json:"tips"`
+}
+
+// txProofInfo is the json encoding of the proof of a tx, the siblings are packed
+type txProofInfo struct {
+	Key           string `json:"key"`
+	Value         string `json:"value"`
+	Root          string `json:"root"`
+	Siblings      string `json:"siblings"`
+	BlockKey      string `json:"blockKey"`
+	BlockValue    string `json:"blockValue"`
+	BlockRoot     string `json:"blockRoot"`
+	BlockSiblings string `json:"blockSiblings"`
+}
+
+// routeAccount returns the account leaf
+func (app *App) routeAccount(view *stateView, args []string, prove bool) (*queryValue, error) {
+	address, err := parseAddress(args[0])
+	if err != nil {
+		return nil, err
+	}
+	data, proof, err := view.get(view.account, "account", address, prove)
+	if err != nil {
+		return nil, err
+	}
+	return accountValue(address, data, proof)
+}
+
+// routeAccountByBls returns the leaf of the account of a bls key, the index is
+// only written with account_watch on
+func (app *App) routeAccountByBls(view *stateView, args []string, prove bool) (*queryValue, error) {
+	key, err := parseHex(args[0], accBlsKeyEnd-accPubKeyEnd)
+	if err != nil {
+		return nil, err
+	}
+	address, err := app.ledgerAddress(app.accountLedgerDb, key)
+	if err != nil {
+		return nil, errQueryNotFound.wrap("bls key %x", key)
+	}
+	data, proof, err := view.get(view.account, "account", address, prove)
+	if err != nil {
+		return nil, err
+	}
+	return accountValue(address, data, proof)
+}
+
+func accountValue(address, data []byte, proof *crypto.ProofOps) (*queryValue, error) {
+	if len(data) < accCounterEnd {
+		return nil, fmt.Errorf("account leaf %x too short", address)
+	}
+	info := &accountInfo{
+		Address: binary.BigEndian.Uint32(address),
+		genesisAccount: genesisAccount{
+			PubKey:    hex.EncodeToString(data[accAmountEnd:accPubKeyEnd]),
+			BlsPubKey: hex.EncodeToString(data[accPubKeyEnd:accBlsKeyEnd]),
+			Balance:   binary.BigEndian.Uint64(data[:accAmountEnd]),
+			Counter:   binary.BigEndian.Uint32(data[accBlsKeyEnd:accCounterEnd]),
+			State:     hex.EncodeToString(data[accCounterEnd:]),
+		},
+	}
+	return &queryValue{raw: data, info: info, proof: proof}, nil
+}
+
+// routeContract returns the counter of a contract followed by its last payload
+func (app *App) routeContract(view *stateView, args []string, prove bool) (*queryValue, error) {
+	address, err := parseAddress(args[0])
+	if err != nil {
+		return nil, err
+	}
+	counter, proof, err := view.get(view.contract, "contract", address, prove)
+	if err != nil {
+		return nil, err
+	}
+	payload := app.storedPayload(address, counter)
+	info := &contractInfo{
+		Address:         binary.BigEndian.Uint32(address),
+		genesisContract: genesisContract{Payload: hex.EncodeToString(payload), Counter: binary.BigEndian.Uint64(counter)},
+	}
+	raw := append(append([]byte{}, counter...), payload...)
+	return &queryValue{raw: raw, info: info, proof: proof}, nil
+}
+
+// routePayload returns the payload written to a contract at a counter, payloads
+// are kept for two tx storage swaps
+func (app *App) routePayload(view *stateView, args []string, prove bool) (*queryValue, error) {
+	address, err := parseAddress(args[0])
+	if err != nil {
+		return nil, err
+	}
+	counter, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return nil, errQueryMalformed.wrap("counter %q", args[1])
+	}
+	last, _, err := view.get(view.contract, "contract", address, false)
+	if err != nil {
+		return nil, err
+	}
+	if counter > binary.BigEndian.Uint64(last) {
+		return nil, errQueryNotFound.wrap("payload %d of contract %s at height %d", counter, args[0], view.height)
+	}
+
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, counter)
+	payload := app.storedPayload(address, key)
+	if payload == nil {
+		return nil, errQueryNotFound.wrap("payload %d of contract %s no longer stored", counter, args[0])
+	}
+	info := &contractInfo{
+		Address:         binary.BigEndian.Uint32(address),
+		genesisContract: genesisContract{Payload: hex.EncodeToString(payload), Counter: counter},
+	}
+	return &queryValue{raw: payload, info: info}, nil
+}
+
+// routeTxProof returns the proof of a tx in the tx tree and of the tx tree root
+// in the block hash tree, in the layout of the 8 byte legacy query
+func (app *App) routeTxProof(view *stateView, args []string, prove bool) (*queryValue, error) {
+	source, err := parseAddress(args[0])
+	if err != nil {
+		return nil, err
+	}
+	counter, err := strconv.ParseUint(args[1], 10, 32)
+	if err != nil {
+		return nil, errQueryMalformed.wrap("counter %q", args[1])
+	}
+	key := make([]byte, 8)
+	copy(key, source)
+	binary.BigEndian.PutUint32(key[4:], uint32(counter))
+
+	p, err := app.proveTx(key)
+	if err != nil {
+		return nil, err
+	}
+	if !p.exists {
+		return nil, errQueryNotFound.wrap("tx %s/%s", args[0], args[1])
+	}
+	info := &txProofInfo{
+		Key:           hex.EncodeToString(p.key),
+		Value:         hex.EncodeToString(p.value),
+		Root:          hex.EncodeToString(p.root),
+		Siblings:      hex.EncodeToString(p.siblings),
+		BlockKey:      hex.EncodeToString(p.blockKey),
+		BlockValue:    hex.EncodeToString(p.blockValue),
+		BlockRoot:     hex.EncodeToString(p.blockRoot),
+		BlockSiblings: hex.EncodeToString(p.blockSiblings),
+	}
+	return &queryValue{raw: p.encode(), info: info}, nil
+}
+
+// routeValidators lists the validator leaves, jailed ones included, as
+// address (20 bytes) | leaf (57 bytes)
+func (app *App) routeValidators(view *stateView, args []string, prove bool) (*queryValue, error) {
+	var raw []byte
+	infos := []validatorInfo{}
+	err := iterateLeaves(view.validator, func(k, d []byte) {
+		v, err := decodeValidator(k, d)
+		if err != nil {
+			return
+		}
+		raw = append(raw, k...)
+		raw = append(raw, v.encode()...)
+		infos = append(infos, newValidatorInfo(k, v))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &queryValue{raw: raw, info: infos}, nil
+}
+
+// routeValidator returns the leaf of a validator by its hex address
+func (app *App) routeValidator(view *stateView, args []string, prove bool) (*queryValue, error) {
+	address, err := parseHex(args[0], 20)
+	if err != nil {
+		return nil, err
+	}
+	data, proof, err := view.get(view.validator, "validator", address, prove)
+	if err != nil {
+		return nil, err
+	}
+	v, err := decodeValidator(address, data)
+	if err != nil {
+		return nil, err
+	}
+	return &queryValue{raw: data, info: newValidatorInfo(address, v), proof: proof}, nil
+}
+
+func newValidatorInfo(address []byte, v *Validator) validatorInfo {
+	return validatorInfo{
+		Address:     hex.EncodeToString(address),
+		VotingPower: v.votingPower(),
+		genesisValidator: genesisValidator{
+			PubKey:      hex.EncodeToString(v.PubKey),
+			Power:       v.Power,
+			Status:      v.Status,
+			JailedUntil: v.JailedUntil,
+			Missed:      v.Missed,
+		},
+	}
+}
+
+// routeUnbondings lists the pending unbondings of an account as maturity
+// height (8 bytes) | validator address (20 bytes) | amount (8 bytes)
+func (app *App) routeUnbondings(view *stateView, args []string, prove bool) (*queryValue, error) {
+	address, err := parseAddress(args[0])
+	if err != nil {
+		return nil, err
+	}
+	raw, err := view.unbondings(address)
+	if err != nil {
+		return nil, err
+	}
+	infos := []genesisUnbonding{}
+	for i := 0; i < len(raw); i += 36 {
+		infos = append(infos, genesisUnbonding{
+			Height:    binary.BigEndian.Uint64(raw[i : i+8]),
+			Account:   binary.BigEndian.Uint32(address),
+			Validator: hex.EncodeToString(raw[i+8 : i+28]),
+			Amount:    binary.BigEndian.Uint64(raw[i+28 : i+36]),
+		})
+	}
+	return &queryValue{raw: raw, info: infos}, nil
+}
+
+// routeFeeMarket returns the base fee per byte, the total burned fees and the
+// tips owed to the next proposer committed at the height, 8 bytes each
+func (app *App) routeFeeMarket(view *stateView, args []string, prove bool) (*queryValue, error) {
+	if len(view.feeMarket) < 16 {
+		return nil, errQueryNotFound.wrap("fee market at height %d", view.height)
+	}
+	info := &feeMarketInfo{
+		BaseFee: binary.BigEndian.Uint64(view.feeMarket[:8]),
+		Burned:  binary.BigEndian.Uint64(view.feeMarket[8:16]),
+	}
+	if len(view.feeMarket) >= 24 {
+		info.Tips = binary.BigEndian.Uint64(view.feeMarket[16:24])
+	}
+	return &queryValue{raw: view.feeMarket, info: info}, nil
+}
+
+// routeParams returns the economic parameters, fixed since genesis
+func (app *App) routeParams(view *stateView, args []string, prove bool) (*queryValue, error) {
+	return &queryValue{raw: app.encodeParams(), info: app.genesisParams()}, nil
+}
+
+// parseAddress reads a decimal account or contract address
+func parseAddress(s string) ([]byte, error) {
+	address, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return nil, errQueryMalformed.wrap("address %q", s)
+	}
+	return addressKey(uint32(address)), nil
+}
+
+// parseHex reads a hex key of the given size, with or without 0x
+func parseHex(s string, size int) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+	if err != nil || len(key) != size {
+		return nil, errQueryMalformed.wrap("key must be %d hex bytes", size)
+	}
+	return key, nil
+}
+
+// txProof is the proof of a tx leaf and of the last block hash leaf
+type txProof struct {
+	key, value, root, siblings                     []byte
+	blockKey, blockValue, blockRoot, blockSiblings []byte
+	exists                                         bool
+}
+
+// proveTx generates the proof of a tx in the tx storage tree holding it
+func (app *App) proveTx(key []byte) (*txProof, error) {
+	app.txDbMutex.Lock()
+	defer app.txDbMutex.Unlock()
+
+	p := &txProof{}
+	var err error
+	p.key, p.value, p.siblings, p.exists, err = app.txStorageTree.GenProof(key)
+	p.root, _ = app.txStorageTree.Root()
+	if err != nil || !p.exists {
+		p.key, p.value, p.siblings, p.exists, err = app.txStorageTree2.GenProof(key)
+		p.root, _ = app.txStorageTree2.Root()
+	}
+	p.blockKey, p.blockValue, p.blockSiblings, _, _ = app.blockHashTree.GenProof(app.blockheight[:]) ////TODO:diff blockheight for tree2
+	p.blockRoot, _ = app.blockHashTree.Root()
+	return p, err
+}
+
+// encode lays the proof out as key | value | root | siblings followed by the
+// same fields of the block hash leaf
+func (p *txProof) encode() []byte {
+	var value []byte
+	for _, field := range [][]byte{p.key, p.value, p.root, p.siblings, p.blockKey, p.blockValue, p.blockRoot, p.blockSiblings} {
+		value = append(value, field...)
+	}
+	return value
+}
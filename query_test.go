@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	abcitypes "github.com/tendermint/tendermint/abci/types"
+)
+
+func TestQueryRoutes(t *testing.T) {
+	accounts := newTestAccounts(t, 2)
+	params := DefaultAppConfig().genesisParams()
+	params.UnbondingBlocks = 10
+	app := newTestApp(t, testGenesis(t, accounts, 1000000, params), accounts[0])
+	valAddr := app.toAddress(accounts[0].pubKey())
+
+	tx, err := accounts[1].signer(t, app).Contract(0, 0, []byte("payload"))
+	require.Nil(t, err)
+	require.Equal(t, uint32(0), commitBlock(t, app, tx)[0].Code)
+	feeMarket := app.encodeFeeMarket()
+	tx, err = accounts[1].signer(t, app).Delegate(accounts[0].address, 100)
+	require.Nil(t, err)
+	require.Equal(t, uint32(0), commitBlock(t, app, tx)[0].Code)
+	tx, err = accounts[1].signer(t, app).Undelegate(accounts[0].address)
+	require.Nil(t, err)
+	require.Equal(t, uint32(0), commitBlock(t, app, tx)[0].Code)
+
+	//released at height 3, mature unbondingBlocks later
+	unbonding := make([]byte, 36)
+	binary.BigEndian.PutUint64(unbonding[:8], 13)
+	copy(unbonding[8:28], valAddr)
+	binary.BigEndian.PutUint64(unbonding[28:], 100)
+
+	tests := []struct {
+		name   string
+		path   string
+		data   []byte
+		height int64
+		code   uint32
+		value  []byte
+	}{
+		{"fee market", "/feemarket", nil, 0, 0, app.encodeFeeMarket()},
+		{"fee market at a past height", "/feemarket", nil, 1, 0, feeMarket},
+		{"unbondings", fmt.Sprintf("/unbondings/%d", accounts[1].address), nil, 0, 0, unbonding},
+		{"unbondings before the undelegation", fmt.Sprintf("/unbondings/%d", accounts[1].address), nil, 2, 0, []byte{}},
+		{"contract", "/contract/0", nil, 0, 0, append(make([]byte, 8), "payload"...)},
+		{"validator", "/validator/" + hex.EncodeToString(valAddr), nil, 0, 0, nil},
+		{"validator of 4 bytes", "/validator/00000000", nil, 0, errQueryMalformed.Code, nil},
+		{"unbondings by data", "/unbondings", addressKey(accounts[1].address), 0, errQueryMalformed.Code, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := app.Query(abcitypes.RequestQuery{Path: tt.path, Data: tt.data, Height: tt.height})
+			require.Equal(t, tt.code, res.Code, res.Log)
+			if tt.value != nil {
+				assert.Equal(t, tt.value, res.Value)
+			}
+		})
+	}
+
+	//the new routes answer in json and prove their leaves
+	res := app.Query(abcitypes.RequestQuery{Path: "/validator/" + hex.EncodeToString(valAddr) + "?format=json", Prove: true})
+	require.Equal(t, uint32(0), res.Code, res.Log)
+	assert.Contains(t, string(res.Value), `"votingPower":1000`)
+	require.NotNil(t, res.ProofOps)
+	assert.Equal(t, "arbo:validator", res.ProofOps.Ops[0].Type)
+}
@@ -0,0 +1,73 @@
+package sdk
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+// Account is the decoded account data returned by the 4 byte account query.
+type Account struct {
+	Balance   uint64
+	PubKey    []byte
+	BlsPubKey []byte
+	Counter   uint32
+	State     []byte
+}
+
+// ParseAccount decodes the account data stored on the account tree.
+func ParseAccount(data []byte) (*Account, error) {
+	if len(data) < 92 {
+		return nil, errors.New("account not found")
+	}
+	account := &Account{
+		Balance:   binary.BigEndian.Uint64(data[:8]),
+		PubKey:    data[8:40],
+		BlsPubKey: data[40:88],
+		Counter:   binary.BigEndian.Uint32(data[88:92]),
+	}
+	if len(data) > 92 {
+		account.State = data[92:]
+	}
+	return account, nil
+}
+
+// AddressQuery returns the query data for the account with the given address.
+func AddressQuery(address uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], address)
+	return b[:]
+}
+
+// FeeMarketPath is the query path returning the base fee per byte, the total
+// burned fees and the tips owed to the next proposer, 8 bytes big endian each.
+const FeeMarketPath = "/feemarket"
+
+// UnbondingsPath returns the query path listing the pending unbondings of the
+// account with the given address.
+func UnbondingsPath(address uint32) string {
+	return "/unbondings/" + strconv.FormatUint(uint64(address), 10)
+}
+
+// Unbonding is released stake waiting for its maturity height.
+type Unbonding struct {
+	MatureHeight uint64
+	Validator    []byte
+	Amount       uint64
+}
+
+// ParseUnbondings decodes the response of the unbondings query.
+func ParseUnbondings(data []byte) ([]Unbonding, error) {
+	if len(data)%36 != 0 {
+		return nil, errors.New("invalid unbondings response")
+	}
+	unbondings := make([]Unbonding, 0, len(data)/36)
+	for i := 0; i < len(data); i += 36 {
+		unbondings = append(unbondings, Unbonding{
+			MatureHeight: binary.BigEndian.Uint64(data[i : i+8]),
+			Validator:    data[i+8 : i+28],
+			Amount:       binary.BigEndian.Uint64(data[i+28 : i+36]),
+		})
+	}
+	return unbondings, nil
+}
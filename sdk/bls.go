@@ -0,0 +1,77 @@
+package sdk
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+
+	blst "github.com/supranational/blst/bindings/go"
+	"golang.org/x/crypto/sha3"
+)
+
+// BlsDst is the domain separation tag used by the node for BLS signatures.
+var BlsDst = []byte("BLS_SIG_BLS12381G2_XMD:SHA-256_SSWU_RO_NUL_")
+
+// Sizes of the compressed BLS12-381 public key and signature.
+const (
+	BlsPubKeySize    = 48
+	BlsSignatureSize = 96
+)
+
+// BlsKey is a BLS12-381 secret key, public keys live in G1 and signatures in G2.
+type BlsKey struct {
+	sk *blst.SecretKey
+}
+
+// GenerateBlsKey derives a key from 32 bytes of input keying material,
+// a random one is used when ikm is nil.
+func GenerateBlsKey(ikm []byte) (*BlsKey, error) {
+	if ikm == nil {
+		ikm = make([]byte, 32)
+		if _, err := rand.Read(ikm); err != nil {
+			return nil, err
+		}
+	}
+	sk := blst.KeyGen(ikm)
+	if sk == nil {
+		return nil, errors.New("bls key generation needs at least 32 bytes")
+	}
+	return &BlsKey{sk: sk}, nil
+}
+
+// BlsKeyFromBytes loads a key serialized with Bytes.
+func BlsKeyFromBytes(b []byte) (*BlsKey, error) {
+	sk := new(blst.SecretKey).Deserialize(b)
+	if sk == nil {
+		return nil, errors.New("invalid bls secret key")
+	}
+	return &BlsKey{sk: sk}, nil
+}
+
+// Bytes serializes the secret key.
+func (k *BlsKey) Bytes() []byte {
+	return k.sk.Serialize()
+}
+
+// PubKey returns the compressed public key.
+func (k *BlsKey) PubKey() []byte {
+	return new(blst.P1Affine).From(k.sk).Compress()
+}
+
+// Sign returns the compressed signature of msg.
+func (k *BlsKey) Sign(msg []byte) []byte {
+	return new(blst.P2Affine).Sign(k.sk, msg, BlsDst).Compress()
+}
+
+// Pop returns the proof of possession of the key for a transaction of the
+// given source account and counter: a signature of sha3-256(pk || source || counter).
+func (k *BlsKey) Pop(source, counter uint32) []byte {
+	var sc [8]byte
+	binary.BigEndian.PutUint32(sc[:4], source)
+	binary.BigEndian.PutUint32(sc[4:], counter)
+
+	h := sha3.New256()
+	h.Write(k.PubKey())
+	h.Write(sc[:])
+	return k.Sign(h.Sum(nil))
+}
@@ -0,0 +1,142 @@
+// Package sdk builds and signs zkSpace transactions.
+//
+// A transaction is a 64 byte ed25519 signature followed by the signed data.
+// The signed data of the versioned format starts with a header, followed by
+// a body that always begins with the 4 byte source address:
+//
+//	FormatV1: version (0xF1) | type tag | valid until (8 bytes) | tip (8 bytes) | body
+//
+// Legacy transactions have no header and the node infers their type from
+// the total size.
+//
+// The signature is computed over
+//
+//	sha256(sha256(data) || counter || chainID)
+//
+// where data is everything after the signature, counter is the current 4
+// byte big endian counter of the source account (bytes 88:92 of the account
+// data) and chainID is the chain id of the genesis file as raw bytes. The
+// counter grows by one with every delivered transaction of the account.
+// Legacy transactions are signed with an empty chain id and can be replayed
+// on other networks, the node rejects them from its legacy cutoff height on.
+//
+// The valid until height is big endian, a transaction is rejected in blocks
+// above it. Zero never expires.
+//
+// The fee of a transaction is base fee * transaction size + tip. The base fee
+// is burned and follows the size of the blocks, the tip goes to the block
+// proposer and orders the mempool. The current base fee is returned by the
+// FeeMarketPath query.
+package sdk
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+// FormatV1 is the version byte of the versioned transaction format.
+const FormatV1 byte = 0xF1
+
+// HeaderSize is the size of the header of the versioned format.
+const HeaderSize = 18
+
+// Type tags of the versioned format.
+const (
+	TypeUpdate byte = iota + 1
+	TypeRelease
+	TypeStake
+	TypeDelegate
+	TypeTransfer
+	TypeCreateAccount
+	TypeChangeKeys
+	TypeContract
+	TypeBatch
+	TypeUnjail
+)
+
+// SignatureSize is the size of the ed25519 signature prefixing every transaction.
+const SignatureSize = 64
+
+// legacy sizes of the fixed size transactions, a legacy contract or batch
+// with one of these sizes would be parsed as the wrong type
+var legacyFixedSizes = []int{68, 72, 74, 76, 100, 108, 244, 248}
+
+// Signer builds transactions on behalf of one source account.
+type Signer struct {
+	// Key is the ed25519 key registered on the source account.
+	Key ed25519.PrivateKey
+	// Source is the address of the account.
+	Source uint32
+	// Counter is the current counter of the account.
+	Counter uint32
+	// ChainID binds versioned transactions to one network.
+	ChainID string
+	// ValidUntil is the last height a versioned transaction can be included
+	// at, zero never expires.
+	ValidUntil uint64
+	// Tip is paid to the proposer on top of the base fee.
+	Tip uint64
+	// Legacy selects the length based format instead of the versioned one.
+	Legacy bool
+}
+
+// NewSigner returns a signer using the versioned format of the given chain.
+func NewSigner(key ed25519.PrivateKey, source, counter uint32, chainID string) *Signer {
+	return &Signer{Key: key, Source: source, Counter: counter, ChainID: chainID}
+}
+
+// Hash returns the message signed for the given data, account counter and
+// chain id, which is empty for legacy transactions.
+func Hash(data []byte, counter uint32, chainID string) []byte {
+	h := sha256.Sum256(data)
+	var c [4]byte
+	binary.BigEndian.PutUint32(c[:], counter)
+	msg := append(h[:], c[:]...)
+	msg = append(msg, chainID...)
+	sum := sha256.Sum256(msg)
+	return sum[:]
+}
+
+// Sign prefixes the body with the header of the selected format and signs it.
+// The body must start with the source address.
+func (s *Signer) Sign(txType byte, body []byte) ([]byte, error) {
+	if len(s.Key) != ed25519.PrivateKeySize {
+		return nil, errors.New("invalid ed25519 private key")
+	}
+
+	data := body
+	chainID := ""
+	if !s.Legacy {
+		var header [HeaderSize]byte
+		header[0] = FormatV1
+		header[1] = txType
+		binary.BigEndian.PutUint64(header[2:10], s.ValidUntil)
+		binary.BigEndian.PutUint64(header[10:], s.Tip)
+		data = append(header[:], body...)
+		chainID = s.ChainID
+	} else if txType == TypeContract || txType == TypeBatch {
+		for _, size := range legacyFixedSizes {
+			if SignatureSize+len(body) == size {
+				return nil, errors.New("legacy transaction size collides with a fixed size type")
+			}
+		}
+	}
+
+	sig := ed25519.Sign(s.Key, Hash(data, s.Counter, chainID))
+	return append(sig, data...), nil
+}
+
+// body starts a transaction body with the source address
+func (s *Signer) body(size int) []byte {
+	b := make([]byte, 4, size)
+	binary.BigEndian.PutUint32(b, s.Source)
+	return b
+}
+
+func putUint32(b []byte, v uint32) []byte {
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], v)
+	return append(b, n[:]...)
+}
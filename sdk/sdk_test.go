@@ -0,0 +1,128 @@
+package sdk
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	blst "github.com/supranational/blst/bindings/go"
+	"golang.org/x/crypto/sha3"
+)
+
+func testSigner(t *testing.T, legacy bool) *Signer {
+	_, key, err := ed25519.GenerateKey(nil)
+	require.Nil(t, err)
+	s := NewSigner(key, 7, 3, "test-chain")
+	s.Legacy = legacy
+	return s
+}
+
+func TestLegacySizes(t *testing.T) {
+	s := testSigner(t, true)
+	bls, err := GenerateBlsKey(nil)
+	require.Nil(t, err)
+	pub := s.Key.Public().(ed25519.PublicKey)
+
+	tx, err := s.Release()
+	require.Nil(t, err)
+	assert.Equal(t, 68, len(tx))
+
+	tx, err = s.Stake(10)
+	require.Nil(t, err)
+	assert.Equal(t, 72, len(tx))
+
+	tx, err = s.Delegate(1, 10)
+	require.Nil(t, err)
+	assert.Equal(t, 74, len(tx))
+
+	tx, err = s.Transfer(1, 10)
+	require.Nil(t, err)
+	assert.Equal(t, 76, len(tx))
+
+	tx, err = s.Update([32]byte{})
+	require.Nil(t, err)
+	assert.Equal(t, 100, len(tx))
+
+	tx, err = s.TransferWithState(1, 10, [32]byte{})
+	require.Nil(t, err)
+	assert.Equal(t, 108, len(tx))
+
+	tx, err = s.ChangeKeys(pub, bls)
+	require.Nil(t, err)
+	assert.Equal(t, 244, len(tx))
+
+	tx, err = s.CreateAccount(10, pub, bls)
+	require.Nil(t, err)
+	assert.Equal(t, 248, len(tx))
+
+	_, err = s.Contract(1, 0, make([]byte, 100-77))
+	assert.NotNil(t, err)
+}
+
+func TestSignature(t *testing.T) {
+	s := testSigner(t, false)
+	tx, err := s.Transfer(1, 10)
+	require.Nil(t, err)
+
+	data := tx[SignatureSize:]
+	assert.Equal(t, FormatV1, data[0])
+	assert.Equal(t, TypeTransfer, data[1])
+	assert.Equal(t, uint64(0), binary.BigEndian.Uint64(data[2:10]))
+	assert.Equal(t, s.Source, binary.BigEndian.Uint32(data[HeaderSize:HeaderSize+4]))
+
+	pub := s.Key.Public().(ed25519.PublicKey)
+	assert.True(t, ed25519.Verify(pub, Hash(data, s.Counter, s.ChainID), tx[:SignatureSize]))
+	assert.False(t, ed25519.Verify(pub, Hash(data, s.Counter+1, s.ChainID), tx[:SignatureSize]))
+	assert.False(t, ed25519.Verify(pub, Hash(data, s.Counter, "other-chain"), tx[:SignatureSize]))
+}
+
+func TestSignatureLegacy(t *testing.T) {
+	s := testSigner(t, true)
+	tx, err := s.Transfer(1, 10)
+	require.Nil(t, err)
+
+	data := tx[SignatureSize:]
+	assert.Equal(t, s.Source, binary.BigEndian.Uint32(data[:4]))
+
+	pub := s.Key.Public().(ed25519.PublicKey)
+	assert.True(t, ed25519.Verify(pub, Hash(data, s.Counter, ""), tx[:SignatureSize]))
+	assert.False(t, ed25519.Verify(pub, Hash(data, s.Counter, s.ChainID), tx[:SignatureSize]))
+}
+
+func TestHeader(t *testing.T) {
+	s := testSigner(t, false)
+	s.ValidUntil = 1234
+	s.Tip = 56
+	tx, err := s.Stake(10)
+	require.Nil(t, err)
+
+	assert.Equal(t, uint64(1234), binary.BigEndian.Uint64(tx[SignatureSize+2:SignatureSize+10]))
+	assert.Equal(t, uint64(56), binary.BigEndian.Uint64(tx[SignatureSize+10:SignatureSize+18]))
+}
+
+func TestPop(t *testing.T) {
+	s := testSigner(t, false)
+	bls, err := GenerateBlsKey(nil)
+	require.Nil(t, err)
+
+	tx, err := s.CreateAccount(10, s.Key.Public().(ed25519.PublicKey), bls)
+	require.Nil(t, err)
+
+	//offsets as read by the node after the header
+	body := tx[SignatureSize+HeaderSize:]
+	blspk := body[40:88]
+	pop := body[88:]
+	assert.Equal(t, bls.PubKey(), blspk)
+
+	h := sha3.New256()
+	h.Write(blspk)
+	h.Write(body[:4])
+	h.Write([]byte{0, 0, 0, 3})
+	assert.True(t, new(blst.P2Affine).VerifyCompressed(pop, true, blspk, true, h.Sum(nil), BlsDst))
+
+	restored, err := BlsKeyFromBytes(bls.Bytes())
+	require.Nil(t, err)
+	assert.Equal(t, bls.PubKey(), restored.PubKey())
+}
@@ -0,0 +1,140 @@
+package sdk
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+)
+
+// Transfer moves amount to the target account.
+func (s *Signer) Transfer(target, amount uint32) ([]byte, error) {
+	b := s.body(12)
+	b = putUint32(b, target)
+	b = putUint32(b, amount)
+	return s.Sign(TypeTransfer, b)
+}
+
+// TransferWithState moves amount to the target account and sets the state of the source.
+func (s *Signer) TransferWithState(target, amount uint32, state [32]byte) ([]byte, error) {
+	b := s.body(44)
+	b = putUint32(b, target)
+	b = putUint32(b, amount)
+	b = append(b, state[:]...)
+	return s.Sign(TypeTransfer, b)
+}
+
+// Update sets the 32 byte state of the source account.
+func (s *Signer) Update(state [32]byte) ([]byte, error) {
+	b := s.body(36)
+	b = append(b, state[:]...)
+	return s.Sign(TypeUpdate, b)
+}
+
+// Stake bonds amount to the validator key of the source account.
+func (s *Signer) Stake(amount uint32) ([]byte, error) {
+	b := s.body(8)
+	b = putUint32(b, amount)
+	return s.Sign(TypeStake, b)
+}
+
+// Release unbonds the stake of the source account.
+func (s *Signer) Release() ([]byte, error) {
+	return s.Sign(TypeRelease, s.body(4))
+}
+
+// Undelegate releases the delegation to the validator whose key is registered
+// on the target account, together with its rewards. Only the versioned format
+// can carry it, a legacy release of this size is a stake.
+func (s *Signer) Undelegate(validator uint32) ([]byte, error) {
+	if s.Legacy {
+		return nil, errors.New("undelegation needs the versioned format")
+	}
+	b := s.body(8)
+	b = putUint32(b, validator)
+	return s.Sign(TypeRelease, b)
+}
+
+// Unjail returns the jailed validator of the source account to the active set
+// once its jail time is over. Only the versioned format can carry it.
+func (s *Signer) Unjail() ([]byte, error) {
+	if s.Legacy {
+		return nil, errors.New("unjail needs the versioned format")
+	}
+	return s.Sign(TypeUnjail, s.body(4))
+}
+
+// Delegate bonds amount to the validator whose key is registered on the target account.
+func (s *Signer) Delegate(validator uint32, amount uint16) ([]byte, error) {
+	b := s.body(10)
+	b = putUint32(b, validator)
+	var a [2]byte
+	binary.BigEndian.PutUint16(a[:], amount)
+	b = append(b, a[:]...)
+	return s.Sign(TypeDelegate, b)
+}
+
+// CreateAccount creates a new account funded with amount from the source account.
+// The proof of possession of the BLS key is bound to the source account and counter.
+func (s *Signer) CreateAccount(amount uint32, pubKey ed25519.PublicKey, bls *BlsKey) ([]byte, error) {
+	if len(pubKey) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid ed25519 public key")
+	}
+	b := s.body(184)
+	b = putUint32(b, amount)
+	b = append(b, pubKey...)
+	b = append(b, bls.PubKey()...)
+	b = append(b, bls.Pop(s.Source, s.Counter)...)
+	return s.Sign(TypeCreateAccount, b)
+}
+
+// ChangeKeys replaces the ed25519 and BLS keys of the source account.
+// The transaction is signed with the current key.
+func (s *Signer) ChangeKeys(pubKey ed25519.PublicKey, bls *BlsKey) ([]byte, error) {
+	if len(pubKey) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid ed25519 public key")
+	}
+	b := s.body(180)
+	b = append(b, pubKey...)
+	b = append(b, bls.PubKey()...)
+	b = append(b, bls.Pop(s.Source, s.Counter)...)
+	return s.Sign(TypeChangeKeys, b)
+}
+
+// Contract writes payload to the target contract, a target beyond the
+// existing contracts creates a new one.
+func (s *Signer) Contract(target, amount uint32, payload []byte) ([]byte, error) {
+	b := s.body(13 + len(payload))
+	b = putUint32(b, amount)
+	b = append(b, 0)
+	b = putUint32(b, target)
+	b = append(b, payload...)
+	return s.Sign(TypeContract, b)
+}
+
+// Batch applies state to every participant, which pays amount to the source
+// account. multisig is the aggregate BLS signature of the participants over
+// state || maxHeight, in the 64 byte slot the node reads it from.
+func (s *Signer) Batch(amount uint32, multisig []byte, state [32]byte, maxHeight uint64, participants []uint32) ([]byte, error) {
+	if len(multisig) != 64 {
+		return nil, errors.New("multisignature must be 64 bytes")
+	}
+	if len(participants) == 0 {
+		return nil, errors.New("batch without participants")
+	}
+
+	b := s.body(113 + 4*(len(participants)+1))
+	b = putUint32(b, amount)
+	b = append(b, 2)
+	b = append(b, multisig...)
+	b = append(b, state[:]...)
+	var h [8]byte
+	binary.BigEndian.PutUint64(h[:], maxHeight)
+	b = append(b, h[:]...)
+	for _, p := range participants {
+		b = putUint32(b, p)
+	}
+
+	//the node ignores the last 4 bytes of the address list
+	b = append(b, 0, 0, 0, 0)
+	return s.Sign(TypeBatch, b)
+}
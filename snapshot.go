@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	abcitypes "github.com/tendermint/tendermint/abci/types"
+	"github.com/vocdoni/arbo"
+)
+
+// snapshot parameters
+const (
+	snapshotFormat    uint32 = 7
+	snapshotChunkSize int    = 4 << 20
+)
+
+// key prefixes of the snapshot database
+var (
+	snapshotPrefix = []byte("s/")
+	chunkPrefix    = []byte("c/")
+)
+
+// snapshotRestore keeps the snapshot offered by tendermint during state sync
+// together with the chunks received so far
+type snapshotRestore struct {
+	snapshot *abcitypes.Snapshot
+	appHash  []byte
+	chunks   [][]byte
+	received uint32
+}
+
+func snapshotKey(height uint64) []byte {
+	key := make([]byte, len(snapshotPrefix)+8)
+	copy(key, snapshotPrefix)
+	binary.BigEndian.PutUint64(key[len(snapshotPrefix):], height)
+	return key
+}
+
+func chunkKey(height uint64, index uint32) []byte {
+	key := make([]byte, len(chunkPrefix)+12)
+	copy(key, chunkPrefix)
+	binary.BigEndian.PutUint64(key[len(chunkPrefix):], height)
+	binary.BigEndian.PutUint32(key[len(chunkPrefix)+8:], index)
+	return key
+}
+
+// snapshotTrees returns the trees contained in a snapshot, in serialization order
+func (app *App) snapshotTrees() []*arbo.Tree {
+	return []*arbo.Tree{app.accountTree, app.contractTree, app.validatorTree, app.delegationTree, app.unbondingTree, app.blockHashTree}
+}
+
+// takeSnapshot captures read only views of the committed trees and of the
+// front tx storage tree, then serializes them in the background. The nodes of
+// a tree root are never modified afterwards, the tx storage is cleared no
+// sooner than txStorageSwapBlocks later.
+func (app *App) takeSnapshot() {
+	trees := append(app.snapshotTrees(), app.txStorageTree)
+	for i, tree := range trees {
+		snapshot, err := tree.Snapshot(nil)
+		if err != nil {
+			commitLogs.logError("Failed to get tree snapshot: ", err)
+			return
+		}
+		trees[i] = snapshot
+	}
+
+	go app.createSnapshot(uint64(app.blockHeight), app.snapshotHeader(), trees)
+}
+
+// snapshotHeader serializes the parameters, chain id and fee market, which
+// are not part of the trees
+func (app *App) snapshotHeader() []byte {
+	var header bytes.Buffer
+	writeSized(&header, app.encodeParams())
+	writeSized(&header, app.chainID)
+	writeSized(&header, app.encodeFeeMarket())
+	return header.Bytes()
+}
+
+// writeSized writes b prefixed with its 8 byte length
+func writeSized(buf *bytes.Buffer, b []byte) {
+	var size [8]byte
+	binary.BigEndian.PutUint64(size[:], uint64(len(b)))
+	buf.Write(size[:])
+	buf.Write(b)
+}
+
+// readSized reads a length prefixed field and returns it with the rest of the blob
+func readSized(blob []byte) ([]byte, []byte, error) {
+	if len(blob) < 8 {
+		return nil, nil, errors.New("snapshot truncated")
+	}
+	size := binary.BigEndian.Uint64(blob[:8])
+	blob = blob[8:]
+	if uint64(len(blob)) < size {
+		return nil, nil, errors.New("snapshot truncated")
+	}
+	return blob[:size], blob[size:], nil
+}
+
+func (app *App) createSnapshot(height uint64, header []byte, trees []*arbo.Tree) {
+	app.snapshotMutex.Lock()
+	defer app.snapshotMutex.Unlock()
+
+	commitLogs.dlog("Creating snapshot at height: ", height)
+
+	//serialize header and tree dumps
+	var buf bytes.Buffer
+	buf.Write(header)
+	for _, tree := range trees {
+		dump, err := tree.Dump(nil)
+		if err != nil {
+			commitLogs.logError("Failed to dump tree for snapshot: ", err)
+			return
+		}
+		writeSized(&buf, dump)
+	}
+	blob := buf.Bytes()
+
+	//split in chunks and keep the hash of every chunk as metadata
+	wSn := app.snapshotDb.WriteTx()
+	defer wSn.Discard()
+
+	var metadata []byte
+	chunks := uint32(0)
+	for start := 0; start < len(blob); start += snapshotChunkSize {
+		end := start + snapshotChunkSize
+		if end > len(blob) {
+			end = len(blob)
+		}
+		chunk := blob[start:end]
+		metadata = append(metadata, app.sha2(chunk)...)
+
+		err := wSn.Set(chunkKey(height, chunks), chunk)
+		if err != nil {
+			commitLogs.logError("Failed to store snapshot chunk: ", err)
+			return
+		}
+		chunks++
+	}
+
+	var info [8]byte
+	binary.BigEndian.PutUint32(info[:4], snapshotFormat)
+	binary.BigEndian.PutUint32(info[4:], chunks)
+	value := append(info[:], app.sha2(blob)...)
+	value = append(value, metadata...)
+
+	err := wSn.Set(snapshotKey(height), value)
+	if err != nil {
+		commitLogs.logError("Failed to store snapshot: ", err)
+		return
+	}
+
+	err = wSn.Commit()
+	if err != nil {
+		commitLogs.logError("Failed to commit snapshot: ", err)
+		return
+	}
+
+	app.pruneSnapshots()
+}
+
+// pruneSnapshots deletes all but the most recent snapshots
+func (app *App) pruneSnapshots() {
+	snapshots := app.loadSnapshots()
+	if len(snapshots) <= app.snapshotKeepRecent {
+		return
+	}
+
+	wSn := app.snapshotDb.WriteTx()
+	defer wSn.Discard()
+
+	for _, s := range snapshots[:len(snapshots)-app.snapshotKeepRecent] {
+		for i := uint32(0); i < s.Chunks; i++ {
+			if err := wSn.Delete(chunkKey(s.Height, i)); err != nil {
+				commitLogs.logError("Failed to delete snapshot chunk: ", err)
+				return
+			}
+		}
+		if err := wSn.Delete(snapshotKey(s.Height)); err != nil {
+			commitLogs.logError("Failed to delete snapshot: ", err)
+			return
+		}
+	}
+
+	if err := wSn.Commit(); err != nil {
+		commitLogs.logError("Failed to prune snapshots: ", err)
+	}
+}
+
+// loadSnapshots returns the stored snapshots in ascending height order
+func (app *App) loadSnapshots() []*abcitypes.Snapshot {
+	var snapshots []*abcitypes.Snapshot
+	err := app.snapshotDb.Iterate(snapshotPrefix, func(key, value []byte) bool {
+		if len(value) < 40 {
+			return true
+		}
+		metadata := make([]byte, len(value)-40)
+		copy(metadata, value[40:])
+		hash := make([]byte, 32)
+		copy(hash, value[8:40])
+
+		snapshots = append(snapshots, &abcitypes.Snapshot{
+			Height:   binary.BigEndian.Uint64(key[len(snapshotPrefix):]),
+			Format:   binary.BigEndian.Uint32(value[:4]),
+			Chunks:   binary.BigEndian.Uint32(value[4:8]),
+			Hash:     hash,
+			Metadata: metadata,
+		})
+		return true
+	})
+	if err != nil {
+		commitLogs.logError("Failed to iterate snapshots: ", err)
+	}
+	return snapshots
+}
+
+func (app *App) ListSnapshots(req abcitypes.RequestListSnapshots) abcitypes.ResponseListSnapshots {
+	return abcitypes.ResponseListSnapshots{Snapshots: app.loadSnapshots()}
+}
+
+func (app *App) LoadSnapshotChunk(req abcitypes.RequestLoadSnapshotChunk) abcitypes.ResponseLoadSnapshotChunk {
+	if req.Format != snapshotFormat {
+		return abcitypes.ResponseLoadSnapshotChunk{}
+	}
+
+	rSn := app.snapshotDb.ReadTx()
+	defer rSn.Discard()
+
+	chunk, err := rSn.Get(chunkKey(req.Height, req.Chunk))
+	if err != nil {
+		commitLogs.logError("Failed to load snapshot chunk: ", err)
+		return abcitypes.ResponseLoadSnapshotChunk{}
+	}
+
+	return abcitypes.ResponseLoadSnapshotChunk{Chunk: chunk}
+}
+
+func (app *App) OfferSnapshot(req abcitypes.RequestOfferSnapshot) abcitypes.ResponseOfferSnapshot {
+	snapshot := req.Snapshot
+	if snapshot == nil {
+		return abcitypes.ResponseOfferSnapshot{Result: abcitypes.ResponseOfferSnapshot_REJECT}
+	}
+
+	if snapshot.Format != snapshotFormat {
+		return abcitypes.ResponseOfferSnapshot{Result: abcitypes.ResponseOfferSnapshot_REJECT_FORMAT}
+	}
+
+	//every chunk must have its hash in the metadata
+	if snapshot.Chunks == 0 || len(snapshot.Metadata) != int(snapshot.Chunks)*32 {
+		return abcitypes.ResponseOfferSnapshot{Result: abcitypes.ResponseOfferSnapshot_REJECT}
+	}
+
+	app.restore = &snapshotRestore{
+		snapshot: snapshot,
+		appHash:  req.AppHash,
+		chunks:   make([][]byte, snapshot.Chunks),
+	}
+
+	commitLogs.dlog("Accepted snapshot at height: ", snapshot.Height)
+	return abcitypes.ResponseOfferSnapshot{Result: abcitypes.ResponseOfferSnapshot_ACCEPT}
+}
+
+func (app *App) ApplySnapshotChunk(req abcitypes.RequestApplySnapshotChunk) abcitypes.ResponseApplySnapshotChunk {
+	restore := app.restore
+	if restore == nil || req.Index >= restore.snapshot.Chunks {
+		return abcitypes.ResponseApplySnapshotChunk{Result: abcitypes.ResponseApplySnapshotChunk_ABORT}
+	}
+
+	//verify the chunk against its hash in the metadata
+	expected := restore.snapshot.Metadata[req.Index*32 : (req.Index+1)*32]
+	if !bytes.Equal(app.sha2(req.Chunk), expected) {
+		commitLogs.dlog("Bad snapshot chunk: ", req.Index)
+		return abcitypes.ResponseApplySnapshotChunk{
+			Result:        abcitypes.ResponseApplySnapshotChunk_RETRY,
+			RefetchChunks: []uint32{req.Index},
+			RejectSenders: []string{req.Sender},
+		}
+	}
+
+	if restore.chunks[req.Index] == nil {
+		restore.received++
+	}
+	restore.chunks[req.Index] = req.Chunk
+
+	if restore.received < restore.snapshot.Chunks {
+		return abcitypes.ResponseApplySnapshotChunk{Result: abcitypes.ResponseApplySnapshotChunk_ACCEPT}
+	}
+
+	//all chunks are here, rebuild the state
+	blob := bytes.Join(restore.chunks, nil)
+	if !bytes.Equal(app.sha2(blob), restore.snapshot.Hash) {
+		commitLogs.log("Snapshot hash mismatch")
+		app.restore = nil
+		return abcitypes.ResponseApplySnapshotChunk{Result: abcitypes.ResponseApplySnapshotChunk_REJECT_SNAPSHOT}
+	}
+
+	err := app.restoreSnapshot(blob, restore)
+	app.restore = nil
+	if err != nil {
+		//the trees are no longer empty, another snapshot can not be applied
+		commitLogs.logError("Failed to restore snapshot: ", err)
+		return abcitypes.ResponseApplySnapshotChunk{Result: abcitypes.ResponseApplySnapshotChunk_ABORT}
+	}
+
+	return abcitypes.ResponseApplySnapshotChunk{Result: abcitypes.ResponseApplySnapshotChunk_ACCEPT}
+}
+
+// restoreSnapshot imports the tree dumps of a snapshot and checks the resulting
+// roots against the app hash trusted by the light client, the tx storage tree
+// through the block hash of the height. Counters and ledgers are rebuilt from
+// the verified trees, contract payloads are not part of a snapshot
+func (app *App) restoreSnapshot(blob []byte, restore *snapshotRestore) error {
+	params, blob, err := readSized(blob)
+	if err != nil {
+		return err
+	}
+	chainID, blob, err := readSized(blob)
+	if err != nil {
+		return err
+	}
+	feeMarket, blob, err := readSized(blob)
+	if err != nil {
+		return err
+	}
+
+	//the storage databases go where swapDb left them at the height, a swap
+	//moves the tx storage tree of the block to the back
+	app.blockHeight = int64(restore.snapshot.Height)
+	binary.BigEndian.PutUint64(app.blockheight[:], restore.snapshot.Height)
+	app.orderStorageDbs()
+	txTree := app.txStorageTree
+	if restore.snapshot.Height%txStorageSwapBlocks == 0 {
+		txTree = app.txStorageTree2
+	}
+
+	for _, tree := range append(app.snapshotTrees(), txTree) {
+		var dump []byte
+		dump, blob, err = readSized(blob)
+		if err != nil {
+			return err
+		}
+		err = tree.ImportDump(dump)
+		if err != nil {
+			return err
+		}
+	}
+	if len(blob) != 0 {
+		return errors.New("snapshot has trailing bytes")
+	}
+
+	//the fee market is part of the app hash
+	err = app.decodeFeeMarket(feeMarket)
+	if err != nil {
+		return err
+	}
+	appHash, err := app.computeAppHash()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(appHash, restore.appHash) {
+		return errors.New("restored state does not match the trusted app hash")
+	}
+	_, blockRoot, err := app.blockHashTree.Get(app.blockheight[:])
+	if err != nil {
+		return err
+	}
+	txRoot, err := txTree.Root()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(blockRoot, txRoot) {
+		return errors.New("restored tx storage does not match the block hash")
+	}
+
+	//the indexes of the delegations and unbondings are not part of the dump
+	err = app.indexDelegations()
+	if err == nil {
+		err = app.indexUnbondings()
+	}
+	if err == nil {
+		err = app.indexAccountLedger()
+	}
+	if err != nil {
+		return err
+	}
+
+	app.accountNumOnDb, err = app.accountTree.GetNLeafs()
+	if err != nil {
+		return err
+	}
+	app.contractNumOnDb, err = app.contractTree.GetNLeafs()
+	if err != nil {
+		return err
+	}
+
+	err = app.decodeParams(params)
+	if err != nil {
+		return err
+	}
+	app.chainID = chainID
+	err = app.saveParams()
+	if err != nil {
+		return err
+	}
+
+	commitLogs.dlog("Restored snapshot at height: ", app.blockHeight)
+	return app.saveState(appHash)
+}
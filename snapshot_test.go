@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	abcitypes "github.com/tendermint/tendermint/abci/types"
+)
+
+// syncSnapshot offers a snapshot of app to a new node and applies its chunks,
+// it returns the node and the result of the last chunk
+func syncSnapshot(t *testing.T, app *App, snapshot *abcitypes.Snapshot, appHash []byte) (*App, abcitypes.ResponseApplySnapshotChunk_Result) {
+	synced := openTestApp(t, t.TempDir())
+	t.Cleanup(synced.closeDbs)
+	offer := synced.OfferSnapshot(abcitypes.RequestOfferSnapshot{Snapshot: snapshot, AppHash: appHash})
+	require.Equal(t, abcitypes.ResponseOfferSnapshot_ACCEPT, offer.Result)
+
+	var result abcitypes.ResponseApplySnapshotChunk_Result
+	for i := uint32(0); i < snapshot.Chunks; i++ {
+		chunk := app.LoadSnapshotChunk(abcitypes.RequestLoadSnapshotChunk{Height: snapshot.Height, Format: snapshot.Format, Chunk: i})
+		result = synced.ApplySnapshotChunk(abcitypes.RequestApplySnapshotChunk{Index: i, Chunk: chunk.Chunk}).Result
+	}
+	return synced, result
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	accounts := newTestAccounts(t, 2)
+	app := newTestApp(t, testGenesis(t, accounts, 1000000, nil), accounts[0])
+	app.snapshotInterval = 2
+
+	tx, err := accounts[1].signer(t, app).Contract(0, 0, []byte("payload"))
+	require.Nil(t, err)
+	require.Equal(t, uint32(0), commitBlock(t, app, tx)[0].Code)
+	commitBlock(t, app)
+
+	//the snapshot is written in the background
+	var snapshots []*abcitypes.Snapshot
+	require.Eventually(t, func() bool {
+		snapshots = app.ListSnapshots(abcitypes.RequestListSnapshots{}).Snapshots
+		return len(snapshots) == 1
+	}, 10*time.Second, 10*time.Millisecond)
+	snapshot := snapshots[0]
+	assert.Equal(t, uint64(2), snapshot.Height)
+
+	//blocks committed meanwhile are not part of it
+	appHash := app.appHash
+	accountNum, contractNum := app.accountNumOnDb, app.contractNumOnDb
+	tx, err = accounts[1].signer(t, app).Contract(1, 0, []byte("later"))
+	require.Nil(t, err)
+	require.Equal(t, uint32(0), commitBlock(t, app, tx)[0].Code)
+
+	synced, result := syncSnapshot(t, app, snapshot, appHash)
+	require.Equal(t, abcitypes.ResponseApplySnapshotChunk_ACCEPT, result)
+	assert.Equal(t, int64(2), synced.blockHeight)
+	assert.Equal(t, appHash, synced.appHash)
+	assert.Equal(t, accountNum, synced.accountNumOnDb)
+	assert.Equal(t, contractNum, synced.contractNumOnDb)
+
+	//the ledger is rebuilt from the account tree
+	account, err := synced.findAccountByPubKey(accounts[1].bls.PubKey())
+	require.Nil(t, err)
+	assert.Equal(t, addressKey(accounts[1].address), account.Address)
+
+	//with the tx storage of the height the next block hashes the same
+	require.Equal(t, uint32(0), commitBlock(t, synced, tx)[0].Code)
+	assert.Equal(t, app.appHash, synced.appHash)
+}
+
+func TestSnapshotContractTree(t *testing.T) {
+	accounts := newTestAccounts(t, 2)
+	app := newTestApp(t, testGenesis(t, accounts, 1000000, nil), accounts[0])
+
+	tx, err := accounts[1].signer(t, app).Contract(0, 0, []byte("payload"))
+	require.Nil(t, err)
+	require.Equal(t, uint32(0), commitBlock(t, app, tx)[0].Code)
+
+	//a snapshot without the contract leaves does not give back the app hash
+	trees := append(app.snapshotTrees(), app.txStorageTree)
+	trees[1], err = app.contractTree.Snapshot(make([]byte, 32))
+	require.Nil(t, err)
+	app.createSnapshot(uint64(app.blockHeight), app.snapshotHeader(), trees)
+	snapshots := app.ListSnapshots(abcitypes.RequestListSnapshots{}).Snapshots
+	require.Len(t, snapshots, 1)
+
+	_, result := syncSnapshot(t, app, snapshots[0], app.appHash)
+	assert.Equal(t, abcitypes.ResponseApplySnapshotChunk_ABORT, result)
+}
+
+func TestSnapshotKeepRecent(t *testing.T) {
+	config := DefaultAppConfig()
+	config.SnapshotKeepRecent = 0
+	assert.NotNil(t, config.ValidateBasic())
+
+	//nothing is pruned without snapshots
+	config.SnapshotInterval = 0
+	assert.Nil(t, config.ValidateBasic())
+}
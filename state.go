@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/binary"
+
+	"go.vocdoni.io/dvote/db"
+)
+
+// keys of the entries kept in the application state database
+var (
+	stateHeightKey  = []byte("height")
+	stateAppHashKey = []byte("apphash")
+)
+
+// saveState persists the last committed height and app hash, so that
+// the ABCI handshake can resume from them after a restart, together with
+// the tree states of the height, kept for historical queries, and the
+// removal of the commit journal
+func (app *App) saveState(appHash []byte) error {
+	states, err := app.treeStates()
+	if err != nil {
+		commitLogs.logError("Failed to read the tree states: ", err)
+		return err
+	}
+
+	wSt := app.stateDb.WriteTx()
+	defer wSt.Discard()
+
+	var height [8]byte
+	binary.BigEndian.PutUint64(height[:], uint64(app.blockHeight))
+
+	err = wSt.Set(stateHeightKey, height[:])
+	if err != nil {
+		commitLogs.logError("Failed to store the last block height: ", err)
+		return err
+	}
+
+	err = wSt.Set(stateAppHashKey, appHash)
+	if err != nil {
+		commitLogs.logError("Failed to store the last app hash: ", err)
+		return err
+	}
+
+	err = wSt.Set(stateFeeMarketKey, app.encodeFeeMarket())
+	if err != nil {
+		commitLogs.logError("Failed to store the fee market: ", err)
+		return err
+	}
+
+	err = app.putTreeStates(wSt, states)
+	if err != nil {
+		commitLogs.logError("Failed to store the tree states: ", err)
+		return err
+	}
+
+	//the height leaving the retention window
+	if app.historyBlocks > 0 && app.blockHeight >= app.historyBlocks {
+		err = wSt.Delete(historyKey(app.blockHeight - app.historyBlocks))
+		if err != nil && err != db.ErrKeyNotFound {
+			commitLogs.logError("Failed to prune the tree states: ", err)
+			return err
+		}
+	}
+
+	err = wSt.Delete(stateJournalKey)
+	if err != nil && err != db.ErrKeyNotFound {
+		commitLogs.logError("Failed to clear the commit journal: ", err)
+		return err
+	}
+
+	err = wSt.Commit()
+	if err != nil {
+		commitLogs.logError("Failed to commit the application state: ", err)
+		return err
+	}
+
+	app.appHash = appHash
+	app.committed = states
+	app.committedHeight = app.blockHeight
+	return nil
+}
+
+// putTreeStates records the tree states of the last committed height, the
+// rollback target of the next commit, and with the fee market the state of
+// its historical queries
+func (app *App) putTreeStates(wSt db.WriteTx, states []treeState) error {
+	blob := encodeTreeStates(states)
+	err := wSt.Set(stateRootsKey, blob)
+	if err != nil {
+		return err
+	}
+	return wSt.Set(historyKey(app.blockHeight), append(blob, app.encodeFeeMarket()...))
+}
+
+// stateMarked reports whether a key of the state database is set, such as the
+// marker of a one-time upgrade of the stored state
+func (app *App) stateMarked(key []byte) (bool, error) {
+	rSt := app.stateDb.ReadTx()
+	defer rSt.Discard()
+
+	_, err := rSt.Get(key)
+	if err == db.ErrKeyNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// loadState restores the last committed height and app hash
+// a fresh database leaves both of them empty
+func (app *App) loadState() error {
+	rSt := app.stateDb.ReadTx()
+	defer rSt.Discard()
+
+	height, err := rSt.Get(stateHeightKey)
+	if err == db.ErrKeyNotFound {
+		commitLogs.log("No previous state found, starting from genesis")
+		return nil
+	}
+	if err != nil {
+		commitLogs.logError("Failed to read the last block height: ", err)
+		return err
+	}
+
+	appHash, err := rSt.Get(stateAppHashKey)
+	if err != nil {
+		commitLogs.logError("Failed to read the last app hash: ", err)
+		return err
+	}
+
+	//states saved before the fee market have none
+	feeMarket, err := rSt.Get(stateFeeMarketKey)
+	if err == nil {
+		err = app.decodeFeeMarket(feeMarket)
+	} else if err == db.ErrKeyNotFound {
+		err = nil
+	}
+	if err != nil {
+		commitLogs.logError("Failed to read the fee market: ", err)
+		return err
+	}
+
+	copy(app.blockheight[:], height)
+	app.blockHeight = int64(binary.BigEndian.Uint64(height))
+	app.appHash = appHash
+
+	//restore the sizes of the trees
+	app.accountNumOnDb, err = app.accountTree.GetNLeafs()
+	if err != nil {
+		commitLogs.logError("Failed to count leaves on the Account Tree: ", err)
+		return err
+	}
+
+	app.contractNumOnDb, err = app.contractTree.GetNLeafs()
+	if err != nil {
+		commitLogs.logError("Failed to count leaves on the Contract Tree: ", err)
+		return err
+	}
+
+	//tree states to journal on the next commit, states saved before they
+	//were recorded start from the trees as they are
+	app.committed, err = app.committedTreeStates()
+	if err == nil && app.committed == nil {
+		app.committed, err = app.treeStates()
+	}
+	if err != nil {
+		commitLogs.logError("Failed to read the committed tree states: ", err)
+		return err
+	}
+	app.committedHeight = app.blockHeight
+
+	commitLogs.dlog("Restored state at height: ", app.blockHeight)
+	return nil
+}
+
+// executingHeight is the height of the block being executed, or of the next
+// block while checking txs. It follows the last committed height, EndBlock
+// already moves blockHeight to the executing block before Commit
+func (app *App) executingHeight() uint64 {
+	return uint64(app.committedHeight) + 1
+}
+
+// computeAppHash hashes the roots of the account, contract, validator,
+// delegation and unbonding trees with the fee market and appends the root of
+// the blockhash tree
+func (app *App) computeAppHash() ([]byte, error) {
+	ledgerRoot, err := app.accountTree.Root()
+	if err != nil {
+		commitLogs.logError("Failed to get the Account Tree root: ", err)
+		return nil, err
+	}
+
+	contractRoot, err := app.contractTree.Root()
+	if err != nil {
+		commitLogs.logError("Failed to get the Contract Tree root: ", err)
+		return nil, err
+	}
+
+	validatorRoot, err := app.validatorTree.Root()
+	if err != nil {
+		commitLogs.logError("Failed to get the Validator Tree root: ", err)
+		return nil, err
+	}
+
+	delegationRoot, err := app.delegationTree.Root()
+	if err != nil {
+		commitLogs.logError("Failed to get the Delegation Tree root: ", err)
+		return nil, err
+	}
+
+	unbondingRoot, err := app.unbondingTree.Root()
+	if err != nil {
+		commitLogs.logError("Failed to get the Unbonding Tree root: ", err)
+		return nil, err
+	}
+
+	chainRoot, err := app.blockHashTree.Root()
+	if err != nil {
+		commitLogs.logError("Failed to get the BlockHash Tree root: ", err)
+		return nil, err
+	}
+
+	byteSlice := append(ledgerRoot, contractRoot...)
+	byteSlice = append(byteSlice, validatorRoot...)
+	byteSlice = append(byteSlice, delegationRoot...)
+	byteSlice = append(byteSlice, unbondingRoot...)
+	byteSlice = append(byteSlice, app.encodeFeeMarket()...)
+	return append(app.sha2(byteSlice), chainRoot...), nil
+}
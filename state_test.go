@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	abcitypes "github.com/tendermint/tendermint/abci/types"
+)
+
+func TestAppHashFeeMarket(t *testing.T) {
+	accounts := newTestAccounts(t, 2)
+	app := newTestApp(t, testGenesis(t, accounts, 1000000, nil))
+
+	tx, err := accounts[0].signer(t, app).Transfer(accounts[1].address, 10)
+	require.Nil(t, err)
+	commitBlock(t, app, tx)
+	appHashes := [][]byte{nil, app.appHash}
+	commitBlock(t, app)
+	appHashes = append(appHashes, app.appHash)
+
+	//the burned fees and the tips are part of the app hash
+	appHash, err := app.computeAppHash()
+	require.Nil(t, err)
+	assert.Equal(t, app.appHash, appHash)
+	for _, field := range []*uint64{&app.burned, &app.totalFees} {
+		*field++
+		appHash, err = app.computeAppHash()
+		require.Nil(t, err)
+		assert.NotEqual(t, app.appHash, appHash)
+		*field--
+	}
+
+	//the apphash proof op gives back the app hash of every height
+	for _, height := range []int64{1, 2} {
+		res := app.Query(abcitypes.RequestQuery{Data: addressKey(accounts[0].address), Height: height, Prove: true})
+		require.Equal(t, uint32(0), res.Code, res.Log)
+		require.Equal(t, 2, len(res.ProofOps.Ops))
+		roots := res.ProofOps.Ops[1].Data
+		require.Equal(t, 5*32+24+32, len(roots))
+
+		sum := sha256.Sum256(roots[:len(roots)-32])
+		assert.Equal(t, appHashes[height], append(sum[:], roots[len(roots)-32:]...))
+	}
+}
+
+func TestTipsAcrossRestart(t *testing.T) {
+	tests := []struct {
+		name    string
+		restart bool
+	}{
+		{"same process", false},
+		{"restart before the next block", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			accounts := newTestAccounts(t, 2)
+			params := DefaultAppConfig().genesisParams()
+			params.BlockReward = 0
+			app := newTestApp(t, testGenesis(t, accounts, 1000000, params), accounts[0])
+
+			signer := accounts[1].signer(t, app)
+			signer.Tip = 50
+			tx, err := signer.Transfer(accounts[0].address, 10)
+			require.Nil(t, err)
+			require.Equal(t, uint32(0), commitBlock(t, app, tx)[0].Code)
+
+			if tt.restart {
+				app = reopenTestApp(t, app)
+			}
+
+			//the tips of a block are paid to the proposer of the next one
+			deliverBlock(app, proposedBy(app, accounts[0]))
+			app.Commit()
+			v, err := app.fetchValidator(app.toAddress(accounts[0].pubKey()))
+			require.Nil(t, err)
+			//the proposer then leaks 1050/256+1 like every vote
+			assert.Equal(t, uint64(1045), v.Power)
+		})
+	}
+}
+
+func TestInitChainCrash(t *testing.T) {
+	accounts := newTestAccounts(t, 2)
+	genesis := testGenesis(t, accounts, 1000000, nil)
+
+	tests := []struct {
+		name          string
+		initialHeight int64
+	}{
+		{"initial height 1", 1},
+		{"initial height 10", 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := abcitypes.RequestInitChain{
+				ChainId:       testChainID,
+				AppStateBytes: genesis,
+				InitialHeight: tt.initialHeight,
+				Validators:    []abcitypes.ValidatorUpdate{abcitypes.UpdateValidator(accounts[0].pubKey(), 1000, "ed25519")},
+			}
+			app := openTestApp(t, t.TempDir())
+			app.InitChain(req)
+			states, err := app.treeStates()
+			require.Nil(t, err)
+
+			//the node stops before the first commit, the handshake runs
+			//InitChain again on the saved genesis state
+			app = reopenTestApp(t, app)
+			assert.Equal(t, tt.initialHeight-1, app.Info(abcitypes.RequestInfo{}).LastBlockHeight)
+			app.InitChain(req)
+			restored, err := app.treeStates()
+			require.Nil(t, err)
+			assert.Equal(t, states, restored)
+			assert.Equal(t, 2, app.accountNumOnDb)
+			assert.Equal(t, uint64(1000000), testBalance(t, app, accounts[1].address))
+
+			//the first block is executed at the initial height
+			commitBlock(t, app)
+			assert.Equal(t, tt.initialHeight, app.committedHeight)
+		})
+	}
+}
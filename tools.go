@@ -3,9 +3,10 @@ package main
 
 import (
 	"crypto/sha256"
+	"encoding/binary"
+	"math/bits"
 	//"kvstore/poseidon"
 
-	"github.com/tendermint/tendermint/abci/types"
 	"github.com/tendermint/tendermint/crypto/ed25519"
 	"github.com/tendermint/tendermint/crypto/encoding"
 	"github.com/tendermint/tendermint/proto/tendermint/crypto"
@@ -42,26 +43,49 @@ func (app *App) toPk(key []byte) (crypto.PublicKey, error) {
 	pkp, err := encoding.PubKeyToProto(pke)
 	if err != nil {
 		logs.logError("Failed to encode public key :", err)
-		panic(err)
 		return pkp, err
 	}
 	return pkp, nil
 }
 
-func (app *App) removeDuplicateValidatorUpdates() {
-	seen := make(map[string]types.ValidatorUpdate)
+// checked arithmetic for balances, ok is false on overflow or underflow
+func addAmount(a, b uint64) (uint64, bool) {
+	sum, carry := bits.Add64(a, b, 0)
+	return sum, carry == 0
+}
 
-	// Iterate through the updates and keep the rightmost occurrences
-	for _, update := range app.valUpdates {
-		key := update.PubKey.String()
-		seen[key] = update
-	}
+func subAmount(a, b uint64) (uint64, bool) {
+	diff, borrow := bits.Sub64(a, b, 0)
+	return diff, borrow == 0
+}
+
+func mulAmount(a, b uint64) (uint64, bool) {
+	hi, lo := bits.Mul64(a, b)
+	return lo, hi == 0
+}
 
-	// delete the updates slice
-	app.valUpdates = make([]types.ValidatorUpdate, 0)
+// parseAmount reads a big endian amount of 2, 4 or 8 bytes from a tx
+func parseAmount(b []byte) uint64 {
+	switch len(b) {
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b))
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b))
+	case 8:
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
 
-	// Refill the slice from the map values
-	for _, update := range seen {
-		app.valUpdates = append(app.valUpdates, update)
+// mulDiv returns a*b/c without intermediate overflow, ok is false if the result does not fit
+func mulDiv(a, b, c uint64) (uint64, bool) {
+	if c == 0 {
+		return 0, false
+	}
+	hi, lo := bits.Mul64(a, b)
+	if hi >= c {
+		return 0, false
 	}
+	q, _ := bits.Div64(hi, lo, c)
+	return q, true
 }
@@ -12,7 +12,7 @@ func (app *App) createTreeDb(dbname string, levels int, sha256 bool) (*badb.Badg
 	opts.Path = dbname
 	dbpoint, err := badb.New(opts)
 	if err != nil {
-		logs.logError("Failed to access database "+dbname+" !!!", err)
+		commitLogs.logError("Failed to access database "+dbname+" !!!", err)
 		return nil, nil, err
 	}
 	return app.createTree(dbpoint, levels, sha256)
@@ -34,7 +34,7 @@ func (app *App) createTree(dbpoint *badb.BadgerDB, levels int, sha256 bool) (*ba
 	Tree, err := arbo.NewTree(config)
 
 	if err != nil {
-		logs.logError("Failed to create tree !!!", err)
+		commitLogs.logError("Failed to create tree !!!", err)
 		return dbpoint, nil, err
 	}
 
@@ -21,12 +21,28 @@ type Transaction struct {
 	counter      []byte
 	pad          byte
 
+	//proof of possession verified for pubkey and counter
+	popVerified bool
+
+	//signature verified against the current counter of the source account
+	signed bool
+
+	//wire format version and type tag, zero for legacy transactions
+	version byte
+	txType  byte
+
+	//last height the tx can be included at, zero never expires (versioned txs only)
+	validUntil uint64
+
 	//boolArray []bool
 	addresses []byte
 	//batchedTxNum int
 
-	Amount uint32
-	Fee    uint32
+	Amount uint64
+	Fee    uint64
+
+	//part of the fee paid to the proposer, the rest is burned (versioned txs only)
+	Tip uint64
 
 	length int
 
@@ -40,6 +56,7 @@ type Transaction struct {
 	isStake             bool
 	isDelegate          bool
 	isRelease           bool
+	isUnjail            bool
 	isCollateral        bool
 	isEvidence          bool //this includes 2 distinct signatures on the same blockheight
 	//or on the same tx counter, which indicates that the user tried
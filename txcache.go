@@ -0,0 +1,92 @@
+package main
+
+import (
+	"container/list"
+	"time"
+)
+
+// tx cache bounds, entries of txs still in the mempool are refreshed by rechecks
+const (
+	txCacheMaxSize   = 10000
+	txCacheMaxAge    = 10 * time.Minute
+	txCacheMaxBlocks = 100
+)
+
+// txCache keeps the txs accepted by CheckTx until they are delivered, evicted
+// when the cache is full or expired by age and height, so that txs dropped by
+// the mempool do not stay in memory
+type txCache struct {
+	entries map[[32]byte]*list.Element
+	order   *list.List //oldest entry first
+
+	maxSize   int
+	maxAge    time.Duration
+	maxBlocks int64
+
+	evicted uint64
+}
+
+type txCacheEntry struct {
+	tx     *Transaction
+	height int64
+	added  time.Time
+}
+
+func newTxCache(maxSize int, maxAge time.Duration, maxBlocks int64) *txCache {
+	return &txCache{
+		entries:   make(map[[32]byte]*list.Element),
+		order:     list.New(),
+		maxSize:   maxSize,
+		maxAge:    maxAge,
+		maxBlocks: maxBlocks,
+	}
+}
+
+func (c *txCache) get(hash [32]byte) *Transaction {
+	e, ok := c.entries[hash]
+	if !ok {
+		return nil
+	}
+	return e.Value.(*txCacheEntry).tx
+}
+
+// add stores a tx checked at the given height, replacing a previous entry
+// and evicting the oldest entries beyond the size bound
+func (c *txCache) add(tx *Transaction, height int64) {
+	c.remove(tx.hash)
+	c.entries[tx.hash] = c.order.PushBack(&txCacheEntry{tx: tx, height: height, added: time.Now()})
+
+	for c.order.Len() > c.maxSize {
+		c.removeElement(c.order.Front())
+		c.evicted++
+	}
+}
+
+func (c *txCache) remove(hash [32]byte) {
+	e, ok := c.entries[hash]
+	if ok {
+		c.removeElement(e)
+	}
+}
+
+func (c *txCache) removeElement(e *list.Element) {
+	delete(c.entries, e.Value.(*txCacheEntry).tx.hash)
+	c.order.Remove(e)
+}
+
+// expire drops the entries checked more than maxBlocks blocks or maxAge ago
+func (c *txCache) expire(height int64, now time.Time) {
+	for e := c.order.Front(); e != nil; {
+		next := e.Next()
+		entry := e.Value.(*txCacheEntry)
+		if height-entry.height > c.maxBlocks || now.Sub(entry.added) > c.maxAge {
+			c.removeElement(e)
+			c.evicted++
+		}
+		e = next
+	}
+}
+
+func (c *txCache) len() int {
+	return c.order.Len()
+}
@@ -0,0 +1,157 @@
+package main
+
+// versioned transaction format:
+// [ 64 bytes  | 1 byte | 1 byte   | 8 bytes     | 8 bytes | N bytes ]
+// [ signature | 0xF1   | type tag | valid until | tip     | body    ]
+// the body keeps the legacy layout, starting with the 4 byte source address,
+// and the signature covers the header, the body and the chain id.
+// legacy transactions have no header, their type is inferred from the size
+// and their signature does not cover the chain id, they can be replayed on
+// other networks until the legacy cutoff height.
+
+// version byte of the versioned format, legacy transactions start with the
+// source address, which only reaches this value beyond 0xF1000000 accounts
+const txFormatV1 byte = 0xF1
+
+const txHeaderSize = 18
+
+// type tags of the versioned format
+const (
+	txTypeUpdate byte = iota + 1
+	txTypeRelease
+	txTypeStake
+	txTypeDelegate
+	txTypeTransfer
+	txTypeCreateAccount
+	txTypeChangeKeys
+	txTypeContract
+	txTypeBatch
+	txTypeUnjail
+)
+
+// txDecoder parses the body of a versioned transaction of one type
+type txDecoder struct {
+	sizes   []int // accepted body sizes, empty for variable sized bodies
+	minSize int
+	decode  func(tx *Transaction)
+}
+
+var txDecoders = map[byte]txDecoder{
+	txTypeUpdate:        {sizes: []int{36}, decode: (*Transaction).parseUpdate},
+	txTypeRelease:       {sizes: []int{4, 8}, decode: (*Transaction).parseRelease},
+	txTypeStake:         {sizes: []int{8}, decode: (*Transaction).parseStake},
+	txTypeDelegate:      {sizes: []int{10}, decode: (*Transaction).parseDelegate},
+	txTypeTransfer:      {sizes: []int{12, 44}, decode: (*Transaction).parseTransfer},
+	txTypeCreateAccount: {sizes: []int{184}, decode: (*Transaction).parseCreateAccount},
+	txTypeChangeKeys:    {sizes: []int{180}, decode: (*Transaction).parseChangeKeys},
+	txTypeContract:      {minSize: 13, decode: (*Transaction).parseContract},
+	txTypeBatch:         {minSize: 113, decode: (*Transaction).parseBatch},
+	txTypeUnjail:        {sizes: []int{4}, decode: (*Transaction).parseUnjail},
+}
+
+func (tx *Transaction) selectVersionedTxType() bool {
+	decoder, ok := txDecoders[tx.txType]
+	if !ok {
+		checkLogs.log("Unknown tx type")
+		return false
+	}
+
+	size := len(tx.data)
+	if len(decoder.sizes) > 0 {
+		valid := false
+		for _, s := range decoder.sizes {
+			if size == s {
+				valid = true
+			}
+		}
+		if !valid {
+			checkLogs.log("Bad size for tx type")
+			return false
+		}
+	} else if size < decoder.minSize {
+		checkLogs.log("Too small for tx type")
+		return false
+	}
+
+	decoder.decode(tx)
+	return true
+}
+
+func (tx *Transaction) parseUpdate() {
+	tx.isUpdate = true
+	checkLogs.log("	Update state")
+	tx.state = tx.data[4:]
+}
+
+func (tx *Transaction) parseRelease() {
+	tx.isRelease = true
+	if len(tx.data) > 4 {
+		checkLogs.log("	Release from delegation")
+		tx.target = tx.data[4:8]
+	} else {
+		checkLogs.log("	Release from staking")
+	}
+}
+
+// parseUnjail has no legacy layout, only the versioned format can carry it
+func (tx *Transaction) parseUnjail() {
+	tx.isUnjail = true
+	checkLogs.log("	Unjail")
+}
+
+func (tx *Transaction) parseStake() {
+	tx.isStake = true
+	checkLogs.log("	Stake")
+	tx.amount = tx.data[4:8]
+}
+
+func (tx *Transaction) parseDelegate() {
+	tx.isDelegate = true
+	checkLogs.log("	Delegate")
+	tx.amount = tx.data[8:10]
+	tx.target = tx.data[4:8]
+}
+
+func (tx *Transaction) parseTransfer() {
+	tx.isTransfer = true
+	tx.target = tx.data[4:8]
+	tx.amount = tx.data[8:12]
+	if len(tx.data) > 12 {
+		checkLogs.log("	Transfer with state update")
+		tx.state = tx.data[12:]
+	} else {
+		checkLogs.log("	Transfer simple")
+	}
+}
+
+func (tx *Transaction) parseChangeKeys() {
+	tx.isAccountKeyChanger = true
+	checkLogs.log("	Change Account keys")
+	tx.target = nil
+	tx.amount = nil
+	tx.publickeys = tx.data[4:]
+}
+
+func (tx *Transaction) parseCreateAccount() {
+	tx.isAccountCreator = true
+	checkLogs.log("	Create account")
+	tx.target = nil
+	tx.amount = tx.data[4:8]
+	tx.publickeys = tx.data[8:]
+}
+
+func (tx *Transaction) parseContract() {
+	tx.isContract = true
+	checkLogs.log("	Contract")
+	tx.amount = tx.data[4:8]
+	tx.pad = tx.data[8]
+	tx.target = tx.data[9:13]
+	tx.payload = tx.data[13:]
+}
+
+func (tx *Transaction) parseBatch() {
+	tx.isBatch = true
+	checkLogs.log("	Batch transaction")
+	tx.amount = tx.data[4:8]
+	tx.pad = tx.data[8]
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/vocdoni/arbo"
+	"go.vocdoni.io/dvote/db"
+)
+
+// unbonding leaves are keyed by maturity height (8 bytes), account (4 bytes)
+// and validator address (20 bytes), the value is the amount (8 bytes)
+// released funds stay slashable until EndBlock of the maturity height credits them
+// arbo can not delete leaves, a paid or slashed entry is left with zero amount
+
+func unbondingKey(matureHeight uint64, account, valAddr []byte) []byte {
+	key := make([]byte, 32)
+	binary.BigEndian.PutUint64(key[:8], matureHeight)
+	copy(key[8:12], account)
+	copy(key[12:], valAddr)
+	return key
+}
+
+// unbondings are indexed by maturity height in the database of the unbonding
+// tree, next to the nodes of the tree. Index entries are never removed, an
+// entry of a rolled back leaf points to a missing leaf
+var (
+	unbondingIndexPrefix   = []byte("ub/")
+	stateUnbondingIndexKey = []byte("unbondingindex")
+)
+
+// unbondingIndexKey returns the index entry of an unbonding key, or the
+// prefix of the entries of a height given its first 8 bytes
+func unbondingIndexKey(key []byte) []byte {
+	return append(append([]byte{}, unbondingIndexPrefix...), key...)
+}
+
+// queueUnbonding schedules the release of amount to an account, releases of
+// the same account and validator in one block share a single entry
+func (app *App) queueUnbonding(account, valAddr []byte, amount uint64) error {
+	matureHeight := app.executingHeight() + app.unbondingBlocks
+	key := unbondingKey(matureHeight, account, valAddr)
+
+	value := make([]byte, 8)
+	_, v, err := app.unbondingTree.Get(key)
+	if err == nil {
+		total, ok := addAmount(binary.BigEndian.Uint64(v), amount)
+		if !ok {
+			return errors.New("unbonding amount out of range")
+		}
+		binary.BigEndian.PutUint64(value, total)
+		return app.unbondingTree.Update(key, value)
+	}
+
+	binary.BigEndian.PutUint64(value, amount)
+	wUb := app.unbondingDb.WriteTx()
+	defer wUb.Discard()
+	err = app.unbondingTree.AddWithTx(wUb, key, value)
+	if err == nil {
+		err = wUb.Set(unbondingIndexKey(key), nil)
+	}
+	if err != nil {
+		return err
+	}
+	return wUb.Commit()
+}
+
+// indexUnbondings builds the index of the unbondings on the tree, for trees
+// written before the index and trees restored from a snapshot or an export
+func (app *App) indexUnbondings() error {
+	var keys [][]byte
+	err := iterateLeaves(app.unbondingTree, func(k, _ []byte) {
+		if len(k) == 32 {
+			keys = append(keys, unbondingIndexKey(k))
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	batch := db.NewBatch(app.unbondingDb)
+	defer batch.Discard()
+	for _, key := range keys {
+		err = batch.Set(key, nil)
+		if err != nil {
+			return err
+		}
+	}
+	err = batch.Commit()
+	if err != nil {
+		return err
+	}
+	valLogs.dlog("Indexed unbondings: ", len(keys))
+
+	wSt := app.stateDb.WriteTx()
+	defer wSt.Discard()
+	err = wSt.Set(stateUnbondingIndexKey, []byte{1})
+	if err != nil {
+		return err
+	}
+	return wSt.Commit()
+}
+
+// dueUnbondings returns the keys and values of the unbondings maturing from
+// height from to height to with a non zero amount and matching the filter
+func (app *App) dueUnbondings(from, to uint64, filter func(key []byte) bool) ([][]byte, [][]byte, error) {
+	var f, t [8]byte
+	binary.BigEndian.PutUint64(f[:], from)
+	binary.BigEndian.PutUint64(t[:], to)
+	//the index is ordered by height, scan once the heights sharing the prefix
+	//of both ends
+	common := 0
+	for common < 8 && f[common] == t[common] {
+		common++
+	}
+	prefix := unbondingIndexKey(f[:common])
+
+	var indexed [][]byte
+	err := app.unbondingDb.Iterate(prefix, func(k, _ []byte) bool {
+		key := k[len(unbondingIndexPrefix):]
+		height := binary.BigEndian.Uint64(key[:8])
+		if height > to {
+			return false
+		}
+		if height >= from {
+			indexed = append(indexed, append([]byte{}, key...))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var keys, values [][]byte
+	for _, key := range indexed {
+		if !filter(key) {
+			continue
+		}
+		_, amount, err := app.unbondingTree.Get(key)
+		if err == arbo.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if binary.BigEndian.Uint64(amount) == 0 {
+			continue
+		}
+		keys = append(keys, key)
+		values = append(values, append([]byte{}, amount...))
+	}
+	return keys, values, nil
+}
+
+// pendingUnbondings returns the keys and values of the unbondings of a tree
+// with a non zero amount matching the filter
+func pendingUnbondings(tree *arbo.Tree, filter func(key []byte) bool) ([][]byte, [][]byte, error) {
+	var keys, values [][]byte
+	err := tree.Iterate(nil, func(_, v []byte) {
+		if v[0] != arbo.PrefixValueLeaf {
+			return
+		}
+		k, amount := arbo.ReadLeafValue(v)
+		if len(k) != 32 || len(amount) != 8 || binary.BigEndian.Uint64(amount) == 0 {
+			return
+		}
+		if !filter(k) {
+			return
+		}
+		keys = append(keys, append([]byte{}, k...))
+		values = append(values, append([]byte{}, amount...))
+	})
+	return keys, values, err
+}
+
+// releaseUnbondings credits the unbondings maturing at height, EndBlock
+// releases every height in turn
+func (app *App) releaseUnbondings(height uint64) error {
+	keys, values, err := app.dueUnbondings(height, height, func([]byte) bool { return true })
+	if err != nil {
+		return err
+	}
+
+	wUb := app.unbondingDb.WriteTx()
+	defer wUb.Discard()
+
+	for i, key := range keys {
+		account, err := app.fetchAccount(key[8:12])
+		if err != nil {
+			valLogs.logError("Unbonding account not found: ", err)
+			continue
+		}
+
+		amount, ok := addAmount(account.Amount, binary.BigEndian.Uint64(values[i]))
+		if !ok {
+			valLogs.log("Unbonding credit out of range")
+			continue
+		}
+		account.Amount = amount
+		account.writeAccount(app)
+
+		valLogs.dlog("Released unbonding to account: ", key[8:12])
+
+		err = app.unbondingTree.UpdateWithTx(wUb, key, make([]byte, 8))
+		if err != nil {
+			return err
+		}
+	}
+
+	return wUb.Commit()
+}
+
+// slashUnbondings burns a fraction of the pending unbondings from a validator,
+// they mature from the block being executed to the end of the unbonding period
+func (app *App) slashUnbondings(valAddr []byte, fraction uint64) error {
+	from := app.executingHeight()
+	keys, values, err := app.dueUnbondings(from, from+app.unbondingBlocks, func(k []byte) bool {
+		return string(k[12:]) == string(valAddr)
+	})
+	if err != nil {
+		return err
+	}
+
+	wUb := app.unbondingDb.WriteTx()
+	defer wUb.Discard()
+
+	for i, key := range keys {
+		amount := binary.BigEndian.Uint64(values[i])
+		burn, _ := mulDiv(amount, fraction, slashFractionBase)
+		binary.BigEndian.PutUint64(values[i], amount-burn)
+
+		err := app.unbondingTree.UpdateWithTx(wUb, key, values[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	return wUb.Commit()
+}
+
+// unbondings lists the pending unbondings of an account as
+// maturity height (8 bytes) | validator address (20 bytes) | amount (8 bytes)
+func (view *stateView) unbondings(account []byte) ([]byte, error) {
+	keys, values, err := pendingUnbondings(view.unbonding, func(k []byte) bool {
+		return string(k[8:12]) == string(account)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	value := make([]byte, 0, len(keys)*36)
+	for i, key := range keys {
+		value = append(value, key[:8]...)
+		value = append(value, key[12:]...)
+		value = append(value, values[i]...)
+	}
+	return value, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	abcitypes "github.com/tendermint/tendermint/abci/types"
+	tmproto "github.com/tendermint/tendermint/proto/tendermint/types"
+)
+
+func TestReleaseUnbondings(t *testing.T) {
+	tests := []struct {
+		name     string
+		slash    bool
+		reindex  bool
+		released uint64
+	}{
+		{"released at maturity", false, false, 100},
+		{"slashed before maturity", true, false, 95},
+		{"indexed on start", false, true, 100},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			accounts := newTestAccounts(t, 2)
+			params := DefaultAppConfig().genesisParams()
+			params.UnbondingBlocks = 2
+			app := newTestApp(t, testGenesis(t, accounts, 1000000, params), accounts[0])
+			delegator := accounts[1]
+
+			tx, err := delegator.signer(t, app).Delegate(accounts[0].address, 100)
+			require.Nil(t, err)
+			require.Equal(t, uint32(0), commitBlock(t, app, tx)[0].Code)
+
+			//released at height 2, paid in EndBlock of height 4
+			tx, err = delegator.signer(t, app).Undelegate(accounts[0].address)
+			require.Nil(t, err)
+			require.Equal(t, uint32(0), commitBlock(t, app, tx)[0].Code)
+			balance := testBalance(t, app, delegator.address)
+
+			if tt.reindex {
+				wSt := app.stateDb.WriteTx()
+				require.Nil(t, wSt.Delete(stateUnbondingIndexKey))
+				require.Nil(t, wSt.Commit())
+				wUb := app.unbondingDb.WriteTx()
+				require.Nil(t, wUb.Delete(unbondingIndexKey(unbondingKey(4, addressKey(delegator.address), app.toAddress(accounts[0].pubKey())))))
+				require.Nil(t, wUb.Commit())
+				app = reopenTestApp(t, app)
+			}
+
+			req := abcitypes.RequestBeginBlock{Header: tmproto.Header{}}
+			if tt.slash {
+				req.ByzantineValidators = []abcitypes.Evidence{{
+					Type:      abcitypes.EvidenceType_DUPLICATE_VOTE,
+					Validator: abcitypes.Validator{Address: app.toAddress(accounts[0].pubKey())},
+					Height:    2,
+				}}
+			}
+			deliverBlock(app, req)
+			app.Commit()
+			assert.Equal(t, balance, testBalance(t, app, delegator.address))
+
+			commitBlock(t, app)
+			assert.Equal(t, balance+tt.released, testBalance(t, app, delegator.address))
+
+			//paid entries are not paid again
+			commitBlock(t, app)
+			assert.Equal(t, balance+tt.released, testBalance(t, app, delegator.address))
+		})
+	}
+}
+
+func TestDueUnbondings(t *testing.T) {
+	accounts := newTestAccounts(t, 2)
+	app := newTestApp(t, testGenesis(t, accounts, 1000000, nil), accounts[0])
+	valAddr := app.toAddress(accounts[0].pubKey())
+
+	//the range crosses a byte boundary of the height
+	wUb := app.unbondingDb.WriteTx()
+	for _, height := range []uint64{249, 250, 255, 256, 260, 261, 511} {
+		key := unbondingKey(height, addressKey(accounts[1].address), valAddr)
+		require.Nil(t, app.unbondingTree.AddWithTx(wUb, key, []byte{0, 0, 0, 0, 0, 0, 0, 1}))
+		require.Nil(t, wUb.Set(unbondingIndexKey(key), nil))
+	}
+	require.Nil(t, wUb.Commit())
+
+	tests := []struct {
+		name     string
+		from, to uint64
+		heights  []uint64
+	}{
+		{"one height", 255, 255, []uint64{255}},
+		{"range", 250, 260, []uint64{250, 255, 256, 260}},
+		{"empty range", 262, 510, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, _, err := app.dueUnbondings(tt.from, tt.to, func([]byte) bool { return true })
+			require.Nil(t, err)
+			var heights []uint64
+			for _, key := range keys {
+				heights = append(heights, binary.BigEndian.Uint64(key[:8]))
+			}
+			assert.Equal(t, tt.heights, heights)
+		})
+	}
+}
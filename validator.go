@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+
+	abcitypes "github.com/tendermint/tendermint/abci/types"
+	tmtypes "github.com/tendermint/tendermint/types"
+	"github.com/vocdoni/arbo"
+)
+
+// validator leaf layout, keyed by the first 20 bytes of the sha256 of the ed25519 key:
+// [ 8 bytes | 32 bytes   | 1 byte | 8 bytes      | 8 bytes       ]
+// [ power   | ed25519 pk | status | jailed until | missed blocks ]
+// validators stored before jailing existed have only power and key
+const (
+	valPowerEnd  = 8
+	valPubKeyEnd = 40
+	valStatusEnd = 41
+	valJailedEnd = 49
+	valMissedEnd = 57
+)
+
+// validator status flags
+const (
+	validatorJailed     byte = 1
+	validatorTombstoned byte = 2
+)
+
+// slash fractions are expressed in parts of slashFractionBase
+const slashFractionBase uint64 = 10000
+
+type Validator struct {
+	Address     []byte
+	PubKey      []byte
+	Power       uint64
+	Status      byte
+	JailedUntil uint64
+	Missed      uint64
+}
+
+func decodeValidator(address, data []byte) (*Validator, error) {
+	if len(data) < valPubKeyEnd {
+		return nil, errors.New("validator entry too short")
+	}
+
+	v := &Validator{
+		Address: address,
+		PubKey:  append([]byte{}, data[valPowerEnd:valPubKeyEnd]...),
+		Power:   binary.BigEndian.Uint64(data[:valPowerEnd]),
+	}
+	if len(data) >= valMissedEnd {
+		v.Status = data[valPubKeyEnd]
+		v.JailedUntil = binary.BigEndian.Uint64(data[valStatusEnd:valJailedEnd])
+		v.Missed = binary.BigEndian.Uint64(data[valJailedEnd:valMissedEnd])
+	}
+	return v, nil
+}
+
+func (v *Validator) encode() []byte {
+	data := make([]byte, valMissedEnd)
+	binary.BigEndian.PutUint64(data[:valPowerEnd], v.Power)
+	copy(data[valPowerEnd:valPubKeyEnd], v.PubKey)
+	data[valPubKeyEnd] = v.Status
+	binary.BigEndian.PutUint64(data[valStatusEnd:valJailedEnd], v.JailedUntil)
+	binary.BigEndian.PutUint64(data[valJailedEnd:valMissedEnd], v.Missed)
+	return data
+}
+
+func (v *Validator) jailed() bool {
+	return v.Status&validatorJailed != 0
+}
+
+func (v *Validator) tombstoned() bool {
+	return v.Status&validatorTombstoned != 0
+}
+
+// votingPower is the power reported to tendermint, jailed validators have none
+func (v *Validator) votingPower() int64 {
+	if v.jailed() {
+		return 0
+	}
+	return int64(v.Power)
+}
+
+func (app *App) fetchValidator(address []byte) (*Validator, error) {
+	_, data, err := app.validatorTree.Get(address)
+	if err != nil {
+		return nil, err
+	}
+	return decodeValidator(address, data)
+}
+
+// validatorPowers sums the power of all validators and the voting power of
+// those that are not jailed
+func (app *App) validatorPowers() (total uint64, active uint64, err error) {
+	err = app.validatorTree.Iterate(nil, func(_, v []byte) {
+		if v[0] != arbo.PrefixValueLeaf {
+			return
+		}
+		k, d := arbo.ReadLeafValue(v)
+		val, err := decodeValidator(k, d)
+		if err != nil {
+			return
+		}
+		total += val.Power
+		active += uint64(val.votingPower())
+	})
+	return total, active, err
+}
+
+// powerInRange reports whether the total power of the validators, jailed
+// ones included, stays within what tendermint accepts with v at power
+func (app *App) powerInRange(v *Validator, power uint64) (bool, error) {
+	total, _, err := app.validatorPowers()
+	if err != nil {
+		return false, err
+	}
+	//the tree holds v at its current power, or not at all with power 0
+	return total-v.Power+power <= uint64(tmtypes.MaxTotalVotingPower), nil
+}
+
+// storeValidator adds or updates the leaf of a validator, EndBlock reports
+// its voting power to tendermint if the block changed it
+func (app *App) storeValidator(v *Validator) error {
+	touched := false
+	for _, addr := range app.valTouched {
+		if string(addr) == string(v.Address) {
+			touched = true
+			break
+		}
+	}
+	if !touched {
+		app.valTouched = append(app.valTouched, v.Address)
+	}
+
+	_, _, err := app.validatorTree.Get(v.Address)
+	if err == nil {
+		return app.validatorTree.Update(v.Address, v.encode())
+	}
+	return app.validatorTree.Add(v.Address, v.encode())
+}
+
+// validatorUpdates returns the voting power of the validators stored in the
+// block whose voting power differs from the committed one, in the order they
+// were first stored. Tendermint knows the committed voting powers and fails
+// on the removal of a validator it does not have, a validator that was
+// already at zero is not reported again
+func (app *App) validatorUpdates() ([]abcitypes.ValidatorUpdate, error) {
+	var committed *arbo.Tree
+	for i, t := range app.journaledTrees() {
+		if t.name == "validator" && app.committed != nil {
+			var err error
+			committed, err = app.validatorTree.Snapshot(app.committed[i].root)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if committed == nil {
+		return nil, errors.New("no committed validator tree")
+	}
+
+	updates := make([]abcitypes.ValidatorUpdate, 0)
+	for _, addr := range app.valTouched {
+		v, err := app.fetchValidator(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		reported := int64(0)
+		_, data, err := committed.Get(addr)
+		if err == nil {
+			last, err := decodeValidator(addr, data)
+			if err != nil {
+				return nil, err
+			}
+			reported = last.votingPower()
+		} else if err != arbo.ErrKeyNotFound {
+			return nil, err
+		}
+		if v.votingPower() == reported {
+			continue
+		}
+
+		pk, err := app.toPk(v.PubKey)
+		if err != nil {
+			return nil, err
+		}
+		updates = append(updates, abcitypes.ValidatorUpdate{PubKey: pk, Power: v.votingPower()})
+	}
+	return updates, nil
+}
+
+// slashValidator burns a fraction of the power of a validator together with
+// the same fraction of its delegations and pending unbondings
+func (app *App) slashValidator(v *Validator, fraction uint64) error {
+	if fraction > slashFractionBase {
+		fraction = slashFractionBase
+	}
+
+	burn, _ := mulDiv(v.Power, fraction, slashFractionBase)
+	v.Power -= burn
+	valLogs.dlog("SLASH: -", burn)
+
+	err := app.slashDelegations(v.Address, fraction)
+	if err != nil {
+		return err
+	}
+	return app.slashUnbondings(v.Address, fraction)
+}
+
+// jail removes a validator from the active set until the given height
+func (v *Validator) jail(until uint64) {
+	v.Status |= validatorJailed
+	v.JailedUntil = until
+	v.Missed = 0
+}
+
+// punishDowntime slashes and jails a validator that missed too many blocks in a row
+func (app *App) punishDowntime(v *Validator, height uint64) error {
+	valLogs.dlog("Jailing validator for downtime: ", v.Address)
+
+	err := app.slashValidator(v, app.slashFractionDowntime)
+	if err != nil {
+		return err
+	}
+	v.jail(height + app.jailBlocks)
+	return nil
+}
+
+// punishDoubleSign slashes, jails and tombstones a validator for byzantine evidence
+func (app *App) punishDoubleSign(v *Validator) error {
+	valLogs.dlog("Tombstoning validator: ", v.Address)
+
+	err := app.slashValidator(v, app.slashFractionDoubleSign)
+	if err != nil {
+		return err
+	}
+	v.jail(0)
+	v.Status |= validatorTombstoned
+	return nil
+}
+
+func (tx *Transaction) execUnjail(app *App) error {
+	valLogs.log("Executing unjail")
+
+	account, err := app.fetchAccount(tx.source)
+	if err != nil {
+		//this should not happen
+		valLogs.logError("source account not found: ", err)
+		return errUnknownSource.wrap("%v", err)
+	}
+
+	v, err := app.fetchValidator(app.toAddress(account.schnorrPubKey))
+	if err != nil {
+		valLogs.logError("Validator not found: ", err)
+		return errNotValidator.wrap("%v", err)
+	}
+
+	if !v.jailed() {
+		valLogs.log("Validator is not jailed")
+		return errNotJailed
+	}
+	if v.tombstoned() {
+		valLogs.log("Validator is tombstoned")
+		return errTombstoned
+	}
+	if app.executingHeight() < v.JailedUntil {
+		valLogs.log("Validator is still jailed")
+		return errStillJailed.wrap("until %d", v.JailedUntil)
+	}
+
+	if _, err := tx.execUpdate(app); err != nil {
+		return err
+	}
+
+	v.Status &^= validatorJailed
+	v.JailedUntil = 0
+	v.Missed = 0
+
+	err = app.storeValidator(v)
+	if err != nil {
+		valLogs.logError("Failed to store validator: ", err)
+		return err
+	}
+
+	app.emitEvent(eventUnjail,
+		"account", eventAddress(tx.source),
+		"validator", eventAddress(v.Address),
+	)
+	return nil
+}
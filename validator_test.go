@@ -0,0 +1,166 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	abcitypes "github.com/tendermint/tendermint/abci/types"
+	tmproto "github.com/tendermint/tendermint/proto/tendermint/types"
+	tmtypes "github.com/tendermint/tendermint/types"
+)
+
+// missedBy returns a BeginBlock request of a block v did not sign
+func missedBy(app *App, v *testAccount) abcitypes.RequestBeginBlock {
+	return abcitypes.RequestBeginBlock{
+		Header: tmproto.Header{},
+		LastCommitInfo: abcitypes.LastCommitInfo{Votes: []abcitypes.VoteInfo{
+			{Validator: abcitypes.Validator{Address: app.toAddress(v.pubKey())}},
+		}},
+	}
+}
+
+// doubleSignedBy returns a BeginBlock request with evidence against v
+func doubleSignedBy(app *App, v *testAccount) abcitypes.RequestBeginBlock {
+	return abcitypes.RequestBeginBlock{
+		Header: tmproto.Header{},
+		ByzantineValidators: []abcitypes.Evidence{{
+			Type:      abcitypes.EvidenceType_DUPLICATE_VOTE,
+			Validator: abcitypes.Validator{Address: app.toAddress(v.pubKey())},
+		}},
+	}
+}
+
+func TestValidatorUpdates(t *testing.T) {
+	tests := []struct {
+		name   string
+		jailed bool
+		begin  func(app *App, v *testAccount) abcitypes.RequestBeginBlock
+		tx     func(s *testAccount, v *testAccount, app *App) ([]byte, error)
+		//voting powers reported for the validator, nil for none
+		reported []int64
+	}{
+		{
+			name:     "delegate to an active validator",
+			tx:       func(s, v *testAccount, app *App) ([]byte, error) { return s.signer(t, app).Delegate(v.address, 100) },
+			reported: []int64{1100},
+		},
+		{
+			name:   "delegate to a jailed validator",
+			jailed: true,
+			tx:     func(s, v *testAccount, app *App) ([]byte, error) { return s.signer(t, app).Delegate(v.address, 100) },
+		},
+		{
+			name:   "stake of a jailed validator",
+			jailed: true,
+			tx:     func(_, v *testAccount, app *App) ([]byte, error) { return v.signer(t, app).Stake(100) },
+		},
+		{
+			name:   "late double sign of a jailed validator",
+			jailed: true,
+			begin:  doubleSignedBy,
+		},
+		{
+			name:   "missed block of a jailed validator",
+			jailed: true,
+			begin:  missedBy,
+		},
+		{
+			name:   "unjail",
+			jailed: true,
+			tx:     func(_, v *testAccount, app *App) ([]byte, error) { return v.signer(t, app).Unjail() },
+			//the missed block leaked 1000/256+1 and the slash rounded to zero
+			reported: []int64{996},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			accounts := newTestAccounts(t, 2)
+			params := DefaultAppConfig().genesisParams()
+			params.DowntimeWindow = 1
+			params.JailBlocks = 0
+			app := newTestApp(t, testGenesis(t, accounts, 1000000, params), accounts[0])
+			v := accounts[0]
+
+			if tt.jailed {
+				//missing a block jails the validator, tendermint removes it
+				_, updates := deliverBlock(app, missedBy(app, v))
+				require.Equal(t, 1, len(updates))
+				assert.Equal(t, int64(0), updates[0].Power)
+				app.Commit()
+			}
+
+			req := abcitypes.RequestBeginBlock{Header: tmproto.Header{}}
+			if tt.begin != nil {
+				req = tt.begin(app, v)
+			}
+			var txs [][]byte
+			if tt.tx != nil {
+				tx, err := tt.tx(accounts[1], v, app)
+				require.Nil(t, err)
+				txs = append(txs, tx)
+			}
+
+			results, updates := deliverBlock(app, req, txs...)
+			for _, res := range results {
+				require.Equal(t, uint32(0), res.Code, res.Log)
+			}
+			var reported []int64
+			for _, u := range updates {
+				reported = append(reported, u.Power)
+			}
+			assert.Equal(t, tt.reported, reported)
+			app.Commit()
+		})
+	}
+}
+
+func TestPowerRange(t *testing.T) {
+	accounts := newTestAccounts(t, 2)
+	app := newTestApp(t, testGenesis(t, accounts, 1000000, nil), accounts[0])
+	valAddr := app.toAddress(accounts[0].pubKey())
+
+	//a second validator takes the set 100 below the tendermint limit
+	require.Nil(t, app.storeValidator(&Validator{
+		Address: app.toAddress(accounts[1].pubKey()),
+		PubKey:  accounts[1].pubKey(),
+		Power:   uint64(tmtypes.MaxTotalVotingPower) - 1100,
+	}))
+	commitBlock(t, app)
+
+	tests := []struct {
+		name string
+		tx   func(t *testing.T) ([]byte, error)
+		code uint32
+	}{
+		{"stake above the limit", func(t *testing.T) ([]byte, error) {
+			return accounts[0].signer(t, app).Stake(101)
+		}, errPowerRange.Code},
+		{"delegation above the limit", func(t *testing.T) ([]byte, error) {
+			return accounts[1].signer(t, app).Delegate(accounts[0].address, 101)
+		}, errPowerRange.Code},
+		{"stake up to the limit", func(t *testing.T) ([]byte, error) {
+			return accounts[0].signer(t, app).Stake(100)
+		}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx, err := tt.tx(t)
+			require.Nil(t, err)
+			res := commitBlock(t, app, tx)[0]
+			assert.Equal(t, tt.code, res.Code, res.Log)
+		})
+	}
+
+	//the proposer reward is not paid at the limit, the vote still leaks
+	v, err := app.fetchValidator(valAddr)
+	require.Nil(t, err)
+	require.Equal(t, uint64(1100), v.Power)
+	deliverBlock(app, proposedBy(app, accounts[0]))
+	app.Commit()
+	v, err = app.fetchValidator(valAddr)
+	require.Nil(t, err)
+	assert.Equal(t, uint64(1100-1100/256-1), v.Power)
+}
@@ -0,0 +1,9 @@
+package main
+
+// AppVersion is the protocol version of the state machine, reported to
+// tendermint in Info. It changes with every rule that changes the app hash
+const AppVersion uint64 = 1
+
+// Version of the node software, set at build time with
+// go build -ldflags "-X main.Version=<version>"
+var Version = "dev"